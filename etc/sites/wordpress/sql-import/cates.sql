@@ -1,4 +1,5 @@
 -- key=wtt.term_id
+-- unique=cat_id
 SELECT wtt.term_id AS cat_id, wt.name AS cat_name
      , IFNULL(CONCAT('[', getCategoryParentListObj (wtt.term_id),']'),'[]')  AS categories
 FROM wp_term_taxonomy AS wtt
@@ -1,4 +1,6 @@
 -- key=wp.ID
+-- index=ID
+-- index=cat_id
 select
     wp.ID
      ,tt.term_id as cat_id
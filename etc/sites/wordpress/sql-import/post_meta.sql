@@ -1,4 +1,5 @@
 -- key=wp.ID
+-- index=ID
 SET group_concat_max_len = 10485760;  -- 10MB
 select
     wp.ID
@@ -1,3 +1,4 @@
+-- unique=ID
 SELECT
     wp.ID
      ,wp.post_type
@@ -11,14 +11,63 @@ type Config struct {
 }
 
 type DataSource struct {
-	Host     string
-	Port     int
+	// mysql, postgres, sqlite3, dumpfile
+	Driver string `json:",default=mysql"`
+	Host   string `json:",optional"`
+	Port   int    `json:",optional"`
+	// sqlite3时为数据库文件路径
 	Dbname   string
-	Username string
-	Password string
-	Driver   string
-	TimeZone string
-	InitSql  string
+	Username string `json:",optional"`
+	Password string `json:",optional"`
+	TimeZone string `json:",optional"`
+	InitSql  string `json:",optional"`
+	// 连接串的附加参数, 如mysql的 tls=true, postgres的 sslmode=require
+	Params string `json:",optional"`
+	// 连接池, ConnMaxLifetime单位秒
+	MaxOpenConns    int `json:",default=20"`
+	MaxIdleConns    int `json:",default=5"`
+	ConnMaxLifetime int `json:",default=300"`
+	// 同时执行的查询数上限, 0不限制
+	MaxConcurrency int `json:",optional"`
+}
+
+// MaskRule 导入时脱敏的列, 写入本地db前替换
+type MaskRule struct {
+	// sql-import中的表名
+	Table   string
+	Columns []string
+	// hash: SHA-256, null: 置空, fake: 按列名生成假数据, truncate: 只保留前Length个字符
+	Method string
+	Length int `json:",optional"`
+	// fake的类型: email, phone, name, address, text; 为空时按列名判断
+	Fake string `json:",optional"`
+	// hash和fake的盐, 相同的值在各表中脱敏结果相同, 可用于关联
+	Salt string `json:",optional"`
+}
+
+// DocTransforms etc/sites/{site}/transforms.yaml, 导出时按顺序处理每个文档
+type DocTransforms struct {
+	Transforms []DocTransform
+}
+
+// DocTransform 对查询结果列的一个操作
+type DocTransform struct {
+	// json_decode, php_unserialize, rename, drop, split, cast, lowercase, strip_html, move
+	Op     string
+	Fields []string
+	// 字段所在的对象或对象数组, 如metaArrayJson; 为空时为文档顶层的列
+	In string `json:",optional"`
+	// rename的新字段名, 与Fields一一对应; move的对象名; 其他操作的结果写入文档顶层的这些字段, 为空时写回原字段
+	To []string `json:",optional"`
+	// split的分隔符, 默认逗号
+	Sep string `json:",optional"`
+	// cast的类型: int, float, bool, string
+	Type string `json:",optional"`
+}
+
+// DataSourceGroup 分片数据源组, 各分片的表结构相同
+type DataSourceGroup struct {
+	DataSources []string
 }
 
 type SiteConfig struct {
@@ -35,6 +84,24 @@ type SiteConfig struct {
 	TimeZone    string
 	DocTypeName string
 	DocIdKey    string
+	// 导入行数允许的差异比例, 如0.001; 默认0, 有丢失的行时导入失败
+	MaxMismatchRate float64 `json:",optional"`
+	// 导出前执行ANALYZE, 更新本地db索引的统计信息, 便于关联查询选择索引
+	Analyze bool `json:",optional"`
+	// sql和json文件模板中的自定义变量: {{ .Vars.xxx }}
+	Vars map[string]string `json:",optional"`
+	// 导入时脱敏的列, 脱敏后的数据才写入本地db
+	Masks []MaskRule `json:",optional"`
+	// full: 每次导出到新索引再切换别名(默认); incremental: 直接写入别名指向的索引, 只发送新增和变化的文档
+	ExportMode string `json:",optional"`
+	// 增量导出时删除sql-export中已不存在的文档: hash 与上次导出成功的文档比较, index 与索引中的全部文档比较; 为空时不删除
+	ExportDeletes string `json:",optional"`
+	// ExportDeletes为index时必填: 文档中记录写入时间的字段, sql-export和实时同步都要写入, 只删除早于本次同步开始的文档
+	DeletesTimeField string `json:",optional"`
+	// 一次导出最多删除的文档数, 超过时本次不删除并报错; 0不限制
+	MaxDeletes int `json:",default=1000"`
+	// scripts中每个脚本处理一个文档的时间上限, 毫秒; 0不限制
+	ScriptTimeout int `json:",default=100"`
 }
 
 func (c SiteConfig) EnabledImportLimit() bool {
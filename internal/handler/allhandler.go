@@ -41,16 +41,21 @@ func SqlsyncifyAllHandler(svcCtx *svc.ServiceContext) http.HandlerFunc {
 		}
 		mapLock.Store(req.Site, 1)
 
-		l := logic.NewAllLogic(r.Context(), svcCtx)
+		// query参数用于sql和json文件模板
+		l := logic.NewAllLogic(svc.WithQuery(r.Context(), r.URL.Query()), svcCtx)
 		resp, err := l.All(&req)
 		mapLock.Delete(req.Site)
 
 		if err != nil {
+			if resp != nil && (resp.Import != nil || resp.Transform != nil || len(resp.Scripts) > 0) {
+				// 导入、转换或导出失败时返回执行结果
+				httpx.WriteJsonCtx(r.Context(), w, http.StatusInternalServerError, resp)
+				return
+			}
 			httpx.ErrorCtx(r.Context(), w, err)
 			return
 		}
-		_, _ = w.Write([]byte(resp.Message))
-		httpx.Ok(w)
+		httpx.OkJsonCtx(r.Context(), w, resp)
 
 	}
 }
@@ -4,10 +4,13 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"path/filepath"
 	"sqlsyncify/internal/logic/export"
 	"sqlsyncify/internal/logic/importer"
+	"sqlsyncify/internal/logic/transform"
 	"sqlsyncify/internal/svc"
 	"sqlsyncify/internal/types"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/zeromicro/go-zero/core/logx"
@@ -35,11 +38,16 @@ func (l *AllLogic) All(req *types.Request) (*types.Response, error) {
 		l.Error(req.Site, " failed to load site conf: ", err)
 		return nil, err
 	}
-	db, err := svc.NewDbConn(siteConf.DataSource)
+	if err = svc.CheckMaskedSource(siteConf, siteConf.DataSource); err != nil {
+		l.Error(req.Site, " failed to check DataSource: ", err)
+		return nil, err
+	}
+	db, err := l.svcCtx.DataSources.Get(siteConf.DataSource)
 	if err != nil {
 		l.Error(req.Site, " failed to connect to DataSource: ", err)
 		return nil, err
 	}
+	defer l.svcCtx.DataSources.Put(db)
 
 	//prepare
 	dbLocal, err := svc.NewSqliteConn(req.Site)
@@ -49,7 +57,6 @@ func (l *AllLogic) All(req *types.Request) (*types.Response, error) {
 	}
 
 	defer func() {
-		_ = db.Close()
 		// 执行 PRAGMA wal_checkpoint;
 		// 更积极的模式可以使用 PRAGMA wal_checkpoint(TRUNCATE);
 		// TRUNCATE 选项会在检查点完成后将WAL文件截断回0字节。
@@ -65,23 +72,84 @@ func (l *AllLogic) All(req *types.Request) (*types.Response, error) {
 	if req.TestDataSource {
 		return resp, nil
 	}
+	// sql和json文件模板中的变量
+	tplVars := svc.NewTemplateVars(l.ctx, l.svcCtx.Config, siteConf)
+
+	if req.Plan {
+		// 只生成导入计划, 不导入不导出
+		l.Info(req.Site, " plan import...")
+		plan, err := importer.NewImporter(&importer.Config{
+			Ctx:         l.ctx,
+			Db:          db,
+			DataSources: l.svcCtx.DataSources,
+			DbLocal:     dbLocal,
+			Site:        req.Site,
+			Debug:       req.Debug,
+			AppConf:     l.svcCtx.Config,
+			SiteConf:    siteConf,
+			TplVars:     tplVars,
+		}).Plan()
+		if err != nil {
+			l.Error(req.Site, " plan error:", err)
+			return nil, err
+		}
+		resp.Plan = importPlan(plan)
+		if err = plan.Err(); err != nil {
+			resp.Message = err.Error()
+		}
+		return resp, nil
+	}
 
 	if req.Import {
 		l.Info(req.Site, " start import...")
 		impCfg := importer.Config{
+			Ctx:         l.ctx,
+			Db:          db,
+			DataSources: l.svcCtx.DataSources,
+			DbLocal:     dbLocal,
+			Site:        req.Site,
+			Debug:       req.Debug,
+			Resume:      req.Resume,
+			AppConf:     l.svcCtx.Config,
+			SiteConf:    siteConf,
+			TplVars:     tplVars,
+		}
+		imp := importer.NewImporter(&impCfg)
+		report, err := imp.Run()
+		if report != nil {
+			resp.Import = importReport(report)
+			if err == nil {
+				err = report.Err()
+			}
+		}
+		if err != nil {
+			l.Error(req.Site, " import error:", err)
+			resp.Message = err.Error()
+			return resp, err
+		}
+	}
+
+	if req.Import || req.Export {
+		// 导入后、导出前执行 sql-transform
+		tr := transform.NewTransformer(&transform.Config{
 			Ctx:      l.ctx,
-			Db:       db,
 			DbLocal:  dbLocal,
 			Site:     req.Site,
 			Debug:    req.Debug,
-			AppConf:  l.svcCtx.Config,
 			SiteConf: siteConf,
+			TplVars:  tplVars,
+		})
+		report, err := tr.Run()
+		if report != nil && len(report.Files) > 0 {
+			resp.Transform = transformReport(report)
+			if err == nil {
+				err = report.Err()
+			}
 		}
-		imp := importer.NewImporter(&impCfg)
-		err = imp.Run()
 		if err != nil {
-			l.Error(req.Site, " import error:", err)
-			return nil, err
+			l.Error(req.Site, " transform error:", err)
+			resp.Message = err.Error()
+			return resp, err
 		}
 	}
 
@@ -91,13 +159,20 @@ func (l *AllLogic) All(req *types.Request) (*types.Response, error) {
 		AppConf:  l.svcCtx.Config,
 		SiteConf: siteConf,
 		DbLocal:  dbLocal,
-		Debug:    req.Debug}
+		Debug:    req.Debug,
+		Rebuild:  req.Rebuild,
+		TplVars:  tplVars}
 	exp := export.NewExporter(&conf)
 	if req.Export {
 		l.Info(req.Site, " start export...")
 		successRate, err = exp.Run()
+		resp.Scripts = scriptReports(exp.Scripts())
 		if err != nil {
 			l.Error(req.Site, " export run error:", err)
+			if len(resp.Scripts) > 0 {
+				resp.Message = err.Error()
+				return resp, err
+			}
 			return nil, err
 		}
 		///成功率80%才做alias
@@ -125,3 +200,118 @@ func (l *AllLogic) All(req *types.Request) (*types.Response, error) {
 
 	return resp, nil
 }
+
+// importReport 导入结果转为接口返回的格式
+func importReport(report *importer.Report) *types.ImportReport {
+	ret := &types.ImportReport{
+		Success:  report.Success(),
+		Duration: report.Duration.Round(time.Millisecond).String(),
+		Files:    make([]types.ImportFileReport, 0, len(report.Files)),
+		Tables:   make([]types.ImportTableReport, 0, len(report.Tables)),
+		Writer: types.ImportWriterStats{
+			Rows:          report.Writer.Rows,
+			FailedRows:    report.Writer.FailedRows,
+			Statements:    report.Writer.Statements,
+			Transactions:  report.Writer.Transactions,
+			BusyRetries:   report.Writer.BusyRetries,
+			LockWait:      report.Writer.LockWait.Round(time.Millisecond).String(),
+			Elapsed:       report.Writer.Elapsed.Round(time.Millisecond).String(),
+			RowsPerSecond: report.Writer.RowsPerSecond,
+		},
+	}
+	for _, f := range report.Files {
+		ret.Files = append(ret.Files, types.ImportFileReport{
+			File:            filepath.Base(f.File),
+			Table:           f.Table,
+			ChunksPlanned:   f.ChunksPlanned,
+			ChunksSucceeded: f.ChunksSucceeded,
+			ChunksFailed:    f.ChunksFailed,
+			RowsRead:        f.RowsRead,
+			RowsWritten:     f.RowsWritten,
+			Duration:        f.Duration.Round(time.Millisecond).String(),
+			Errors:          f.Errors,
+			ErrorCount:      f.ErrorCount,
+		})
+	}
+	for _, t := range report.Tables {
+		ret.Tables = append(ret.Tables, types.ImportTableReport{
+			Table:        t.Table,
+			Shard:        t.Shard,
+			Chunks:       t.Chunks,
+			FailedChunks: t.FailedChunks,
+			SourceRows:   t.SourceRows,
+			LocalRows:    t.LocalRows,
+			Missing:      t.Missing,
+			Unknown:      t.Unknown,
+		})
+	}
+	return ret
+}
+
+// transformReport 转换结果转为接口返回的格式
+func transformReport(report *transform.Report) *types.TransformReport {
+	ret := &types.TransformReport{
+		Success:  report.Err() == nil,
+		Duration: report.Duration.Round(time.Millisecond).String(),
+		Files:    make([]types.TransformFileReport, 0, len(report.Files)),
+	}
+	for _, f := range report.Files {
+		ret.Files = append(ret.Files, types.TransformFileReport{
+			File:     f.File,
+			Level:    f.Level,
+			Duration: f.Duration.Round(time.Millisecond).String(),
+			Skipped:  f.Skipped,
+			Error:    f.Error,
+		})
+	}
+	return ret
+}
+
+// scriptReports 导出脚本的执行结果转为接口返回的格式
+func scriptReports(reports []*export.ScriptReport) []types.ExportScriptReport {
+	var ret []types.ExportScriptReport
+	for _, r := range reports {
+		ret = append(ret, types.ExportScriptReport{
+			Script:   r.Script,
+			Docs:     r.Docs,
+			Errors:   r.Errors,
+			Timeouts: r.Timeouts,
+			Dropped:  r.Dropped,
+			Emitted:  r.Emitted,
+			Duration: r.Duration.Round(time.Millisecond).String(),
+			Error:    r.Error,
+		})
+	}
+	return ret
+}
+
+// importPlan 导入计划转为接口返回的格式
+func importPlan(plan *importer.Plan) *types.ImportPlan {
+	ret := &types.ImportPlan{
+		Duration: plan.Duration.Round(time.Millisecond).String(),
+		Files:    make([]types.ImportFilePlan, 0, len(plan.Files)),
+	}
+	for _, f := range plan.Files {
+		ret.Files = append(ret.Files, types.ImportFilePlan{
+			File:          f.File,
+			Table:         f.Table,
+			Level:         f.Level,
+			After:         f.After,
+			Priority:      f.Priority,
+			DataSource:    f.DataSource,
+			Driver:        f.Driver,
+			Key:           f.Key,
+			ChunkMode:     f.ChunkMode,
+			Incremental:   f.Incremental,
+			Watermark:     f.Watermark,
+			MinKey:        f.MinKey,
+			MaxKey:        f.MaxKey,
+			Chunks:        f.Chunks,
+			EstimatedRows: f.EstimatedRows,
+			Sql:           f.Sql,
+			Sqls:          f.Sqls,
+			Error:         f.Error,
+		})
+	}
+	return ret
+}
@@ -21,6 +21,10 @@ func (exp *exporterImplement) Alias() error {
 	if exp.cfg.EsClient == nil {
 		return errors.New("require es client")
 	}
+	if exp.live {
+		log.Println("incremental export to the alias index, do not change alias:", exp.cfg.FullIndexName)
+		return nil
+	}
 	req1 := esapi.IndicesExistsAliasRequest{Name: []string{exp.cfg.SiteConf.AliasName}}
 	res, err := req1.Do(exp.cfg.Ctx, exp.cfg.EsClient)
 	if err != nil {
@@ -44,34 +48,10 @@ func (exp *exporterImplement) Alias() error {
 
 	log.Println("alias has found")
 	// find index name by alias
-	req := esapi.IndicesGetAliasRequest{Name: []string{exp.cfg.SiteConf.AliasName}}
-	resp, err := req.Do(exp.cfg.Ctx, exp.cfg.EsClient)
-	if err != nil {
-		return err
-	}
-	if resp.IsError() {
-		return errors.New("get alias error:" + resp.String())
-	}
-	body := new(bytes.Buffer)
-	_, _ = body.ReadFrom(resp.Body)
-	defer resp.Body.Close()
-
-	// resp.String() = [200 OK] {"test_20240912171638":{"aliases":{"test":{}}}}
-	// 从已有别名中找出索引名: test_20240912171638
-	log.Println("old alias:" + body.String())
-	//map
-	var bodyMap MapResponse
-	err = json.Unmarshal(body.Bytes(), &bodyMap)
+	oldIndex, err := exp.aliasIndex()
 	if err != nil {
 		return err
 	}
-	oldIndex := ""
-	for index := range bodyMap {
-		if strings.HasPrefix(index, ".") {
-			continue
-		}
-		oldIndex = index
-	}
 	if len(oldIndex) == 0 {
 		return errors.New("empty old index name")
 	}
@@ -131,5 +111,47 @@ func (exp *exporterImplement) Alias() error {
 	log.Println(res2.String())
 	res2.Body.Close()
 
+	if exp.hashes != nil {
+		// 旧索引的文档哈希不再使用
+		if err = pruneDocHashes(exp.cfg.Ctx, exp.cfg.DbLocal, exp.cfg.FullIndexName); err != nil {
+			log.Println("prune doc hash error:", err)
+		}
+	}
 	return nil
 }
+
+// aliasIndex 别名当前指向的索引, 别名不存在时返回空
+func (exp *exporterImplement) aliasIndex() (string, error) {
+	req := esapi.IndicesGetAliasRequest{Name: []string{exp.cfg.SiteConf.AliasName}}
+	resp, err := req.Do(exp.cfg.Ctx, exp.cfg.EsClient)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.IsError() {
+		return "", errors.New("get alias error:" + resp.String())
+	}
+	body := new(bytes.Buffer)
+	_, _ = body.ReadFrom(resp.Body)
+
+	// resp.String() = [200 OK] {"test_20240912171638":{"aliases":{"test":{}}}}
+	// 从已有别名中找出索引名: test_20240912171638
+	log.Println("old alias:" + body.String())
+	//map
+	var bodyMap MapResponse
+	err = json.Unmarshal(body.Bytes(), &bodyMap)
+	if err != nil {
+		return "", err
+	}
+	oldIndex := ""
+	for index := range bodyMap {
+		if strings.HasPrefix(index, ".") {
+			continue
+		}
+		oldIndex = index
+	}
+	return oldIndex, nil
+}
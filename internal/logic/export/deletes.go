@@ -0,0 +1,174 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+)
+
+// 增量导出时删除文档的比较来源
+const (
+	// 与上次导出成功记录的文档哈希比较
+	deletesHash = "hash"
+	// 与索引中的全部文档id比较, 适用于还有实时同步写入的索引
+	// 只比较DeletesTimeField早于本次同步开始的文档, 导入之后实时同步写入的文档不在本次导入的数据中, 不能删除
+	deletesIndex = "index"
+)
+
+// 滚动读取索引文档id的每页数量
+const scrollSize = 5000
+
+// initDeletes 增量导出时记录本次导出的文档id, 用于删除已不存在的文档
+func (exp *exporterImplement) initDeletes() error {
+	switch exp.cfg.SiteConf.ExportDeletes {
+	case "":
+		return nil
+	case deletesHash:
+	case deletesIndex:
+		if len(exp.cfg.SiteConf.DeletesTimeField) == 0 {
+			return fmt.Errorf("ExportEs, ExportDeletes index requires DeletesTimeField")
+		}
+	default:
+		return fmt.Errorf("ExportEs, unknown ExportDeletes: %s", exp.cfg.SiteConf.ExportDeletes)
+	}
+	if exp.live {
+		exp.seen = make(map[string]struct{})
+	}
+	return nil
+}
+
+// addDeletes 删除上次有、本次sql-export中没有的文档, 超过MaxDeletes时不删除并返回错误
+func (exp *exporterImplement) addDeletes(bulkIndexer esutil.BulkIndexer) error {
+	if exp.seen == nil {
+		return nil
+	}
+	if exp.incomplete {
+		log.Println("export has errors, skip deletes")
+		return nil
+	}
+	var ids []string
+	var err error
+	if exp.cfg.SiteConf.ExportDeletes == deletesIndex {
+		ids, err = exp.indexIds()
+	} else {
+		ids, err = exp.hashes.docIds()
+	}
+	if err != nil {
+		return fmt.Errorf("ExportEs, get previous doc ids error: %v", err)
+	}
+	var deletes []string
+	for _, id := range ids {
+		if _, ok := exp.seen[id]; !ok {
+			deletes = append(deletes, id)
+		}
+	}
+	maxDeletes := exp.cfg.SiteConf.MaxDeletes
+	if maxDeletes > 0 && len(deletes) > maxDeletes {
+		return fmt.Errorf("ExportEs, %d documents to delete exceed MaxDeletes %d, skip deletes", len(deletes), maxDeletes)
+	}
+	log.Println("ExportEs deletes:", len(deletes))
+	for _, id := range deletes {
+		err = bulkIndexer.Add(exp.cfg.Ctx, esutil.BulkIndexerItem{
+			Action:     "delete",
+			DocumentID: id,
+			OnSuccess:  exp.deleteOnSuccess,
+			OnFailure:  exp.deleteOnFailure,
+		})
+		if err != nil {
+			log.Printf("Unexpected error(bulkIndexer.Add): %s \n", err)
+		}
+	}
+	return nil
+}
+
+func (exp *exporterImplement) deleteOnSuccess(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem) {
+	atomic.AddUint64(&exp.countDeleted, 1)
+	exp.bulkOnSuccess(ctx, item, res)
+	exp.hashes.add(item.DocumentID, "")
+}
+
+// deleteOnFailure 文档已经不存在时也算删除成功
+func (exp *exporterImplement) deleteOnFailure(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+	if err == nil && res.Status == http.StatusNotFound {
+		exp.deleteOnSuccess(ctx, item, res)
+		return
+	}
+	exp.bulkOnFailure(ctx, item, res, err)
+}
+
+type scrollResponse struct {
+	ScrollId string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []struct {
+			Id string `json:"_id"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// indexIds 滚动读取索引中写入时间早于本次同步开始的文档id, 没有时间字段的文档不删除
+func (exp *exporterImplement) indexIds() ([]string, error) {
+	body, err := json.Marshal(map[string]any{
+		"_source": false,
+		"sort":    []string{"_doc"},
+		"query": map[string]any{
+			"range": map[string]any{
+				exp.cfg.SiteConf.DeletesTimeField: map[string]any{"lt": exp.cfg.TplVars.Now.UnixMilli(), "format": "epoch_millis"},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	es := exp.cfg.EsClient
+	res, err := es.Search(
+		es.Search.WithContext(exp.cfg.Ctx),
+		es.Search.WithIndex(exp.cfg.FullIndexName),
+		es.Search.WithScroll(time.Minute),
+		es.Search.WithSize(scrollSize),
+		es.Search.WithBody(bytes.NewReader(body)),
+	)
+	var ids []string
+	scrollId := ""
+	defer func() {
+		if len(scrollId) > 0 {
+			res, err := es.ClearScroll(es.ClearScroll.WithScrollID(scrollId))
+			if err == nil {
+				_ = res.Body.Close()
+			}
+		}
+	}()
+	for {
+		if err != nil {
+			return nil, err
+		}
+		if res.IsError() {
+			_ = res.Body.Close()
+			return nil, fmt.Errorf("scroll error: %s", res.String())
+		}
+		var page scrollResponse
+		err = json.NewDecoder(res.Body).Decode(&page)
+		_ = res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		scrollId = page.ScrollId
+		if len(page.Hits.Hits) == 0 {
+			return ids, nil
+		}
+		for _, hit := range page.Hits.Hits {
+			ids = append(ids, hit.Id)
+		}
+		res, err = es.Scroll(
+			es.Scroll.WithContext(exp.cfg.Ctx),
+			es.Scroll.WithScrollID(scrollId),
+			es.Scroll.WithScroll(time.Minute),
+		)
+	}
+}
@@ -0,0 +1,148 @@
+package export
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// 增量导出的文档内容哈希, 保存在站点本地db中, 按索引名区分
+const docHashTable = "_sqlsyncify_doc_hash"
+
+// 每批写入的哈希数
+const docHashBatch = 5000
+
+// docHashes 索引中每个文档的内容哈希, 文档写入es成功后攒批保存
+type docHashes struct {
+	ctx    context.Context
+	db     *sql.DB
+	index  string
+	lookup *sql.Stmt
+	mu     sync.Mutex
+	buf    [][2]string
+}
+
+func newDocHashes(ctx context.Context, db *sql.DB, index string) (*docHashes, error) {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		index_name TEXT NOT NULL,
+		doc_id TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		updated_at TEXT NOT NULL,
+		PRIMARY KEY (index_name, doc_id)
+	)`, docHashTable))
+	if err != nil {
+		return nil, err
+	}
+	lookup, err := db.PrepareContext(ctx, fmt.Sprintf("SELECT hash FROM %s WHERE index_name = ? AND doc_id = ?", docHashTable))
+	if err != nil {
+		return nil, err
+	}
+	return &docHashes{ctx: ctx, db: db, index: index, lookup: lookup}, nil
+}
+
+// docHash 文档json的哈希, map按键排序编码, 内容相同时哈希相同
+func docHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// changed 文档是新增的或内容有变化
+func (h *docHashes) changed(docId, hash string) bool {
+	var old string
+	err := h.lookup.QueryRowContext(h.ctx, h.index, docId).Scan(&old)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("read doc hash error:", docId, err)
+	}
+	return old != hash
+}
+
+// add 记录写入成功的文档, hash为空时删除记录; 由bulk的协程并发调用
+func (h *docHashes) add(docId, hash string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf = append(h.buf, [2]string{docId, hash})
+	if len(h.buf) >= docHashBatch {
+		h.flushLocked()
+	}
+}
+
+func (h *docHashes) flushLocked() {
+	if len(h.buf) == 0 {
+		return
+	}
+	err := h.save(h.buf)
+	if err != nil {
+		// 未保存的文档下次再导出
+		log.Println("save doc hash error:", err)
+	}
+	h.buf = h.buf[:0]
+}
+
+func (h *docHashes) save(items [][2]string) error {
+	tx, err := h.db.BeginTx(h.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	stmt, err := tx.PrepareContext(h.ctx, fmt.Sprintf("INSERT OR REPLACE INTO %s (index_name, doc_id, hash, updated_at) VALUES (?, ?, ?, ?)", docHashTable))
+	if err != nil {
+		return err
+	}
+	del, err := tx.PrepareContext(h.ctx, fmt.Sprintf("DELETE FROM %s WHERE index_name = ? AND doc_id = ?", docHashTable))
+	if err != nil {
+		return err
+	}
+	now := time.Now().Format(time.DateTime)
+	for _, item := range items {
+		if len(item[1]) == 0 {
+			_, err = del.ExecContext(h.ctx, h.index, item[0])
+		} else {
+			_, err = stmt.ExecContext(h.ctx, h.index, item[0], item[1], now)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// close 保存剩余的哈希
+func (h *docHashes) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.flushLocked()
+	_ = h.lookup.Close()
+}
+
+// docIds 上次导出成功的文档id
+func (h *docHashes) docIds() ([]string, error) {
+	rows, err := h.db.QueryContext(h.ctx, fmt.Sprintf("SELECT doc_id FROM %s WHERE index_name = ?", docHashTable), h.index)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// pruneDocHashes 别名切换到新索引后, 删除其他索引的哈希
+func pruneDocHashes(ctx context.Context, db *sql.DB, index string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE index_name != ?", docHashTable), index)
+	return err
+}
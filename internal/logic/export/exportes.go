@@ -10,6 +10,7 @@ import (
 	"log"
 	"os"
 	"sqlsyncify/internal/config"
+	"sqlsyncify/internal/svc"
 	"sqlsyncify/internal/utils"
 	"strings"
 	"sync/atomic"
@@ -29,11 +30,23 @@ type ExporterConfig struct {
 	FullIndexName string
 	Debug         bool
 	DocIdKey      string
+	// sql和json文件模板中的变量, 为空时只用站点配置和环境变量
+	TplVars *svc.TemplateVars
+	// 增量导出的站点重建索引, 导出到新索引并重新记录文档哈希
+	Rebuild bool
 }
 
+// 站点的导出方式
+const (
+	ExportModeFull        = "full"
+	ExportModeIncremental = "incremental"
+)
+
 type Exporter interface {
 	Run() (uint64, error)
 	Alias() error
+	// Scripts 每个脚本的执行结果, 没有脚本时为nil
+	Scripts() []*ScriptReport
 }
 
 type exporterImplement struct {
@@ -41,6 +54,20 @@ type exporterImplement struct {
 	cfgv5           *ExporterConfigV5
 	countSuccessful uint64
 	countFail       uint64
+	// 增量导出的站点记录文档哈希, 全量导出时为nil
+	hashes *docHashes
+	// 写入别名当前指向的索引, 不建索引不切换别名
+	live           bool
+	countUnchanged uint64
+	// 本次导出的文档id, 增量导出删除文档时不为nil
+	seen map[string]struct{}
+	// 有文件或行导出出错, 文档id不完整时不删除
+	incomplete   bool
+	countDeleted uint64
+	// transforms.yaml 中的文档转换
+	transforms docTransforms
+	// scripts 中的脚本, 没有时为nil
+	scripts *docScripts
 }
 
 // NewExporter 入口
@@ -49,6 +76,9 @@ func NewExporter(config *ExporterConfig) Exporter {
 		// the new index name
 		config.FullIndexName = utils.GenerateIndexName(config.SiteConf.IndexName, config.SiteConf.TimeZone)
 	}
+	if config.TplVars == nil {
+		config.TplVars = svc.NewTemplateVars(config.Ctx, config.AppConf, config.SiteConf)
+	}
 	return &exporterImplement{cfg: config}
 }
 
@@ -77,16 +107,48 @@ func (exp *exporterImplement) initClient() error {
 	return nil
 }
 
+// analyze 导出前更新本地db的统计信息
+func (exp *exporterImplement) analyze() {
+	if !exp.cfg.SiteConf.Analyze {
+		return
+	}
+	start := time.Now()
+	if _, err := exp.cfg.DbLocal.ExecContext(exp.cfg.Ctx, "ANALYZE"); err != nil {
+		log.Println("sqlite ANALYZE error:", err)
+		return
+	}
+	log.Println("sqlite ANALYZE:", time.Since(start))
+}
+
 // Run 导出到es
 func (exp *exporterImplement) Run() (uint64, error) {
+	exp.analyze()
+	if err := exp.initTransforms(); err != nil {
+		return 0, err
+	}
+	if err := exp.initScripts(); err != nil {
+		return 0, err
+	}
 	v, _ := utils.CompareVersion(exp.cfg.SiteConf.EsVersion, "6.0")
 	if v == -1 {
+		if exp.cfg.SiteConf.ExportMode == ExportModeIncremental {
+			log.Println("incremental export requires es 6.0+, full export")
+		}
 		return exp.runV5()
 	}
 	err := exp.initClient()
 	if err != nil {
 		return 0, err
 	}
+	if err = exp.initIncremental(); err != nil {
+		return 0, err
+	}
+	if err = exp.initDeletes(); err != nil {
+		return 0, err
+	}
+	if exp.hashes != nil {
+		defer exp.hashes.close()
+	}
 	log.Println("conf.EsCluster", exp.cfg.SiteConf.EsCluster)
 	if len(exp.cfg.SiteConf.EsCluster) == 0 {
 		return 0, errors.New("ExportEs, cannot empty es cluster addr")
@@ -103,38 +165,39 @@ func (exp *exporterImplement) Run() (uint64, error) {
 	}
 	sqlFiles, _ := utils.ScanDir(dirPath)
 
-	mapping, err := os.ReadFile(fmt.Sprintf("etc/sites/%s/mapping.json", exp.cfg.SiteConf.Site))
+	// setting替换关键词
+	mapping, err := exp.cfg.TplVars.RenderFile(fmt.Sprintf("etc/sites/%s/mapping.json", exp.cfg.SiteConf.Site))
 	if err != nil {
 		return 0, errors.New(fmt.Sprintf("ExportEs, read mapping error: %s", err.Error()))
 	}
-	setting, err := os.ReadFile(fmt.Sprintf("etc/sites/%s/setting.json", exp.cfg.SiteConf.Site))
+	setting, err := exp.cfg.TplVars.RenderFile(fmt.Sprintf("etc/sites/%s/setting.json", exp.cfg.SiteConf.Site))
 	if err != nil {
 		return 0, errors.New(fmt.Sprintf("ExportEs, read setting error: %s", err.Error()))
 	}
 
-	// setting替换关键词
-	setting = exp.filterSetting(setting)
-	mapping = exp.filterSetting(mapping)
-
-	log.Println("ready to create new index:", exp.cfg.FullIndexName)
-	body := fmt.Sprintf(`{
+	if exp.live {
+		log.Println("incremental export to index:", exp.cfg.FullIndexName)
+	} else {
+		log.Println("ready to create new index:", exp.cfg.FullIndexName)
+		body := fmt.Sprintf(`{
 		  "settings": %s,
 		  "mappings": %s
 		}`, setting, mapping)
-	if exp.cfg.Debug {
-		log.Println(body)
-	}
+		if exp.cfg.Debug {
+			log.Println(body)
+		}
 
-	res, err := exp.cfg.EsClient.Indices.Create(exp.cfg.FullIndexName,
-		exp.cfg.EsClient.Indices.Create.WithBody(strings.NewReader(body)),
-	)
-	if err != nil {
-		return 0, errors.New(fmt.Sprintf("ExportEs, cannot create es index: %s", err.Error()))
-	}
-	if res.IsError() {
-		return 0, errors.New(fmt.Sprintf("ExportEs, cannot create es index: %s", res.String()))
+		res, err := exp.cfg.EsClient.Indices.Create(exp.cfg.FullIndexName,
+			exp.cfg.EsClient.Indices.Create.WithBody(strings.NewReader(body)),
+		)
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("ExportEs, cannot create es index: %s", err.Error()))
+		}
+		if res.IsError() {
+			return 0, errors.New(fmt.Sprintf("ExportEs, cannot create es index: %s", res.String()))
+		}
+		_ = res.Body.Close()
 	}
-	_ = res.Body.Close()
 
 	// Create the BulkIndexer
 	//
@@ -159,8 +222,14 @@ func (exp *exporterImplement) Run() (uint64, error) {
 		err = exp.loadDataFromSqlFile(file, bulkIndexer)
 		if err != nil {
 			log.Println(file, err)
+			exp.incomplete = true
 		}
 	}
+	// 删除已不存在的文档, 超过上限时照常完成写入再返回错误
+	deleteErr := exp.addDeletes(bulkIndexer)
+	if deleteErr != nil {
+		log.Println(deleteErr)
+	}
 
 	log.Println("waiting for all workers...")
 	// waiting and close the indexer
@@ -189,31 +258,65 @@ func (exp *exporterImplement) Run() (uint64, error) {
 			)
 		}
 	}
-	log.Println("ExportEs done, numErrors:", biStats.NumFailed, ", ", "numSuccess:", biStats.NumFlushed)
+	log.Println("ExportEs done, numErrors:", biStats.NumFailed, ", ", "numSuccess:", biStats.NumFlushed, ", ", "numUnchanged:", exp.countUnchanged, ", ", "numDeleted:", exp.countDeleted)
 	if biStats.NumFlushed+biStats.NumFailed == 0 {
-		return 0, nil
+		if exp.live {
+			// 没有变化的文档
+			return 100, deleteErr
+		}
+		return 0, deleteErr
 	}
 	percent := uint64((float32(biStats.NumFlushed) / float32(biStats.NumFlushed+biStats.NumFailed)) * 100)
-	return percent, nil
+	return percent, deleteErr
+}
+
+// initIncremental 增量导出的站点写入别名当前指向的索引
+// 重建或别名还不存在时导出到新索引, 同时记录文档哈希
+func (exp *exporterImplement) initIncremental() error {
+	if exp.cfg.SiteConf.ExportMode != ExportModeIncremental {
+		return nil
+	}
+	if !exp.cfg.Rebuild {
+		index, err := exp.aliasIndex()
+		if err != nil {
+			return fmt.Errorf("ExportEs, get alias index error: %v", err)
+		}
+		if len(index) > 0 {
+			exp.cfg.FullIndexName, exp.live = index, true
+		} else {
+			log.Println("alias not found, rebuild index:", exp.cfg.SiteConf.AliasName)
+		}
+	}
+	hashes, err := newDocHashes(exp.cfg.Ctx, exp.cfg.DbLocal, exp.cfg.FullIndexName)
+	if err != nil {
+		return fmt.Errorf("ExportEs, init doc hash error: %v", err)
+	}
+	exp.hashes = hashes
+	return nil
 }
 
 // 装载数据
 func (exp *exporterImplement) loadDataFromSqlFile(file string, bulkIndexer esutil.BulkIndexer) error {
 	log.Println("Load File:", file)
-	sqlf, err := os.ReadFile(file)
+	sqlStr, err := exp.cfg.TplVars.RenderFile(file)
 	if err != nil {
 		return err
 	}
-	sqlStr := string(sqlf)
 	// 不以SELECT开头的,就不用处理查询结果
 	// 原则上一个站点一次只做写入一个索引, 但是可以做SQL分页查询导出到同一个索引
 	if false == utils.IsPrefix(sqlStr, "SELECT") {
-		_, err = exp.cfg.DbLocal.Exec(sqlStr)
+		_, err = exp.cfg.DbLocal.ExecContext(exp.cfg.Ctx, sqlStr)
 		if err != nil {
-			log.Fatalln(file, " error:", err)
+			return fmt.Errorf("error at exec sql:%v", err)
 		}
 		return nil
 	}
+	// 子表按父文档id合并为数组: -- nest=meta:post_meta.ID
+	nests, sqlStr, err := openNests(exp.cfg.Ctx, exp.cfg.DbLocal, sqlStr, exp.cfg.SiteConf.DocIdKey)
+	if err != nil {
+		return fmt.Errorf("error at nest: %v", err)
+	}
+	defer nests.close()
 	rows, err := exp.cfg.DbLocal.QueryContext(exp.cfg.Ctx, sqlStr)
 	if err != nil {
 		return fmt.Errorf("error euery: %v", err)
@@ -241,6 +344,7 @@ func (exp *exporterImplement) loadDataFromSqlFile(file string, bulkIndexer esuti
 		// 扫描每一行数据
 		if err := rows.Scan(valuePtrs...); err != nil {
 			log.Printf("Error scanning row: %v\n", err)
+			exp.incomplete = true
 			continue
 		}
 		// 将结果存储到map中
@@ -256,43 +360,74 @@ func (exp *exporterImplement) loadDataFromSqlFile(file string, bulkIndexer esuti
 			result[col] = v
 		}
 		primaryKey := exp.cfg.SiteConf.DocIdKey
+		if err = nests.merge(result); err != nil {
+			return err
+		}
 
 		exp.formatFields(result)
-
-		// Prepare the data payload: encode article to JSON
-		//
-		jsonBody, err := json.Marshal(result)
+		// 脚本处理后的文档, 可能丢弃或拆分为多个
+		docs, err := exp.scripts.run(result)
 		if err != nil {
-			log.Printf("Cannot encode sku %s: %s \n", result[primaryKey], err)
+			log.Println(err)
+			exp.incomplete = true
 			continue
 		}
-		if count < 1 {
-			log.Println(string(jsonBody))
-		}
-		count++
+		for _, result := range docs {
+			// Prepare the data payload: encode article to JSON
+			//
+			jsonBody, err := json.Marshal(result)
+			if err != nil {
+				log.Printf("Cannot encode sku %s: %s \n", result[primaryKey], err)
+				exp.incomplete = true
+				continue
+			}
+			if count < 1 {
+				log.Println(string(jsonBody))
+			}
+			count++
 
-		// Add an item to the BulkIndexer
-		//
-		docId := fmt.Sprintf("%v", result[primaryKey])
-		err = bulkIndexer.Add(
-			exp.cfg.Ctx,
-			esutil.BulkIndexerItem{
-				// Action field configures the operation to perform (index, create, delete, update)
-				Action: "index",
-				// DocumentID is the (optional) document ID
-				DocumentID: docId,
-				// Body is an `io.Reader` with the payload
-				Body: bytes.NewReader(jsonBody),
-				// OnSuccess is called for each successful operation
-				OnSuccess: exp.bulkOnSuccess,
-				// OnFailure is called for each failed operation
-				OnFailure: exp.bulkOnFailure,
-			},
-		)
-		if err != nil {
-			log.Printf("Unexpected error(bulkIndexer.Add): %s \n", err)
+			// Add an item to the BulkIndexer
+			//
+			docId := fmt.Sprintf("%v", result[primaryKey])
+			if exp.seen != nil {
+				exp.seen[docId] = struct{}{}
+			}
+			onSuccess := exp.bulkOnSuccess
+			if exp.hashes != nil {
+				// 增量导出跳过内容没有变化的文档, 写入成功后记录哈希
+				hash := docHash(jsonBody)
+				if exp.live && !exp.hashes.changed(docId, hash) {
+					exp.countUnchanged++
+					continue
+				}
+				onSuccess = func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem) {
+					exp.bulkOnSuccess(ctx, item, res)
+					exp.hashes.add(item.DocumentID, hash)
+				}
+			}
+			err = bulkIndexer.Add(
+				exp.cfg.Ctx,
+				esutil.BulkIndexerItem{
+					// Action field configures the operation to perform (index, create, delete, update)
+					Action: "index",
+					// DocumentID is the (optional) document ID
+					DocumentID: docId,
+					// Body is an `io.Reader` with the payload
+					Body: bytes.NewReader(jsonBody),
+					// OnSuccess is called for each successful operation
+					OnSuccess: onSuccess,
+					// OnFailure is called for each failed operation
+					OnFailure: exp.bulkOnFailure,
+				},
+			)
+			if err != nil {
+				log.Printf("Unexpected error(bulkIndexer.Add): %s \n", err)
+			}
 		}
 	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error reading rows: %v", err)
+	}
 	return nil
 }
 
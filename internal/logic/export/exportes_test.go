@@ -0,0 +1,267 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sqlsyncify/internal/config"
+	"sqlsyncify/internal/svc"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEs 记录bulk写入和删除的文档、新建的索引
+type fakeEs struct {
+	mu      sync.Mutex
+	alias   string
+	created []string
+	docs    []string
+	deleted []string
+	// 索引中的文档id和写入时间, 滚动读取时按range查询的lt过滤
+	ids map[string]time.Time
+}
+
+// searchBody indexIds 的查询, 只有一个range条件
+type searchBody struct {
+	Query struct {
+		Range map[string]struct {
+			Lt int64 `json:"lt"`
+		} `json:"range"`
+	} `json:"query"`
+}
+
+func (f *fakeEs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/_alias/"):
+		if len(f.alias) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{%q:{"aliases":{"demo":{}}}}`, f.alias)
+	case r.URL.Path == "/_aliases":
+		_, _ = w.Write([]byte(`{"acknowledged":true}`))
+	case strings.HasSuffix(r.URL.Path, "/_search"):
+		var body searchBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Query.Range) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		var hits []string
+		for _, cond := range body.Query.Range {
+			for id, written := range f.ids {
+				if written.UnixMilli() < cond.Lt {
+					hits = append(hits, fmt.Sprintf(`{"_id":%q}`, id))
+				}
+			}
+		}
+		_, _ = fmt.Fprintf(w, `{"_scroll_id":"s1","hits":{"hits":[%s]}}`, strings.Join(hits, ","))
+	case r.URL.Path == "/_search/scroll":
+		_, _ = w.Write([]byte(`{"_scroll_id":"s1","hits":{"hits":[]}}`))
+	case strings.HasSuffix(r.URL.Path, "/_bulk"):
+		var items []string
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var meta map[string]map[string]string
+			if err := json.Unmarshal(scanner.Bytes(), &meta); err != nil {
+				continue
+			}
+			if id, ok := meta["delete"]["_id"]; ok {
+				f.deleted = append(f.deleted, id)
+				items = append(items, fmt.Sprintf(`{"delete":{"_id":%q,"status":200}}`, id))
+				continue
+			}
+			id := meta["index"]["_id"]
+			f.docs = append(f.docs, id)
+			items = append(items, fmt.Sprintf(`{"index":{"_id":%q,"status":200}}`, id))
+			scanner.Scan()
+		}
+		_, _ = fmt.Fprintf(w, `{"errors":false,"items":[%s]}`, strings.Join(items, ","))
+	case r.Method == http.MethodPut:
+		f.created = append(f.created, strings.Trim(r.URL.Path, "/"))
+		_, _ = w.Write([]byte(`{"acknowledged":true}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{}`))
+	}
+}
+
+// sent 取出上次导出后写入和删除的文档, bulk的多个协程顺序不定, 按id排序
+func (f *fakeEs) sent() (string, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sort.Strings(f.docs)
+	sort.Strings(f.deleted)
+	docs, deleted := strings.Join(f.docs, ","), strings.Join(f.deleted, ",")
+	f.docs, f.deleted = nil, nil
+	return docs, deleted
+}
+
+// newTestSite 切换到临时目录, 写入站点demo的文件(路径相对于临时目录), 打开本地db
+func newTestSite(t *testing.T, files map[string]string) *sql.DB {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll("storage", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dbLocal, err := svc.NewSqliteConn("demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = dbLocal.Close()
+	})
+	return dbLocal
+}
+
+// TestIncrementalExport 增量导出只发送新增和变化的文档, rebuild=1 导出到新索引
+func TestIncrementalExport(t *testing.T) {
+	dbLocal := newTestSite(t, map[string]string{
+		"etc/sites/demo/mapping.json":         `{"properties": {"title": {"type": "text"}}}`,
+		"etc/sites/demo/setting.json":         `{}`,
+		"etc/sites/demo/sql-export/posts.sql": "SELECT id, title FROM posts ORDER BY id",
+	})
+	_, err := dbLocal.Exec("CREATE TABLE posts (id INTEGER PRIMARY KEY, title TEXT); INSERT INTO posts VALUES (1, 'a'), (2, 'b'), (3, 'c')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := &fakeEs{alias: "demo_1"}
+	server := httptest.NewServer(es)
+	defer server.Close()
+
+	run := func(rebuild bool) Exporter {
+		exp := NewExporter(&ExporterConfig{
+			Ctx:           context.Background(),
+			DbLocal:       dbLocal,
+			FullIndexName: "demo_2",
+			Rebuild:       rebuild,
+			SiteConf: &config.SiteConfig{Site: "demo", IndexName: "demo", AliasName: "demo", EsVersion: "8.7",
+				EsCluster: server.URL, DocIdKey: "id", ExportMode: ExportModeIncremental},
+		})
+		rate, err := exp.Run()
+		if err != nil || rate != 100 {
+			t.Fatalf("export rate = %d, %v", rate, err)
+		}
+		return exp
+	}
+
+	run(false)
+	if got, _ := es.sent(); got != "1,2,3" || len(es.created) != 0 {
+		t.Errorf("first export sent %s, created %v", got, es.created)
+	}
+	if err = run(false).Alias(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := es.sent(); got != "" {
+		t.Errorf("unchanged export sent %s", got)
+	}
+	if _, err = dbLocal.Exec("UPDATE posts SET title = 'b2' WHERE id = 2; INSERT INTO posts VALUES (4, 'd')"); err != nil {
+		t.Fatal(err)
+	}
+	run(false)
+	if got, _ := es.sent(); got != "2,4" {
+		t.Errorf("changed export sent %s", got)
+	}
+
+	if err = run(true).Alias(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := es.sent(); got != "1,2,3,4" || strings.Join(es.created, ",") != "demo_2" {
+		t.Errorf("rebuild sent %s, created %v", got, es.created)
+	}
+	var indexes string
+	if err = dbLocal.QueryRow(fmt.Sprintf("SELECT group_concat(DISTINCT index_name) FROM %s", docHashTable)).Scan(&indexes); err != nil || indexes != "demo_2" {
+		t.Errorf("doc hashes after rebuild: %s %v", indexes, err)
+	}
+}
+
+// TestExportDeletes 删除sql-export中已不存在的文档, 超过MaxDeletes时不删除
+func TestExportDeletes(t *testing.T) {
+	dbLocal := newTestSite(t, map[string]string{
+		"etc/sites/demo/mapping.json":         `{}`,
+		"etc/sites/demo/setting.json":         `{}`,
+		"etc/sites/demo/sql-export/posts.sql": "SELECT id, title FROM posts WHERE status = 'publish'",
+	})
+	_, err := dbLocal.Exec("CREATE TABLE posts (id INTEGER PRIMARY KEY, title TEXT, status TEXT); INSERT INTO posts VALUES (1, 'a', 'publish'), (2, 'b', 'publish'), (3, 'c', 'publish'), (4, 'd', 'publish')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := &fakeEs{alias: "demo_1"}
+	server := httptest.NewServer(es)
+	defer server.Close()
+
+	timeField := ""
+	run := func(deletes string, maxDeletes int) error {
+		_, err := NewExporter(&ExporterConfig{
+			Ctx:     context.Background(),
+			DbLocal: dbLocal,
+			SiteConf: &config.SiteConfig{Site: "demo", IndexName: "demo", AliasName: "demo", EsVersion: "8.7", EsCluster: server.URL,
+				DocIdKey: "id", ExportMode: ExportModeIncremental, ExportDeletes: deletes, MaxDeletes: maxDeletes, DeletesTimeField: timeField},
+		}).Run()
+		return err
+	}
+	if err = run(deletesHash, 1); err != nil {
+		t.Fatal(err)
+	}
+	es.sent()
+
+	// 超过上限时不删除
+	if _, err = dbLocal.Exec("UPDATE posts SET status = 'draft' WHERE id IN (2, 3)"); err != nil {
+		t.Fatal(err)
+	}
+	if err = run(deletesHash, 1); err == nil || !strings.Contains(err.Error(), "MaxDeletes") {
+		t.Errorf("exceed MaxDeletes: want error, got %v", err)
+	}
+	if _, deleted := es.sent(); deleted != "" {
+		t.Errorf("exceed MaxDeletes deleted %s", deleted)
+	}
+	if err = run(deletesHash, 2); err != nil {
+		t.Fatal(err)
+	}
+	if docs, deleted := es.sent(); docs != "" || deleted != "2,3" {
+		t.Errorf("deletes by hash: sent %s, deleted %s", docs, deleted)
+	}
+	// 已删除的文档不再记录
+	if err = run(deletesHash, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, deleted := es.sent(); deleted != "" {
+		t.Errorf("deleted again: %s", deleted)
+	}
+
+	// 实时同步写入索引的文档也按索引中的id删除, 同步开始后写入的文档不在本次导入的数据中, 不删除
+	if err = run(deletesIndex, 0); err == nil || !strings.Contains(err.Error(), "DeletesTimeField") {
+		t.Errorf("index deletes without DeletesTimeField: want error, got %v", err)
+	}
+	timeField = "modified"
+	past := time.Now().Add(-time.Hour)
+	es.ids = map[string]time.Time{"1": past, "4": past, "9": past, "10": time.Now().Add(time.Hour)}
+	if err = run(deletesIndex, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, deleted := es.sent(); deleted != "9" {
+		t.Errorf("deletes by index: deleted %s", deleted)
+	}
+}
@@ -100,17 +100,15 @@ func (exp *exporterImplement) runV5() (uint64, error) {
 	}
 	sqlFiles, _ := utils.ScanDir(dirPath)
 
-	mapping, err := os.ReadFile(fmt.Sprintf("etc/sites/%s/mapping_v5.json", exp.cfg.SiteConf.Site))
+	// setting替换关键词
+	mapping, err := exp.cfg.TplVars.RenderFile(fmt.Sprintf("etc/sites/%s/mapping_v5.json", exp.cfg.SiteConf.Site))
 	if err != nil {
 		return 0, errors.New("ExportEs, read mapping error:" + err.Error())
 	}
-	setting, err := os.ReadFile(fmt.Sprintf("etc/sites/%s/setting_v5.json", exp.cfg.SiteConf.Site))
+	setting, err := exp.cfg.TplVars.RenderFile(fmt.Sprintf("etc/sites/%s/setting_v5.json", exp.cfg.SiteConf.Site))
 	if err != nil {
 		return 0, errors.New("ExportEs, read setting error:" + err.Error())
 	}
-	// setting替换关键词
-	setting = exp.filterSetting(setting)
-	mapping = exp.filterSetting(mapping)
 
 	log.Println("ready to create new index:", exp.cfg.FullIndexName)
 	body := fmt.Sprintf(`{
@@ -290,11 +288,10 @@ func (exp *exporterImplement) loadDataFromSqlFileV5(file string) error {
 	// es 5.6 doc type 不能以下滑线开头
 	docType = strings.TrimPrefix(docType, "_")
 
-	sqlf, err := os.ReadFile(file)
+	sqlStr, err := exp.cfg.TplVars.RenderFile(file)
 	if err != nil {
 		return fmt.Errorf("readFile error:%v", err)
 	}
-	sqlStr := string(sqlf)
 	log.Println(sqlStr)
 	// 不以SELECT开头的,就不用处理查询结果
 	if sel := utils.IsPrefix(sqlStr, "SELECT"); !sel {
@@ -304,6 +301,12 @@ func (exp *exporterImplement) loadDataFromSqlFileV5(file string) error {
 		}
 		return nil
 	}
+	// 子表按父文档id合并为数组: -- nest=meta:post_meta.ID
+	nests, sqlStr, err := openNests(exp.cfg.Ctx, exp.cfg.DbLocal, sqlStr, exp.cfg.SiteConf.DocIdKey)
+	if err != nil {
+		return fmt.Errorf("nest error:%v", err)
+	}
+	defer nests.close()
 	rows, err := exp.cfg.DbLocal.QueryContext(exp.cfg.Ctx, sqlStr)
 	if err != nil {
 		return fmt.Errorf("query error:%v", err)
@@ -345,25 +348,35 @@ func (exp *exporterImplement) loadDataFromSqlFileV5(file string) error {
 		}
 
 		primaryKey := exp.cfg.SiteConf.DocIdKey
+		if err = nests.merge(result); err != nil {
+			return err
+		}
 		exp.formatFields(result)
-
-		// Prepare the data payload: encode article to JSON
-		//
-		jsonBody, err := json.Marshal(result)
+		// 脚本处理后的文档, 可能丢弃或拆分为多个
+		docs, err := exp.scripts.run(result)
 		if err != nil {
-			log.Printf("error: fail at encode sku %v: %v \n", result[primaryKey], err)
+			log.Println(err)
 			continue
 		}
-		docId := fmt.Sprintf("%v", result[primaryKey])
-		// Prepare the metadata payload
-		//
-		meta := []byte(fmt.Sprintf(`{"index":{"_id":"%s","_type":"%s"}}%s`, docId, docType, "\n"))
-
-		// Append newline to the data payload
-		//
-		jsonBody = append(jsonBody, "\n"...) // <-- Comment out to trigger failure for batch
-		// 在协程中再去积攒批量
-		exp.cfgv5.ChBatch <- &bulkIndexerItemV5{DocumentID: docId, docType: docType, Body: jsonBody, Meta: meta}
+		for _, result := range docs {
+			// Prepare the data payload: encode article to JSON
+			//
+			jsonBody, err := json.Marshal(result)
+			if err != nil {
+				log.Printf("error: fail at encode sku %v: %v \n", result[primaryKey], err)
+				continue
+			}
+			docId := fmt.Sprintf("%v", result[primaryKey])
+			// Prepare the metadata payload
+			//
+			meta := []byte(fmt.Sprintf(`{"index":{"_id":"%s","_type":"%s"}}%s`, docId, docType, "\n"))
+
+			// Append newline to the data payload
+			//
+			jsonBody = append(jsonBody, "\n"...) // <-- Comment out to trigger failure for batch
+			// 在协程中再去积攒批量
+			exp.cfgv5.ChBatch <- &bulkIndexerItemV5{DocumentID: docId, docType: docType, Body: jsonBody, Meta: meta}
+		}
 
 	}
 	return nil
@@ -1,105 +1,291 @@
 package export
 
 import (
-	"bytes"
 	"encoding/json"
-	"github.com/leeqvip/gophp"
+	"fmt"
+	"html"
 	"log"
-	"sqlsyncify/internal/utils"
+	"regexp"
+	"sqlsyncify/internal/config"
+	"sqlsyncify/internal/svc"
+	"strconv"
+	"strings"
+
+	"github.com/leeqvip/gophp"
 )
 
-// setting替换关键词
-func (exp *exporterImplement) filterSetting(setting []byte) []byte {
-	setting = bytes.ReplaceAll(setting, []byte("{host}"), []byte(exp.cfg.AppConf.AppHost))
-	setting = bytes.ReplaceAll(setting, []byte("{site}"), []byte(exp.cfg.SiteConf.Site))
-	setting = bytes.ReplaceAll(setting, []byte("{lang}"), []byte(exp.cfg.SiteConf.Lang))
-	return setting
-}
+// transforms.yaml 中的操作
+const (
+	opJsonDecode     = "json_decode"
+	opPhpUnserialize = "php_unserialize"
+	opRename         = "rename"
+	opDrop           = "drop"
+	opSplit          = "split"
+	opCast           = "cast"
+	opLowercase      = "lowercase"
+	opStripHtml      = "strip_html"
+	// 把字段移入一个对象
+	opMove = "move"
+)
 
-// 处理json字段
-func (exp *exporterImplement) formatFields(result map[string]any) {
+var (
+	htmlScriptRe = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+	htmlTagRe    = regexp.MustCompile(`(?s)<[^>]*>`)
+)
 
-	fieldList := []string{
-		"categories", "metaArrayJson",
-	}
-	exp.formatJsonFields(fieldList, result)
+// docTransforms 站点的文档转换, 按顺序处理查询结果的每一行
+type docTransforms []config.DocTransform
 
-	metaJson, ok := result["metaArrayJson"]
-	if !ok {
-		return
+// newDocTransforms 检查transforms.yaml中的操作
+func newDocTransforms(items []config.DocTransform) (docTransforms, error) {
+	for n, t := range items {
+		if len(t.Fields) == 0 {
+			return nil, fmt.Errorf("transform %d %s: fields are required", n, t.Op)
+		}
+		switch t.Op {
+		case opRename:
+			if len(t.To) != len(t.Fields) {
+				return nil, fmt.Errorf("transform %d rename: to must match fields", n)
+			}
+		case opMove:
+			if len(t.To) != 1 {
+				return nil, fmt.Errorf("transform %d move: to must be one object name", n)
+			}
+		case opCast:
+			switch t.Type {
+			case "int", "float", "bool", "string":
+			default:
+				return nil, fmt.Errorf("transform %d cast: unknown type %s", n, t.Type)
+			}
+			fallthrough
+		case opJsonDecode, opPhpUnserialize, opSplit, opLowercase, opStripHtml:
+			if len(t.To) > 0 && len(t.To) != len(t.Fields) {
+				return nil, fmt.Errorf("transform %d %s: to must match fields", n, t.Op)
+			}
+		case opDrop:
+		default:
+			return nil, fmt.Errorf("transform %d: unknown op %s", n, t.Op)
+		}
 	}
+	return items, nil
+}
 
-	seriaKeys := []string{"_wp_attachment_metadata", "_product_attributes"}
-	meta, ok2 := metaJson.([]interface{})
-	if !ok2 {
-		return
+// initTransforms 读取站点的 transforms.yaml, 没有时不转换
+func (exp *exporterImplement) initTransforms() error {
+	items, err := svc.LoadDocTransforms(exp.cfg.SiteConf.Site)
+	if err != nil {
+		return fmt.Errorf("ExportEs, read transforms error: %v", err)
 	}
-	exp.phpUnSerialize(seriaKeys, meta, result)
+	exp.transforms, err = newDocTransforms(items)
+	if err != nil {
+		return fmt.Errorf("ExportEs, transforms error: %v", err)
+	}
+	return nil
+}
 
+// 处理结果中的字段
+func (exp *exporterImplement) formatFields(result map[string]any) {
+	exp.transforms.apply(result)
+}
+
+func (ts docTransforms) apply(doc map[string]any) {
+	for _, t := range ts {
+		for _, obj := range transformTargets(doc, t.In) {
+			switch t.Op {
+			case opRename:
+				for n, field := range t.Fields {
+					if v, ok := obj[field]; ok {
+						delete(obj, field)
+						obj[t.To[n]] = v
+					}
+				}
+			case opDrop:
+				for _, field := range t.Fields {
+					delete(obj, field)
+				}
+			case opMove:
+				moved, ok := obj[t.To[0]].(map[string]any)
+				if !ok {
+					moved = make(map[string]any)
+				}
+				for _, field := range t.Fields {
+					if v, ok := obj[field]; ok {
+						delete(obj, field)
+						moved[field] = v
+					}
+				}
+				if len(moved) > 0 {
+					obj[t.To[0]] = moved
+				}
+			default:
+				for n, field := range t.Fields {
+					v, ok := obj[field]
+					if !ok {
+						continue
+					}
+					v = transformValue(t, field, v)
+					// 从对象中取出的值写入文档顶层
+					if len(t.To) > 0 {
+						doc[t.To[n]] = v
+					} else {
+						obj[field] = v
+					}
+				}
+			}
+		}
+	}
 }
 
-func (exp *exporterImplement) metaMapKeys(k string) string {
-	internalMapKeys := make(map[string]string)
-	internalMapKeys["_wp_attachment_metadata"] = "wp_attachment_meta_data"
-	internalMapKeys["_product_attributes"] = "product_attributes"
-	if ret, ok := internalMapKeys[k]; ok {
+// transformTargets 操作的对象: 文档本身, 或文档中的对象、对象数组
+func transformTargets(doc map[string]any, in string) []map[string]any {
+	if len(in) == 0 {
+		return []map[string]any{doc}
+	}
+	switch v := doc[in].(type) {
+	case map[string]any:
+		return []map[string]any{v}
+	case []any:
+		var ret []map[string]any
+		for _, item := range v {
+			if m, ok := item.(map[string]any); ok {
+				ret = append(ret, m)
+			}
+		}
 		return ret
 	}
-	return k
+	return nil
 }
 
-func (exp *exporterImplement) phpUnSerialize(keys []string, metaJson []interface{}, result map[string]any) {
-	for i, m := range metaJson {
-		metaMaps := m.(map[string]interface{})
-		for k, val := range metaMaps {
-			if utils.InArray(keys, k) == false {
-				continue
+func transformValue(t config.DocTransform, field string, v any) any {
+	switch t.Op {
+	case opJsonDecode:
+		s, ok := v.(string)
+		if !ok {
+			return v
+		}
+		if len(s) == 0 {
+			return nil
+		}
+		var obj any
+		if err := json.Unmarshal([]byte(s), &obj); err != nil {
+			log.Printf("json decode field: %s, error:%v\n%v", field, err, s)
+			return v
+		}
+		return obj
+	case opPhpUnserialize:
+		s, ok := v.(string)
+		if !ok {
+			return v
+		}
+		if len(s) == 0 {
+			return nil
+		}
+		obj, err := gophp.Unserialize([]byte(s))
+		if err != nil {
+			log.Println("phpUnserialize fail:", field, err, s)
+			return nil
+		}
+		return obj
+	case opSplit:
+		s, ok := v.(string)
+		if !ok {
+			return v
+		}
+		sep := t.Sep
+		if len(sep) == 0 {
+			sep = ","
+		}
+		ret := make([]string, 0)
+		for _, item := range strings.Split(s, sep) {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				ret = append(ret, item)
 			}
-			vv, ok := val.(string)
-			if ok {
-				tmpv, err := gophp.Unserialize([]byte(vv))
-				if err == nil {
-					result[exp.metaMapKeys(k)] = tmpv
-				} else {
-					log.Println("phpUnserialize fail:", err, vv)
-					result[exp.metaMapKeys(k)] = nil
-				}
+		}
+		return ret
+	case opCast:
+		if v == nil {
+			return nil
+		}
+		ret, err := castValue(t.Type, v)
+		if err != nil {
+			log.Printf("cast field: %s to %s, error:%v", field, t.Type, err)
+			return nil
+		}
+		return ret
+	case opLowercase:
+		return mapStrings(v, strings.ToLower)
+	case opStripHtml:
+		return mapStrings(v, stripHtml)
+	}
+	return v
+}
+
+// castValue sqlite的整数为int64, 小数为float64, 文本为string
+func castValue(typ string, v any) (any, error) {
+	s := strings.TrimSpace(fmt.Sprint(v))
+	switch typ {
+	case "int":
+		switch n := v.(type) {
+		case int64:
+			return n, nil
+		case float64:
+			return int64(n), nil
+		case bool:
+			if n {
+				return int64(1), nil
 			}
-			metaJson = utils.RemoveElement(metaJson, i)
-		}
-		//if k, ok1 := meta["meta_key"]; ok1 {
-		//	if k == nil || utils.InArray(keys, k.(string)) == false {
-		//		continue
-		//	}
-		//	if v, ok2 := meta["meta_value"]; ok2 != false {
-		//		tmpv, err := gophp.Unserialize([]byte(v.(string)))
-		//		if err == nil {
-		//			result[exp.metaMapKeys(k.(string))] = tmpv
-		//		} else {
-		//			log.Println("phpUnserialize fail:", err, v)
-		//			result[exp.metaMapKeys(k.(string))] = nil
-		//		}
-		//	}
-		//	metaJson = utils.RemoveElement(metaJson, i)
-		//}
+			return int64(0), nil
+		}
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		return int64(f), err
+	case "float":
+		if n, ok := v.(int64); ok {
+			return float64(n), nil
+		}
+		return strconv.ParseFloat(s, 64)
+	case "bool":
+		switch n := v.(type) {
+		case int64:
+			return n != 0, nil
+		case float64:
+			return n != 0, nil
+		}
+		return strconv.ParseBool(s)
 	}
+	return fmt.Sprint(v), nil
 }
 
-// 需要json解码的字段处理
-func (exp *exporterImplement) formatJsonFields(fields []string, result map[string]any) {
-	var err error
-	for _, field := range fields {
-		var tmpObj []interface{}
-		tmp, ok5 := result[field].(string)
-		if ok5 && len(tmp) > 0 {
-			err = json.Unmarshal([]byte(tmp), &tmpObj)
-			if err != nil {
-				log.Printf("json decode field: %s, error:%v\n%v", field, err, tmp)
-				continue
+// mapStrings 处理字符串和字符串数组
+func mapStrings(v any, f func(string) string) any {
+	switch s := v.(type) {
+	case string:
+		return f(s)
+	case []string:
+		ret := make([]string, len(s))
+		for n, item := range s {
+			ret[n] = f(item)
+		}
+		return ret
+	case []any:
+		ret := make([]any, len(s))
+		for n, item := range s {
+			if str, ok := item.(string); ok {
+				ret[n] = f(str)
+			} else {
+				ret[n] = item
 			}
-			result[field] = tmpObj
-		} else {
-			result[field] = nil
 		}
+		return ret
 	}
+	return v
+}
+
+// stripHtml 去掉标签、script和style, 解码实体, 合并空白
+func stripHtml(s string) string {
+	s = htmlScriptRe.ReplaceAllString(s, " ")
+	s = htmlTagRe.ReplaceAllString(s, " ")
+	return strings.Join(strings.Fields(html.UnescapeString(s)), " ")
 }
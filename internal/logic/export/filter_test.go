@@ -0,0 +1,69 @@
+package export
+
+import (
+	"encoding/json"
+	"sqlsyncify/internal/config"
+	"sqlsyncify/internal/svc"
+	"testing"
+)
+
+func TestDocTransforms(t *testing.T) {
+	newTestSite(t, map[string]string{"etc/sites/demo/transforms.yaml": `Transforms:
+  - Op: json_decode
+    Fields: [categories, metaArrayJson]
+  - Op: php_unserialize
+    In: metaArrayJson
+    Fields: [_product_attributes]
+    To: [product_attributes]
+  - Op: rename
+    Fields: [post_title]
+    To: [title]
+  - Op: split
+    Fields: [tags]
+    Sep: "|"
+  - Op: lowercase
+    Fields: [tags, sku]
+  - Op: strip_html
+    Fields: [content]
+  - Op: cast
+    Fields: [price, stock]
+    Type: float
+  - Op: move
+    Fields: [price, stock]
+    To: [offer]
+  - Op: drop
+    Fields: [metaArrayJson]
+`})
+	items, err := svc.LoadDocTransforms("demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := newDocTransforms(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := map[string]any{
+		"categories":    `[{"id":1}]`,
+		"metaArrayJson": `[{"_product_attributes":"a:1:{s:5:\"color\";s:3:\"red\";}"},{"other":"x"}]`,
+		"post_title":    "Hello",
+		"tags":          "Red| Blue ||",
+		"sku":           "AB-1",
+		"content":       "<p>a &amp; b</p><script>x()</script><p>c</p>",
+		"price":         "9.5",
+		"stock":         int64(3),
+	}
+	ts.apply(doc)
+	got, _ := json.Marshal(doc)
+	want := `{"categories":[{"id":1}],"content":"a \u0026 b c","offer":{"price":9.5,"stock":3},"product_attributes":{"color":"red"},"sku":"ab-1","tags":["red","blue"],"title":"Hello"}`
+	if string(got) != want {
+		t.Errorf("apply =\n%s\nwant\n%s", got, want)
+	}
+
+	// 没有transforms.yaml时不转换
+	if items, err = svc.LoadDocTransforms("none"); err != nil || items != nil {
+		t.Errorf("missing transforms = %v %v", items, err)
+	}
+	if _, err = newDocTransforms([]config.DocTransform{{Op: "upper", Fields: []string{"a"}}}); err == nil {
+		t.Error("want unknown op error")
+	}
+}
@@ -0,0 +1,216 @@
+package export
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"sqlsyncify/internal/utils"
+	"strings"
+)
+
+// nestChild 子表的行按父文档id合并为对象数组: -- nest=meta:post_meta.ID
+type nestChild struct {
+	// 文档中的字段
+	Field string
+	Table string
+	// 子表中父文档id的列
+	Key     string
+	rows    *sql.Rows
+	columns []string
+	// 已读取、还未合并的下一行
+	next    map[string]any
+	nextKey any
+}
+
+// docNests 一个sql-export文件的子表, 根查询和子表都按父文档id排序, 逐行合并
+// 内存中只有当前文档的子行
+type docNests struct {
+	key      string
+	children []*nestChild
+}
+
+// parseNests 读取 -- nest=meta:post_meta.ID, cates:post_cates.ID, 可以出现多次
+func parseNests(sqlStr string) ([]*nestChild, error) {
+	var ret []*nestChild
+	for _, val := range utils.SqlDirectives(sqlStr, "nest") {
+		for _, item := range strings.Split(val, ",") {
+			item = strings.TrimSpace(item)
+			if len(item) == 0 {
+				continue
+			}
+			field, source, _ := strings.Cut(item, ":")
+			table, key, _ := strings.Cut(source, ".")
+			field, table, key = strings.TrimSpace(field), strings.TrimSpace(table), strings.TrimSpace(key)
+			if len(field) == 0 || len(table) == 0 || len(key) == 0 {
+				return nil, fmt.Errorf("invalid nest: %s, want field:table.column", item)
+			}
+			if strings.ContainsAny(table+key, "\"`") {
+				return nil, fmt.Errorf("invalid nest: %s", item)
+			}
+			ret = append(ret, &nestChild{Field: field, Table: table, Key: key})
+		}
+	}
+	return ret, nil
+}
+
+// openNests 打开子表的查询, 返回按父文档id排序的根查询; 没有 -- nest= 时返回nil
+func openNests(ctx context.Context, db *sql.DB, sqlStr, key string) (*docNests, string, error) {
+	children, err := parseNests(sqlStr)
+	if err != nil || len(children) == 0 {
+		return nil, sqlStr, err
+	}
+	if strings.Contains(key, `"`) {
+		return nil, sqlStr, fmt.Errorf("invalid doc id key: %s", key)
+	}
+	n := &docNests{key: key}
+	for _, c := range children {
+		c.rows, err = c.query(ctx, db)
+		if err != nil {
+			n.close()
+			return nil, sqlStr, fmt.Errorf("nest %s: %v", c.Field, err)
+		}
+		n.children = append(n.children, c)
+		if c.columns, err = c.rows.Columns(); err == nil {
+			err = c.advance()
+		}
+		if err != nil {
+			n.close()
+			return nil, sqlStr, fmt.Errorf("nest %s: %v", c.Field, err)
+		}
+	}
+	sqlStr = strings.TrimRight(strings.TrimSpace(sqlStr), ";")
+	return n, fmt.Sprintf("SELECT * FROM (\n%s\n) ORDER BY \"%s\"", sqlStr, key), nil
+}
+
+// query 按父文档id排序, 再按其他列排序, 同一文档的子行顺序固定, 增量导出的哈希不会变化
+func (c *nestChild) query(ctx context.Context, db *sql.DB) (*sql.Rows, error) {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`SELECT * FROM "%s" LIMIT 0`, c.Table))
+	if err != nil {
+		return nil, err
+	}
+	columns, err := rows.Columns()
+	_ = rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(columns, c.Key) {
+		return nil, fmt.Errorf("column %s not found in %s", c.Key, c.Table)
+	}
+	orderBy := []string{fmt.Sprintf(`"%s"`, c.Key)}
+	for _, col := range columns {
+		if col != c.Key && !strings.Contains(col, `"`) {
+			orderBy = append(orderBy, fmt.Sprintf(`"%s"`, col))
+		}
+	}
+	return db.QueryContext(ctx, fmt.Sprintf(`SELECT * FROM "%s" ORDER BY %s`, c.Table, strings.Join(orderBy, ", ")))
+}
+
+// merge 把父文档id相同的子行写入文档, 没有子行时为空数组
+func (n *docNests) merge(doc map[string]any) error {
+	if n == nil {
+		return nil
+	}
+	id := doc[n.key]
+	for _, c := range n.children {
+		items, err := c.take(id)
+		if err != nil {
+			return fmt.Errorf("nest %s: %v", c.Field, err)
+		}
+		doc[c.Field] = items
+	}
+	return nil
+}
+
+func (n *docNests) close() {
+	if n == nil {
+		return
+	}
+	for _, c := range n.children {
+		_ = c.rows.Close()
+	}
+}
+
+// take 读取父文档id为id的子行, 跳过id更小的子行(父文档不存在)
+func (c *nestChild) take(id any) ([]any, error) {
+	items := make([]any, 0)
+	for c.next != nil {
+		order := compareKey(c.nextKey, id)
+		if order > 0 {
+			break
+		}
+		if order == 0 && id != nil {
+			items = append(items, c.next)
+		}
+		if err := c.advance(); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// advance 读取下一行, 子行中不保留父文档id的列
+func (c *nestChild) advance() error {
+	c.next, c.nextKey = nil, nil
+	if !c.rows.Next() {
+		return c.rows.Err()
+	}
+	values := make([]any, len(c.columns))
+	valuePtrs := make([]any, len(c.columns))
+	for i := range values {
+		valuePtrs[i] = &values[i]
+	}
+	if err := c.rows.Scan(valuePtrs...); err != nil {
+		return err
+	}
+	row := make(map[string]any, len(c.columns))
+	for i, col := range c.columns {
+		v := values[i]
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		if col == c.Key {
+			c.nextKey = v
+			continue
+		}
+		row[col] = v
+	}
+	c.next = row
+	return nil
+}
+
+// compareKey 与sqlite的ORDER BY一致: NULL < 数值 < 文本
+func compareKey(a, b any) int {
+	ra, rb := keyRank(a), keyRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch x := a.(type) {
+	case int64:
+		if y, ok := b.(int64); ok {
+			return cmp.Compare(x, y)
+		}
+		return cmp.Compare(float64(x), b.(float64))
+	case float64:
+		if y, ok := b.(int64); ok {
+			return cmp.Compare(x, float64(y))
+		}
+		return cmp.Compare(x, b.(float64))
+	case string:
+		return strings.Compare(x, b.(string))
+	}
+	return 0
+}
+
+func keyRank(v any) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int64, float64:
+		return 1
+	case string:
+		return 2
+	}
+	return 3
+}
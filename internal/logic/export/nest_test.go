@@ -0,0 +1,64 @@
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNests(t *testing.T) {
+	dbLocal := newTestSite(t, nil)
+	_, err := dbLocal.Exec(`CREATE TABLE posts (ID INTEGER PRIMARY KEY, title TEXT);
+		INSERT INTO posts VALUES (2, 'b'), (10, 'j'), (3, 'c');
+		CREATE TABLE post_meta (ID INTEGER, meta_key TEXT, meta_value TEXT);
+		INSERT INTO post_meta VALUES (10, 'size', 'S'), (1, 'orphan', 'x'), (2, 'size', 'L'), (10, 'color', 'red');
+		CREATE TABLE post_cates (ID INTEGER, cat_name TEXT);
+		INSERT INTO post_cates VALUES (3, 'news'), (NULL, 'none')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlStr := "-- nest=meta:post_meta.ID\n-- nest=cates:post_cates.ID\nSELECT ID, title FROM posts WHERE ID > 1;"
+	nests, sqlStr, err := openNests(context.Background(), dbLocal, sqlStr, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nests.close()
+	rows, err := dbLocal.Query(sqlStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var docs []string
+	for rows.Next() {
+		var id int64
+		var title string
+		if err = rows.Scan(&id, &title); err != nil {
+			t.Fatal(err)
+		}
+		doc := map[string]any{"ID": id, "title": title}
+		if err = nests.merge(doc); err != nil {
+			t.Fatal(err)
+		}
+		b, _ := json.Marshal(doc)
+		docs = append(docs, string(b))
+	}
+	want := []string{
+		`{"ID":2,"cates":[],"meta":[{"meta_key":"size","meta_value":"L"}],"title":"b"}`,
+		`{"ID":3,"cates":[{"cat_name":"news"}],"meta":[],"title":"c"}`,
+		`{"ID":10,"cates":[],"meta":[{"meta_key":"color","meta_value":"red"},{"meta_key":"size","meta_value":"S"}],"title":"j"}`,
+	}
+	if got := strings.Join(docs, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("nested docs =\n%s\nwant\n%s", got, strings.Join(want, "\n"))
+	}
+
+	if _, err = parseNests("-- nest=meta:post_meta\nSELECT 1"); err == nil {
+		t.Error("want invalid nest error")
+	}
+	if _, _, err = openNests(context.Background(), dbLocal, "-- nest=meta:post_meta.post_id\nSELECT 1", "ID"); err == nil {
+		t.Error("want missing column error")
+	}
+}
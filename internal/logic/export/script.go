@@ -0,0 +1,326 @@
+package export
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"sqlsyncify/internal/utils"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// errScriptTimeout 脚本处理一个文档超时, 该文档不导出
+var errScriptTimeout = errors.New("script timeout")
+
+// scriptTick 检查超时的函数, 加在每个模板和 range 的开头, 超时后中断执行
+const scriptTick = "_tick"
+
+// ScriptReport 一个脚本在本次导出中的执行结果
+type ScriptReport struct {
+	Script string
+	// 执行的文档数
+	Docs int64
+	// 出错的文档不导出
+	Errors   int64
+	Timeouts int64
+	Dropped  int64
+	// 拆分出的文档数
+	Emitted int64
+	// 累计耗时
+	Duration time.Duration
+	// 第一个错误
+	Error string
+}
+
+// docScript etc/sites/{site}/scripts/*.tmpl, 在 json.Marshal 之前处理每个文档
+// 模板的输出不使用, 通过 .Set .Unset .Drop .Emit 修改、丢弃或拆分文档
+type docScript struct {
+	tpl    *template.Template
+	report *ScriptReport
+}
+
+type docScripts struct {
+	scripts []*docScript
+	// 每个文档每个脚本的执行时间上限
+	timeout time.Duration
+	// 当前执行的截止时间, 为零时不限制
+	deadline time.Time
+	// 站点yaml中 Vars 的自定义变量
+	vars     map[string]string
+	docIdKey string
+}
+
+// scriptDoc 脚本中的 . , 只有当前文档和修改文档的方法
+type scriptDoc struct {
+	Doc      map[string]any
+	vars     map[string]string
+	docIdKey string
+	dropped  bool
+	emitted  []map[string]any
+}
+
+// Var 站点yaml中 Vars 的自定义变量: {{ if eq (.Var "market") "de" }}
+func (d *scriptDoc) Var(name string) string {
+	return d.vars[name]
+}
+
+// Set {{ .Set "price_text" (printf "%.2f" (float .Doc.price)) }}
+func (d *scriptDoc) Set(key string, v any) string {
+	d.Doc[key] = v
+	return ""
+}
+
+// Unset {{ .Unset "cost" }}
+func (d *scriptDoc) Unset(key string) string {
+	delete(d.Doc, key)
+	return ""
+}
+
+// Drop 不导出当前文档
+func (d *scriptDoc) Drop() string {
+	d.dropped = true
+	return ""
+}
+
+// Emit 增加一个文档, 需要有站点的 DocIdKey: {{ .Emit (merge .Doc (dict "ID" "1-en" "lang" "en")) }}
+func (d *scriptDoc) Emit(doc map[string]any) (string, error) {
+	if id, ok := doc[d.docIdKey]; !ok || id == nil || len(fmt.Sprint(id)) == 0 {
+		return "", fmt.Errorf("emit: doc without %s", d.docIdKey)
+	}
+	d.emitted = append(d.emitted, doc)
+	return "", nil
+}
+
+var scriptFuncs = template.FuncMap{
+	// {{ dict "lang" "en" "price" 10 }}
+	"dict": func(kv ...any) (map[string]any, error) {
+		if len(kv)%2 != 0 {
+			return nil, errors.New("dict: odd number of arguments")
+		}
+		ret := make(map[string]any, len(kv)/2)
+		for n := 0; n < len(kv); n += 2 {
+			ret[fmt.Sprint(kv[n])] = kv[n+1]
+		}
+		return ret, nil
+	},
+	// 复制第一个对象, 后面对象的字段覆盖前面的
+	"merge": func(docs ...map[string]any) map[string]any {
+		ret := make(map[string]any)
+		for _, doc := range docs {
+			maps.Copy(ret, doc)
+		}
+		return ret
+	},
+	"float": scriptFloat,
+	"int": func(v any) (int64, error) {
+		f, err := scriptFloat(v)
+		return int64(f), err
+	},
+	"add": func(a, b any) (float64, error) {
+		return scriptCalc(a, b, func(x, y float64) float64 { return x + y })
+	},
+	"sub": func(a, b any) (float64, error) {
+		return scriptCalc(a, b, func(x, y float64) float64 { return x - y })
+	},
+	"mul": func(a, b any) (float64, error) {
+		return scriptCalc(a, b, func(x, y float64) float64 { return x * y })
+	},
+	"div": func(a, b any) (float64, error) {
+		return scriptCalc(a, b, func(x, y float64) float64 { return x / y })
+	},
+	// {{ round 2 .Doc.price }}
+	"round": func(places int, v any) (float64, error) {
+		f, err := scriptFloat(v)
+		p := math.Pow(10, float64(places))
+		return math.Round(f*p) / p, err
+	},
+	"lower":    strings.ToLower,
+	"upper":    strings.ToUpper,
+	"replace":  strings.ReplaceAll,
+	"contains": strings.Contains,
+	"split":    strings.Split,
+	"join": func(sep string, items []any) string {
+		s := make([]string, len(items))
+		for n, item := range items {
+			s[n] = fmt.Sprint(item)
+		}
+		return strings.Join(s, sep)
+	},
+}
+
+// scriptFloat 数值或数值字符串, NULL为0
+func scriptFloat(v any) (float64, error) {
+	switch n := v.(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case float64:
+		return n, nil
+	}
+	return strconv.ParseFloat(strings.TrimSpace(fmt.Sprint(v)), 64)
+}
+
+func scriptCalc(a, b any, f func(x, y float64) float64) (float64, error) {
+	x, err := scriptFloat(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := scriptFloat(b)
+	if err != nil {
+		return 0, err
+	}
+	return f(x, y), nil
+}
+
+// initScripts 读取站点的脚本, 按文件名顺序执行; 没有scripts目录时不执行
+func (exp *exporterImplement) initScripts() error {
+	dirPath := fmt.Sprintf("./etc/sites/%s/scripts/", exp.cfg.SiteConf.Site)
+	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("ExportEs, read scripts error: %v", err)
+	}
+	files, err := utils.ScanDir(dirPath, ".tmpl")
+	if err != nil {
+		return fmt.Errorf("ExportEs, read scripts error: %v", err)
+	}
+	exp.scripts = &docScripts{
+		timeout:  time.Duration(exp.cfg.SiteConf.ScriptTimeout) * time.Millisecond,
+		vars:     exp.cfg.SiteConf.Vars,
+		docIdKey: exp.cfg.SiteConf.DocIdKey,
+	}
+	funcs := maps.Clone(scriptFuncs)
+	funcs[scriptTick] = exp.scripts.tick
+	tick, err := parse.Parse(scriptTick, "{{ "+scriptTick+" }}", "", "", funcs)
+	if err != nil {
+		return fmt.Errorf("ExportEs, parse script tick error: %v", err)
+	}
+	tickNode := tick[scriptTick].Root.Nodes[0]
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("ExportEs, read script %s error: %v", file, err)
+		}
+		name := filepath.Base(file)
+		tpl, err := template.New(name).Funcs(funcs).Option("missingkey=zero").Parse(string(content))
+		if err != nil {
+			return fmt.Errorf("ExportEs, parse script %s error: %v", name, err)
+		}
+		for _, t := range tpl.Templates() {
+			if t.Tree != nil {
+				addTicks(t.Tree.Root, tickNode)
+			}
+		}
+		exp.scripts.scripts = append(exp.scripts.scripts, &docScript{tpl: tpl, report: &ScriptReport{Script: name}})
+	}
+	log.Println("export scripts:", len(exp.scripts.scripts))
+	return nil
+}
+
+// addTicks 在模板和每个 range 的开头检查超时, 死循环和递归的 template 都会中断
+func addTicks(list *parse.ListNode, tick parse.Node) {
+	if list == nil {
+		return
+	}
+	for _, node := range list.Nodes {
+		switch n := node.(type) {
+		case *parse.RangeNode:
+			addTicks(n.List, tick)
+			addTicks(n.ElseList, tick)
+		case *parse.IfNode:
+			addTicks(n.List, tick)
+			addTicks(n.ElseList, tick)
+		case *parse.WithNode:
+			addTicks(n.List, tick)
+			addTicks(n.ElseList, tick)
+		case *parse.ListNode:
+			addTicks(n, tick)
+		}
+	}
+	list.Nodes = append([]parse.Node{tick}, list.Nodes...)
+}
+
+// tick 超过当前文档的截止时间时返回errScriptTimeout
+func (s *docScripts) tick() (string, error) {
+	if !s.deadline.IsZero() && time.Now().After(s.deadline) {
+		return "", errScriptTimeout
+	}
+	return "", nil
+}
+
+// Scripts 本次导出中每个脚本的执行结果
+func (exp *exporterImplement) Scripts() []*ScriptReport {
+	if exp.scripts == nil {
+		return nil
+	}
+	ret := make([]*ScriptReport, len(exp.scripts.scripts))
+	for n, s := range exp.scripts.scripts {
+		ret[n] = s.report
+	}
+	return ret
+}
+
+// run 依次执行脚本, 返回要导出的文档; 拆分出的文档继续由后面的脚本处理
+// 脚本出错或超时返回错误, 这一行的文档都不导出, 不影响之后的文档
+func (s *docScripts) run(doc map[string]any) ([]map[string]any, error) {
+	docs := []map[string]any{doc}
+	if s == nil {
+		return docs, nil
+	}
+	for _, script := range s.scripts {
+		var next []map[string]any
+		for _, doc := range docs {
+			ret, err := s.exec(script, doc)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, ret...)
+		}
+		docs = next
+	}
+	return docs, nil
+}
+
+// exec 在当前协程中执行, 超时由模板中的 _tick 中断
+func (s *docScripts) exec(script *docScript, doc map[string]any) ([]map[string]any, error) {
+	r := script.report
+	r.Docs++
+	d := &scriptDoc{Doc: doc, vars: s.vars, docIdKey: s.docIdKey}
+	start := time.Now()
+	s.deadline = time.Time{}
+	if s.timeout > 0 {
+		s.deadline = start.Add(s.timeout)
+	}
+	err := script.tpl.Execute(io.Discard, d)
+	r.Duration += time.Since(start)
+	if errors.Is(err, errScriptTimeout) {
+		r.Timeouts++
+		err = errScriptTimeout
+	}
+	if err != nil {
+		r.Errors++
+		if len(r.Error) == 0 {
+			r.Error = err.Error()
+		}
+		return nil, fmt.Errorf("script %s: %w", r.Script, err)
+	}
+	var ret []map[string]any
+	if d.dropped {
+		r.Dropped++
+	} else {
+		ret = append(ret, d.Doc)
+	}
+	r.Emitted += int64(len(d.emitted))
+	return append(ret, d.emitted...), nil
+}
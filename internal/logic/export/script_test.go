@@ -0,0 +1,93 @@
+package export
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sqlsyncify/internal/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDocScripts(t *testing.T) {
+	newTestSite(t, map[string]string{
+		// 按市场格式化价格, 没有价格的文档不导出
+		"etc/sites/demo/scripts/1_price.tmpl": `{{ if not .Doc.price }}{{ .Drop }}{{ else if eq (.Var "market") "de" }}{{ .Set "price_text" (printf "%.2f €" (round 2 (mul .Doc.price 1.1))) }}{{ end }}{{ .Unset "cost" }}`,
+		// 每种语言拆分为一个文档
+		"etc/sites/demo/scripts/2_langs.tmpl": `{{ range split .Doc.langs "," }}{{ $.Emit (merge $.Doc (dict "ID" (printf "%v-%s" $.Doc.ID .) "lang" .)) }}{{ end }}{{ if .Doc.langs }}{{ .Drop }}{{ end }}`,
+	})
+	siteConf := &config.SiteConfig{Site: "demo", DocIdKey: "ID", Vars: map[string]string{"market": "de"}, ScriptTimeout: 1000}
+	exp := &exporterImplement{cfg: &ExporterConfig{SiteConf: siteConf}}
+	if err := exp.initScripts(); err != nil {
+		t.Fatal(err)
+	}
+	run := func(doc map[string]any) (string, error) {
+		docs, err := exp.scripts.run(doc)
+		var ret []string
+		for _, d := range docs {
+			b, _ := json.Marshal(d)
+			ret = append(ret, string(b))
+		}
+		return strings.Join(ret, "\n"), err
+	}
+
+	got, err := run(map[string]any{"ID": int64(1), "price": 10.0, "cost": 5, "langs": "en,fr"})
+	want := `{"ID":"1-en","lang":"en","langs":"en,fr","price":10,"price_text":"11.00 €"}` + "\n" + `{"ID":"1-fr","lang":"fr","langs":"en,fr","price":10,"price_text":"11.00 €"}`
+	if err != nil || got != want {
+		t.Errorf("split docs = %v\n%s\nwant\n%s", err, got, want)
+	}
+	if got, err = run(map[string]any{"ID": int64(2), "price": nil}); err != nil || got != "" {
+		t.Errorf("dropped doc = %s %v", got, err)
+	}
+	if _, err = run(map[string]any{"ID": int64(3), "price": "abc"}); err == nil {
+		t.Error("want script error")
+	}
+	reports := exp.Scripts()
+	if r := reports[0]; r.Docs != 3 || r.Dropped != 1 || r.Errors != 1 || len(r.Error) == 0 {
+		t.Errorf("price report = %+v", r)
+	}
+	if r := reports[1]; r.Docs != 1 || r.Emitted != 2 || r.Dropped != 1 {
+		t.Errorf("langs report = %+v", r)
+	}
+
+	// 超时只中断当前文档, 之后的文档照常执行
+	scripts := map[string]string{
+		"1_price.tmpl": `{{ if .Doc.slow }}{{ range 100000000 }}{{ end }}{{ end }}{{ .Set "ok" true }}`,
+		"2_langs.tmpl": `{{ define "loop" }}{{ range 100000000 }}{{ end }}{{ end }}{{ if .Doc.nested }}{{ template "loop" }}{{ end }}`,
+	}
+	for name, content := range scripts {
+		if err = os.WriteFile("etc/sites/demo/scripts/"+name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	siteConf.ScriptTimeout = 5
+	if err = exp.initScripts(); err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range []map[string]any{{"ID": int64(4), "slow": true}, {"ID": int64(5), "nested": true}} {
+		start := time.Now()
+		if _, err = run(doc); !errors.Is(err, errScriptTimeout) || time.Since(start) > time.Second {
+			t.Errorf("want timeout, got %v after %s", err, time.Since(start))
+		}
+	}
+	if got, err = run(map[string]any{"ID": int64(6)}); err != nil || got != `{"ID":6,"ok":true}` {
+		t.Errorf("after timeout = %s %v", got, err)
+	}
+	if r := exp.Scripts()[0]; r.Timeouts != 1 || r.Docs != 3 {
+		t.Errorf("timeout report = %+v", r)
+	}
+
+	// 脚本只能使用文档和修改文档的方法, 拆分出的文档需要有DocIdKey
+	for _, content := range []string{`{{ .Vars.market }}`, `{{ .Env.HOME }}`, `{{ .Conf.EsCluster }}`, `{{ .Emit (dict "lang" "en") }}`} {
+		if err = os.WriteFile("etc/sites/demo/scripts/1_price.tmpl", []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = exp.initScripts(); err != nil {
+			t.Fatal(err)
+		}
+		if got, err = run(map[string]any{"ID": int64(7)}); err == nil {
+			t.Errorf("%s = %s, want error", content, got)
+		}
+	}
+}
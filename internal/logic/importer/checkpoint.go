@@ -0,0 +1,273 @@
+package importer
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 分段抽取进度表, 保存在站点本地db中, 用于断点续传
+const chunkTable = "_sqlsyncify_chunk"
+
+const (
+	chunkPending = "pending"
+	chunkDone    = "done"
+	chunkFailed  = "failed"
+)
+
+// chunkState 单个分段的进度, 读取完成且全部行写入本地db后才记为完成
+type chunkState struct {
+	TableName string
+	// 分片的数据源名称, 不分片时为空
+	Shard      string
+	Seq        int
+	RangeStart string
+	RangeEnd   string
+	pending    atomic.Int64
+	readDone   atomic.Bool
+	failed     atomic.Bool
+	errMsg     atomic.Value
+	once       sync.Once
+	table      *tableState
+	// 已读取的行数
+	rows atomic.Int64
+	// 分片的行数核对
+	shard *rowCounters
+}
+
+func (i *importerImplement) initChunkTable() error {
+	_, err := i.cfg.DbLocal.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		table_name TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		range_start TEXT NOT NULL,
+		range_end TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		updated_at TEXT NOT NULL,
+		PRIMARY KEY (table_name, seq)
+	)`, chunkTable))
+	return err
+}
+
+// loadChunkStatus 读取上次导入各分段的状态, key为分段范围
+func (i *importerImplement) loadChunkStatus(tableName string) (map[string]string, error) {
+	rows, err := i.cfg.DbLocal.Query(fmt.Sprintf("SELECT range_start, range_end, status FROM %s WHERE table_name = ?", chunkTable), tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	ret := make(map[string]string)
+	for rows.Next() {
+		var start, end, status string
+		if err = rows.Scan(&start, &end, &status); err != nil {
+			return nil, err
+		}
+		ret[chunkRange(start, end)] = status
+	}
+	return ret, rows.Err()
+}
+
+// resetChunks 重新规划表的分段, 不在todo中的分段记为已完成
+// tableName为分片的记录名时只清除这个分片
+func (i *importerImplement) resetChunks(tableName string, chunks []*readSql, todo []*readSql) error {
+	pending := make(map[*chunkState]bool, len(todo))
+	for _, item := range todo {
+		pending[item.chunk] = true
+	}
+	tx, err := i.cfg.DbLocal.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	// 分片数变化时清除旧分片的记录
+	_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE table_name = ? OR table_name GLOB ?", chunkTable), tableName, tableName+"@*")
+	if err != nil {
+		return err
+	}
+	now := time.Now().Format(time.DateTime)
+	for _, item := range chunks {
+		status := chunkDone
+		if pending[item.chunk] {
+			status = chunkPending
+		}
+		_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s (table_name, seq, range_start, range_end, status, updated_at) VALUES (?, ?, ?, ?, ?, ?)", chunkTable),
+			tableName, item.chunk.Seq, item.chunk.RangeStart, item.chunk.RangeEnd, status, now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// addChunk 记录运行中新增的分段, 用于按游标分页的表
+func (i *importerImplement) addChunk(c *chunkState) {
+	_, err := i.cfg.DbLocal.Exec(fmt.Sprintf("INSERT OR REPLACE INTO %s (table_name, seq, range_start, range_end, status, updated_at) VALUES (?, ?, ?, ?, ?, ?)", chunkTable),
+		c.checkpoint(), c.Seq, c.RangeStart, c.RangeEnd, chunkPending, time.Now().Format(time.DateTime))
+	if err != nil {
+		log.Println("add chunk error:", c.checkpoint(), c.Seq, err)
+	}
+}
+
+func (i *importerImplement) saveChunkRange(c *chunkState) {
+	_, err := i.cfg.DbLocal.Exec(fmt.Sprintf("UPDATE %s SET range_end = ? WHERE table_name = ? AND seq = ?", chunkTable), c.RangeEnd, c.checkpoint(), c.Seq)
+	if err != nil {
+		log.Println("save chunk range error:", c.checkpoint(), c.Seq, err)
+	}
+}
+
+func (i *importerImplement) saveChunkStatus(c *chunkState, status string, errMsg string) {
+	_, err := i.cfg.DbLocal.Exec(fmt.Sprintf("UPDATE %s SET status = ?, error = ?, updated_at = ? WHERE table_name = ? AND seq = ?", chunkTable),
+		status, errMsg, time.Now().Format(time.DateTime), c.checkpoint(), c.Seq)
+	if err != nil {
+		log.Println("save chunk status error:", c.checkpoint(), c.Seq, err)
+	}
+}
+
+// dispatchChunks 记录分段计划并提交给读取协程
+// 续传时跳过已完成的分段, 未完成分段先清除本地已写入的部分行
+func (i *importerImplement) dispatchChunks(tableName, keyCol string, chunks []*readSql) error {
+	// 全量导入写入临时表
+	table := newTableState(tableName, chunks[0].KeyCol, chunks[0].IsFirst)
+	table.Indexes = chunks[0].Indexes
+	i.tables.Store(tableName, table)
+	for seq, item := range chunks {
+		item.table = table
+		item.chunk = &chunkState{TableName: tableName, Seq: seq, RangeStart: item.RangeStart, RangeEnd: item.RangeEnd, table: table}
+	}
+	todo := chunks
+	if i.cfg.Resume {
+		todo = i.resumeChunks(tableName, keyCol, chunks)
+	}
+	if err := i.resetChunks(tableName, chunks, todo); err != nil {
+		return fmt.Errorf("error at reset chunks:%v", err)
+	}
+	log.Printf("%s chunks: %d, todo: %d", tableName, len(chunks), len(todo))
+	table.pending.Add(int64(len(todo)))
+	table.chunks.Add(int64(len(todo)))
+	if len(todo) == 0 || !todo[0].IsFirst {
+		// 不需要建表
+		table.markReady()
+	}
+	for _, item := range todo {
+		i.cfg.ChReadSql <- item
+	}
+	// 全部分段已提交
+	i.tableDone(table, false)
+	return nil
+}
+
+func (i *importerImplement) resumeChunks(tableName, keyCol string, chunks []*readSql) []*readSql {
+	status, err := i.loadChunkStatus(tableName)
+	if err != nil {
+		log.Println("load chunk status error:", tableName, err)
+		return chunks
+	}
+	var todo []*readSql
+	for _, item := range chunks {
+		if status[chunkRange(item.RangeStart, item.RangeEnd)] != chunkDone {
+			todo = append(todo, item)
+		}
+	}
+	if len(todo) == len(chunks) || len(todo) == 0 {
+		return todo
+	}
+	// 全量导入续传到临时表
+	target := chunks[0].writeTable()
+	if !i.localTableExists(target) {
+		return chunks
+	}
+	// 续传: 保留旧表, 清除未完成分段已写入的行
+	for _, item := range todo {
+		if len(item.RangeStart) == 0 {
+			// 未分段的表只能全部重新导入
+			return chunks
+		}
+		_, err = i.cfg.DbLocal.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s BETWEEN ? AND ?", target, keyCol), item.RangeStart, item.RangeEnd)
+		if err != nil {
+			log.Println("resume: clean chunk error, full import", tableName, err)
+			return chunks
+		}
+		item.IsFirst = false
+	}
+	return todo
+}
+
+// chunkRead 分段读取结束
+func (i *importerImplement) chunkRead(c *chunkState, err error) {
+	if c == nil {
+		// 游标分页任务按页记录进度
+		return
+	}
+	c.fail(err)
+	c.readDone.Store(true)
+	if c.pending.Load() == 0 {
+		i.chunkFinish(c)
+	}
+}
+
+// chunkWritten 分段中的行写入本地db
+func (i *importerImplement) chunkWritten(c *chunkState, err error) {
+	c.fail(err)
+	if err == nil {
+		for _, rc := range c.counters() {
+			rc.writtenRows.Add(1)
+		}
+	}
+	if c.pending.Add(-1) == 0 && c.readDone.Load() {
+		i.chunkFinish(c)
+	}
+}
+
+func (i *importerImplement) chunkFinish(c *chunkState) {
+	c.once.Do(func() {
+		failed := c.failed.Load()
+		if failed {
+			errMsg, _ := c.errMsg.Load().(string)
+			i.saveChunkStatus(c, chunkFailed, errMsg)
+			for _, rc := range c.counters() {
+				rc.failedChunks.Add(1)
+			}
+		} else {
+			i.saveChunkStatus(c, chunkDone, "")
+			for _, rc := range c.counters() {
+				rc.doneChunks.Add(1)
+			}
+		}
+		i.tableDone(c.table, failed)
+	})
+}
+
+func (c *chunkState) fail(err error) {
+	if err == nil {
+		return
+	}
+	c.errMsg.CompareAndSwap(nil, err.Error())
+	c.failed.Store(true)
+}
+
+// checkpoint 分段进度表中的记录名
+func (c *chunkState) checkpoint() string {
+	return checkpoint(c.TableName, c.Shard)
+}
+
+// counters 分段计入的表和分片计数
+func (c *chunkState) counters() []*rowCounters {
+	var ret []*rowCounters
+	if c.table != nil {
+		ret = append(ret, &c.table.rowCounters)
+	}
+	if c.shard != nil {
+		ret = append(ret, c.shard)
+	}
+	return ret
+}
+
+func chunkRange(start, end string) string {
+	return start + "~" + end
+}
@@ -0,0 +1,96 @@
+package importer
+
+import (
+	"fmt"
+	"log"
+	"sqlsyncify/internal/svc"
+	"sqlsyncify/internal/utils"
+	"strings"
+)
+
+// parseTypes 读取列类型指令: -- type=price:TEXT, amount:NUMERIC
+func parseTypes(sqlStr string) map[string]string {
+	ret := make(map[string]string)
+	for _, val := range utils.SqlDirectives(sqlStr, "type") {
+		for _, pair := range strings.Split(val, ",") {
+			col, decl, ok := strings.Cut(pair, ":")
+			col, decl = localColumn(col), strings.TrimSpace(decl)
+			if ok && len(col) > 0 && len(decl) > 0 {
+				ret[col] = decl
+			}
+		}
+	}
+	return ret
+}
+
+// localColumn 远程字段表达式对应的本地列名: wp.ID => ID
+func localColumn(expr string) string {
+	if pos := strings.LastIndex(expr, "."); pos != -1 {
+		expr = expr[pos+1:]
+	}
+	return strings.Trim(expr, "` ")
+}
+
+// sqlExpr 拼接到查询中的条件或聚合表达式, col转换其中的列
+// 查询包成子查询时, 列为子查询结果集的列名
+type sqlExpr func(col func(expr string) string) string
+
+// queryColumn 原查询中的列表达式
+func queryColumn(expr string) string {
+	return expr
+}
+
+// 查询最外层有这些关键字时, 不能直接在末尾拼接WHERE
+var wrapKeywords = []string{"WHERE", "GROUP", "HAVING", "ORDER", "LIMIT", "OFFSET", "UNION", "INTERSECT", "EXCEPT", "WINDOW"}
+
+// wrapQuery 不能改写语法树时, 查询最外层有WHERE、GROUP BY、ORDER BY、LIMIT、UNION等时包成子查询:
+// SELECT * FROM (<q>) t, 条件和排序用结果集的列名; 否则原样返回
+func wrapQuery(drv svc.SourceDriver, sqlStr string) (string, func(string) string) {
+	keywords := utils.SqlTopLevelKeywords(sqlStr)
+	for _, kw := range wrapKeywords {
+		if keywords[kw] {
+			return subquery(sqlStr, "*"), func(expr string) string {
+				return drv.Quote(localColumn(expr))
+			}
+		}
+	}
+	return sqlStr, queryColumn
+}
+
+// subquery 包成子查询: SELECT selectExprs FROM (<q>) t, 换行避免末尾的注释
+func subquery(sqlStr, selectExprs string) string {
+	return fmt.Sprintf("SELECT %s FROM (\n%s\n) t", selectExprs, strings.TrimRight(strings.TrimSpace(sqlStr), ";"))
+}
+
+// appendCondition 在查询的WHERE中追加条件
+// 非MySQL数据源或语法树改写失败时, 拼接在末尾或包成子查询
+func appendCondition(drv svc.SourceDriver, sqlStr string, cond sqlExpr) string {
+	if drv.Rewritable() {
+		ret, err := utils.SqlAddWhere(sqlStr, cond(queryColumn))
+		if err == nil {
+			return ret
+		}
+		log.Println("rewrite sql error, append condition:", err)
+	}
+	sqlStr, col := wrapQuery(drv, sqlStr)
+	return sqlStr + "\nWHERE " + cond(col)
+}
+
+// aggregateSql 用查询的FROM和WHERE生成聚合查询, 如min/max
+// 不能改写语法树时在子查询的结果上聚合
+func aggregateSql(drv svc.SourceDriver, sqlStr string, selectExprs sqlExpr) (string, error) {
+	if drv.Rewritable() {
+		ret, err := utils.SqlAggregate(sqlStr, selectExprs(queryColumn))
+		if err == nil {
+			return ret, nil
+		}
+		log.Println("rewrite sql error, aggregate on subquery:", err)
+	}
+	if !utils.SqlTopLevelKeywords(sqlStr)["FROM"] {
+		return "", fmt.Errorf("invalid sql: FROM not found")
+	}
+	col := func(expr string) string {
+		return drv.Quote(localColumn(expr))
+	}
+	return subquery(sqlStr, selectExprs(col)), nil
+}
@@ -0,0 +1,511 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sqlsyncify/internal/svc"
+	"sqlsyncify/internal/utils"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/format"
+)
+
+// 可直接放在sql-import目录中导入的数据文件, 文件名做表名
+var dataFileExts = []string{".csv", ".tsv", ".jsonl", ".parquet"}
+
+// 用前n行推断列类型
+const fileSampleRows = 1000
+
+// dataFile sql-import中的数据文件
+type dataFile struct {
+	Path string
+	// csv分隔符, 默认逗号
+	Delimiter rune
+}
+
+// fileReader 逐行读取数据文件
+type fileReader interface {
+	// Next 返回下一行, 读完时返回io.EOF
+	Next() (map[string]any, error)
+	Close() error
+}
+
+func isDataFile(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	for _, e := range dataFileExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// loadDataFromFile 导入sql-import目录中的数据文件, 或sql文件中 -- file= 指定的文件
+func (i *importerImplement) loadDataFromFile(tableName string, item *readSql) error {
+	log.Printf("Load data file: %s, tableName: %s", item.File.Path, tableName)
+	if _, err := os.Stat(item.File.Path); err != nil {
+		return fmt.Errorf("error at load file:%v", err)
+	}
+	if fp := i.filePlan(tableName); fp != nil {
+		planFile(fp, item)
+		return nil
+	}
+	item.TableName, item.IsFirst = tableName, true
+	return i.dispatchChunks(tableName, "", []*readSql{item})
+}
+
+// execFile 读取数据文件, 按前n行推断列类型建表, 再提交给写入协程
+func (i *importerImplement) execFile(item *readSql) error {
+	if item.IsFirst {
+		defer item.table.markReady()
+	}
+	reader, err := openDataFile(item.File)
+	if err != nil {
+		return fmt.Errorf("error at open data file:%v", err)
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	var sample []map[string]any
+	var columns []string
+	// SQLite的列名不区分大小写
+	seen := make(map[string]string)
+	for len(sample) < fileSampleRows {
+		row, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", item.File.Path, err)
+		}
+		sample = append(sample, row)
+		for _, col := range sortedKeys(row) {
+			if prev, ok := seen[strings.ToLower(col)]; !ok {
+				seen[strings.ToLower(col)] = col
+				columns = append(columns, col)
+			} else if prev != col {
+				return fmt.Errorf("error at data file %s: duplicate column %s and %s", item.File.Path, prev, col)
+			}
+		}
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("error at data file %s: no columns", item.File.Path)
+	}
+
+	types := make(map[string]string, len(columns))
+	columnsList := make([]string, len(columns))
+	masks := i.masks.columns(item.TableName, columns)
+	for n, col := range columns {
+		decl := inferColumnType(sample, col)
+		types[col] = decl
+		if d, ok := item.Types[col]; ok {
+			// -- type= 指定的类型, 按类型亲和性转换值
+			decl = d
+			types[col], _ = utils.MapSQLiteType(decl)
+		}
+		if masks != nil && masks[n] != nil {
+			// 脱敏后的值按文本保存, -- type= 指定的类型也不例外
+			decl, types[col] = "TEXT", "TEXT"
+		}
+		// 列名可能是关键字, 如order
+		columnsList[n] = fmt.Sprintf("%s %s", svc.LocalDriver().Quote(col), decl)
+	}
+	if item.IsFirst {
+		if err = i.createLocalTable(item, columnsList); err != nil {
+			return err
+		}
+	}
+	if err = i.waitReady(item); err != nil {
+		return err
+	}
+
+	count := 0
+	send := func(row map[string]any) {
+		rowMap := make(map[string]any, len(columns))
+		for n, col := range columns {
+			rowMap[col] = convertFileValue(row[col], types[col])
+			if masks != nil && masks[n] != nil {
+				rowMap[col] = masks[n](rowMap[col])
+			}
+		}
+		item.chunk.read()
+		i.cfg.ChWriteRow <- &rowBatch{TableName: item.writeTable(), Cols: columns, Item: rowMap, chunk: item.chunk}
+		count++
+	}
+	limit := i.cfg.SiteConf.ImportLimit
+	for _, row := range sample {
+		if i.cfg.SiteConf.EnabledImportLimit() && count >= limit {
+			break
+		}
+		send(row)
+	}
+	for len(sample) == fileSampleRows {
+		if i.cfg.SiteConf.EnabledImportLimit() && count >= limit {
+			break
+		}
+		row, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", item.File.Path, err)
+		}
+		for col := range row {
+			if _, ok := seen[strings.ToLower(col)]; !ok {
+				seen[strings.ToLower(col)] = col
+				log.Printf("%s: column %s not in the first %d rows, skipped", item.File.Path, col, fileSampleRows)
+			}
+		}
+		send(row)
+	}
+	log.Printf("data file %s done, rows:%d", item.File.Path, count)
+	return nil
+}
+
+func openDataFile(file *dataFile) (fileReader, error) {
+	switch strings.ToLower(filepath.Ext(file.Path)) {
+	case ".csv":
+		return newCsvReader(file)
+	case ".tsv":
+		if file.Delimiter == 0 {
+			file.Delimiter = '\t'
+		}
+		return newCsvReader(file)
+	case ".jsonl":
+		return newJsonlReader(file)
+	case ".parquet":
+		return newParquetReader(file)
+	}
+	return nil, fmt.Errorf("unsupported data file: %s", file.Path)
+}
+
+// csvReader 第一行为列名, 值都是字符串, 空字符串为null
+type csvReader struct {
+	f       *os.File
+	r       *csv.Reader
+	columns []string
+}
+
+func newCsvReader(file *dataFile) (*csvReader, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	r := csv.NewReader(bufio.NewReader(f))
+	if file.Delimiter != 0 {
+		r.Comma = file.Delimiter
+	}
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	header, err := r.Read()
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("read csv header: %v", err)
+	}
+	columns := make([]string, len(header))
+	seen := make(map[string]bool, len(header))
+	for n, h := range header {
+		// 去掉UTF-8 BOM
+		columns[n] = fileColumnName(strings.TrimPrefix(h, "\ufeff"))
+		if seen[strings.ToLower(columns[n])] {
+			_ = f.Close()
+			return nil, fmt.Errorf("duplicate column in csv header: %s", columns[n])
+		}
+		seen[strings.ToLower(columns[n])] = true
+	}
+	return &csvReader{f: f, r: r, columns: columns}, nil
+}
+
+func (c *csvReader) Next() (map[string]any, error) {
+	record, err := c.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	row := make(map[string]any, len(c.columns))
+	for n, col := range c.columns {
+		if n < len(record) && len(record[n]) > 0 {
+			row[col] = record[n]
+		} else {
+			row[col] = nil
+		}
+	}
+	return row, nil
+}
+
+func (c *csvReader) Close() error {
+	return c.f.Close()
+}
+
+// jsonlReader 每行一个JSON对象, 嵌套的对象和数组按JSON字符串保存
+type jsonlReader struct {
+	f   *os.File
+	dec *json.Decoder
+}
+
+func newJsonlReader(file *dataFile) (*jsonlReader, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	dec.UseNumber()
+	return &jsonlReader{f: f, dec: dec}, nil
+}
+
+func (j *jsonlReader) Next() (map[string]any, error) {
+	var obj map[string]any
+	if err := j.dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	row := make(map[string]any, len(obj))
+	seen := make(map[string]string, len(obj))
+	for k, v := range obj {
+		col := fileColumnName(k)
+		if prev, ok := seen[strings.ToLower(col)]; ok {
+			return nil, fmt.Errorf("duplicate column %s: %s and %s", col, prev, k)
+		}
+		seen[strings.ToLower(col)] = k
+		switch val := v.(type) {
+		case map[string]any, []any:
+			b, _ := json.Marshal(val)
+			v = string(b)
+		case bool:
+			if val {
+				v = int64(1)
+			} else {
+				v = int64(0)
+			}
+		}
+		row[col] = v
+	}
+	return row, nil
+}
+
+func (j *jsonlReader) Close() error {
+	return j.f.Close()
+}
+
+// parquetReader 按文件的schema读取, 日期时间转为字符串, 嵌套的列表和结构按JSON字符串保存
+type parquetReader struct {
+	f *os.File
+	r *parquet.Reader
+	// 日期时间列: 原始值是距1970-01-01的天数或时间单位数
+	times map[string]func(v any) any
+}
+
+func newParquetReader(file *dataFile) (*parquetReader, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	pf, err := parquet.OpenFile(f, stat.Size())
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("open parquet: %v", err)
+	}
+	times := make(map[string]func(v any) any)
+	for _, field := range pf.Schema().Fields() {
+		lt := field.Type().LogicalType()
+		if lt == nil {
+			continue
+		}
+		switch t := lt.Value.(type) {
+		case *format.DateType:
+			times[field.Name()] = parquetTime(24*time.Hour, "2006-01-02")
+		case *format.TimestampType:
+			if t.Unit.Value != nil {
+				times[field.Name()] = parquetTime(t.Unit.Value.Duration(), "2006-01-02 15:04:05.999999")
+			}
+		}
+	}
+	return &parquetReader{f: f, r: parquet.NewReader(pf), times: times}, nil
+}
+
+// parquetTime 按UTC格式化, 与MySQL返回的格式一致
+func parquetTime(unit time.Duration, layout string) func(v any) any {
+	return func(v any) any {
+		var n int64
+		switch val := v.(type) {
+		case int32:
+			n = int64(val)
+		case int64:
+			n = val
+		default:
+			return v
+		}
+		var tm time.Time
+		if unit >= time.Second {
+			tm = time.Unix(n*int64(unit/time.Second), 0)
+		} else {
+			tm = time.Unix(0, 0).Add(time.Duration(n) * unit)
+		}
+		return tm.UTC().Format(layout)
+	}
+}
+
+func (p *parquetReader) Next() (map[string]any, error) {
+	obj := make(map[string]any)
+	if err := p.r.Read(&obj); err != nil {
+		return nil, err
+	}
+	row := make(map[string]any, len(obj))
+	seen := make(map[string]string, len(obj))
+	for k, v := range obj {
+		col := fileColumnName(k)
+		if prev, ok := seen[strings.ToLower(col)]; ok {
+			return nil, fmt.Errorf("duplicate column %s: %s and %s", col, prev, k)
+		}
+		seen[strings.ToLower(col)] = k
+		if conv, ok := p.times[k]; ok {
+			v = conv(v)
+		}
+		switch val := v.(type) {
+		case map[string]any, []any:
+			b, _ := json.Marshal(val)
+			v = string(b)
+		case bool:
+			if val {
+				v = int64(1)
+			} else {
+				v = int64(0)
+			}
+		case int32:
+			v = int64(val)
+		case float32:
+			v = float64(val)
+		case []byte:
+			if utf8.Valid(val) {
+				v = string(val)
+			}
+		}
+		row[col] = v
+	}
+	return row, nil
+}
+
+func (p *parquetReader) Close() error {
+	return p.f.Close()
+}
+
+// fileColumnName 列名只保留字母数字和下划线, 其余替换为下划线
+func fileColumnName(name string) string {
+	name = strings.TrimSpace(name)
+	b := []byte(name)
+	for n, c := range b {
+		if !(c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			b[n] = '_'
+		}
+	}
+	if len(b) == 0 || b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+func sortedKeys(row map[string]any) []string {
+	keys := make([]string, 0, len(row))
+	for k := range row {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// inferColumnType 整数为INTEGER, 含小数为REAL, 其余为TEXT, 全部为null时为TEXT
+func inferColumnType(sample []map[string]any, col string) string {
+	t := ""
+	for _, row := range sample {
+		vt := valueType(row[col])
+		switch {
+		case vt == "" || vt == t:
+		case t == "":
+			t = vt
+		case vt == "TEXT" || t == "TEXT":
+			return "TEXT"
+		default:
+			// INTEGER和REAL混合
+			t = "REAL"
+		}
+	}
+	if t == "" {
+		return "TEXT"
+	}
+	return t
+}
+
+func valueType(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case int64:
+		return "INTEGER"
+	case float64:
+		return "REAL"
+	case json.Number:
+		if _, err := strconv.ParseInt(string(val), 10, 64); err == nil {
+			return "INTEGER"
+		}
+		return "REAL"
+	case string:
+		if leadingZero(val) {
+			return "TEXT"
+		}
+		if _, err := strconv.ParseInt(val, 10, 64); err == nil {
+			return "INTEGER"
+		}
+		if _, err := strconv.ParseFloat(val, 64); err == nil {
+			return "REAL"
+		}
+	}
+	return "TEXT"
+}
+
+// convertFileValue 按列类型转换值, 转换失败时保留原值
+func convertFileValue(v any, colType string) any {
+	var str string
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case json.Number:
+		str = string(val)
+	case string:
+		str = val
+	default:
+		return v
+	}
+	switch colType {
+	case "INTEGER":
+		if n, err := strconv.ParseInt(str, 10, 64); err == nil {
+			return n
+		}
+	case "REAL":
+		if f, err := strconv.ParseFloat(str, 64); err == nil {
+			return f
+		}
+	}
+	return str
+}
+
+// leadingZero 以0开头的数字字符串(如编号 007、邮编 01234)按文本保存, 0 和 0.5 除外
+func leadingZero(s string) bool {
+	s = strings.TrimPrefix(s, "-")
+	return len(s) > 1 && s[0] == '0' && s[1] != '.'
+}
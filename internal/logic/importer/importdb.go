@@ -7,111 +7,253 @@ import (
 	_ "github.com/go-sql-driver/mysql" // 导入 MySQL 驱动
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"slices"
 	"sqlsyncify/internal/config"
 	"sqlsyncify/internal/svc"
 	"sqlsyncify/internal/utils"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type rowsBatch struct {
 	Items     []map[string]interface{}
 	TableName string
 	Cols      []string
+	Upsert    bool
+	// 每行所属的分段
+	Chunks []*chunkState
 }
 
 type rowBatch struct {
 	Item      map[string]interface{}
 	TableName string
 	Cols      []string
+	Upsert    bool
+	chunk     *chunkState
 }
 
 type readSql struct {
 	IsFirst   bool
 	ReadSql   string
 	TableName string
+	// 增量导入时按主键覆盖写入, 并为主键建唯一索引
+	Upsert bool
+	KeyCol string
+	// 分段范围, 用于断点续传
+	RangeStart string
+	RangeEnd   string
+	chunk      *chunkState
+	// 数据源, sql文件可用 -- ds= 指定
+	Source *svc.DataSource
+	// 查询前在同一连接上执行的SET语句
+	SetSqls []string
+	// 按主键游标顺序分页读取
+	Keyset *keysetPlan
+	// 从数据文件读取, 不查询数据源
+	File *dataFile
+	// 分片导入时的数据源名称, 写入本地表的 _shard 列
+	Shard string
+	// 所属表的进度, 全量导入时写入临时表
+	table *tableState
+	// 导入完成后创建的索引: -- index=, -- unique=
+	Indexes []localIndex
+	// 指定本地列的声明类型: -- type=price:TEXT
+	Types map[string]string
 }
 
 type Config struct {
 	// ChBatch   chan rowsBatch
 	ChWriteRow chan *rowBatch
 	ChReadSql  chan *readSql
-	Db         *sql.DB
-	ExDB       *sql.DB
-	DbLocal    *sql.DB
-	Site       string
-	Ctx        context.Context
-	BatchSize  int
-	BatchCore  int
-	Debug      bool
-	AppConf    config.Config
-	SiteConf   *config.SiteConfig
+	// 站点默认数据源
+	Db *svc.DataSource
+	// 共享的数据源连接池, 用于sql文件中的 -- ds=
+	DataSources *svc.DataSources
+	DbLocal     *sql.DB
+	Site        string
+	Ctx         context.Context
+	BatchCore   int
+	Debug       bool
+	// 断点续传, 只重新导入未完成的分段
+	Resume   bool
+	AppConf  config.Config
+	SiteConf *config.SiteConfig
+	// sql文件模板中的变量, 为空时只用站点配置和环境变量
+	TplVars *svc.TemplateVars
 }
 
 type Importer interface {
-	Run() error
+	// Run 导入sql-import中的文件, 文件和分段的错误记录在Report中
+	Run() (*Report, error)
+	// Plan 解析sql-import中的文件, 只执行min/max查询, 返回每个文件的导入计划
+	Plan() (*Plan, error)
 }
 
 type importerImplement struct {
 	cfg *Config
+	// 增量导入待保存的水位, 全部写入成功后才保存
+	watermarks sync.Map
+	// 导入出错的表, 不保存水位
+	failedTables sync.Map
+	// 本次导入的表: 表名 => *tableState
+	tables sync.Map
+	// 每个文件的导入结果, fileReports: 表名 => *FileReport
+	files       []*FileReport
+	fileReports sync.Map
+	writeStats  WriterStats
+	// 生成导入计划时不为空: 表名 => *FilePlan
+	planFiles map[string]*FilePlan
+	// 站点配置的脱敏规则
+	masks masker
+	// -- ds= 指定的数据源, 导入结束后归还
+	sourcesMu sync.Mutex
+	sources   []*svc.DataSource
 }
 
 func NewImporter(cfg *Config) Importer {
-	//载入本地db的批量200-400,不能太大,字段多时insert into会报too many SQL variables
-	cfg.BatchSize = 200
+	// 读取协程数, 写入本地db只用一个协程, 每批行数按列数计算
 	cfg.BatchCore = runtime.NumCPU()
+	if cfg.TplVars == nil {
+		cfg.TplVars = svc.NewTemplateVars(cfg.Ctx, cfg.AppConf, cfg.SiteConf)
+	}
 	return &importerImplement{cfg: cfg}
 }
 
-func (i *importerImplement) execOnDb(exDB *sql.DB, sql string, args ...any) (sql.Result, error) {
-	if exDB != nil {
-		return exDB.ExecContext(i.cfg.Ctx, sql, args...)
+// dataSource sql文件指定的数据源, 未指定时用站点默认数据源
+func (i *importerImplement) dataSource(name string) (*svc.DataSource, error) {
+	if len(name) == 0 {
+		return i.cfg.Db, nil
+	}
+	if i.cfg.DataSources == nil {
+		return nil, fmt.Errorf("datasource %s: no datasource registry", name)
+	}
+	log.Println("special external data source=", name)
+	if err := svc.CheckMaskedSource(i.cfg.SiteConf, name); err != nil {
+		return nil, err
 	}
-	return i.cfg.Db.ExecContext(i.cfg.Ctx, sql, args...)
+	ds, err := i.cfg.DataSources.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	i.sourcesMu.Lock()
+	i.sources = append(i.sources, ds)
+	i.sourcesMu.Unlock()
+	return ds, nil
 }
 
-func (i *importerImplement) getRowsFromDb(exDB *sql.DB, sql string, args ...any) (*sql.Rows, error) {
-	// 以SELECT开头的 && 没有limit && 如果开启了limit -> 附加limit在末尾
-	sel := utils.IsPrefix(sql, "SELECT")
-	nolimit := !strings.Contains(utils.RemoveSqlComment(sql), "LIMIT ")
-	if sel && nolimit && i.cfg.SiteConf.EnabledImportLimit() {
-		sql += fmt.Sprintf(" LIMIT %d", i.cfg.SiteConf.ImportLimit)
-		// if i.cfg.Debug {
-		// 	log.Println("LIMIT ", i.cfg.AppConf.LocalImportLimit)
-		// }
+// putSources 归还本次导入获取的数据源
+func (i *importerImplement) putSources() {
+	i.sourcesMu.Lock()
+	defer i.sourcesMu.Unlock()
+	for _, ds := range i.sources {
+		i.cfg.DataSources.Put(ds)
 	}
-	if exDB != nil {
-		return exDB.QueryContext(i.cfg.Ctx, sql, args...)
+	i.sources = nil
+}
+
+// limitSql 以SELECT开头的 && 没有limit && 如果开启了limit -> 设置limit
+func (i *importerImplement) limitSql(ds *svc.DataSource, sql string) string {
+	if !utils.IsPrefix(sql, "SELECT") || !i.cfg.SiteConf.EnabledImportLimit() {
+		return sql
+	}
+	if ds.Driver.Rewritable() {
+		if limitSql, err := utils.SqlSetLimit(sql, i.cfg.SiteConf.ImportLimit); err == nil {
+			return limitSql
+		}
 	}
-	return i.cfg.Db.QueryContext(i.cfg.Ctx, sql, args...)
+	if !utils.SqlTopLevelKeywords(sql)["LIMIT"] {
+		sql += fmt.Sprintf("\nLIMIT %d", i.cfg.SiteConf.ImportLimit)
+	}
+	return sql
+}
+
+// getRowsFromDb 从连接池取出一个连接, 先执行SET语句再查询, 保证会话变量对本次查询生效
+// 读取结束后调用release归还连接
+func (i *importerImplement) getRowsFromDb(ds *svc.DataSource, setSqls []string, sql string) (*sql.Rows, func(), error) {
+	sql = i.limitSql(ds, sql)
+	// 每个数据源的并发查询数上限
+	if err := ds.Acquire(i.cfg.Ctx); err != nil {
+		return nil, nil, err
+	}
+	conn, err := ds.Db.Conn(i.cfg.Ctx)
+	if err != nil {
+		ds.Release()
+		return nil, nil, err
+	}
+	for _, setSql := range setSqls {
+		_, err = conn.ExecContext(i.cfg.Ctx, setSql)
+		if err != nil {
+			log.Println(setSql, "Error:", err.Error())
+		}
+	}
+	rows, err := conn.QueryContext(i.cfg.Ctx, sql)
+	if err != nil {
+		_ = conn.Close()
+		ds.Release()
+		return nil, nil, err
+	}
+	return rows, func() {
+		_ = rows.Close()
+		_ = conn.Close()
+		ds.Release()
+	}, nil
 }
 
 // Run 导入远程mysql数据
 // 写入本地db表
-func (i *importerImplement) Run() error {
+func (i *importerImplement) Run() (*Report, error) {
+	start := time.Now()
+	defer i.putSources()
 	dirPath := fmt.Sprintf("./etc/sites/%s/sql-import/", i.cfg.Site)
 	// 使用os.Stat获取文件信息
 	_, err := os.Stat(dirPath)
 
 	if os.IsNotExist(err) {
-		return fmt.Errorf("[Import] site:%s does not found", i.cfg.Site)
+		return nil, fmt.Errorf("[Import] site:%s does not found", i.cfg.Site)
 	} else if err != nil {
 		// 其他错误，例如权限问题
-		return err
+		return nil, err
 		// } else {
 		//站点目录存在
 	}
-	sqlFiles, err := utils.ScanDir(dirPath)
+	sqlFiles, err := utils.ScanDir(dirPath, append([]string{".sql"}, dataFileExts...)...)
 
 	if err != nil {
 		log.Printf("error walking the directory %s: %v\n", dirPath, err)
-		return err
+		return nil, err
+	}
+	i.masks, err = newMasker(i.cfg.SiteConf.Masks)
+	if err != nil {
+		return nil, fmt.Errorf("error at mask rules:%v", err)
+	}
+	err = i.initWatermarkTable()
+	if err != nil {
+		return nil, fmt.Errorf("error at init watermark table:%v", err)
+	}
+	err = i.initChunkTable()
+	if err != nil {
+		return nil, fmt.Errorf("error at init chunk table:%v", err)
+	}
+	// 按 -- after= 分层, 同一层按 -- priority= 和文件名排序
+	var files []*importFile
+	for _, file := range sqlFiles {
+		f, err := loadImportFile(file, i.cfg.TplVars)
+		if err != nil {
+			log.Println(file, err)
+			i.tableError(i.fileReport(file).Table, err)
+			continue
+		}
+		files = append(files, f)
+	}
+	levels, blocked, err := planImportFiles(files)
+	for _, f := range blocked {
+		log.Println(f.Path, err)
+		i.tableError(i.fileReport(f.Path).Table, err)
 	}
-	// 按文件名排序（字母顺序）
-	// sort.Slice(sqlFiles, func(i, j int) bool {
-	// 	return sqlFiles[i] < sqlFiles[j]
-	// })
 
 	//多核并发读
 	i.cfg.ChReadSql = make(chan *readSql, i.cfg.BatchCore)
@@ -125,53 +267,33 @@ func (i *importerImplement) Run() error {
 			}()
 			for item := range i.cfg.ChReadSql {
 				log.Printf("[worker-read-%03d] readSql: %s", workerId, item.ReadSql)
-				err1 := i.execSql(item.TableName, item.ReadSql, item.IsFirst)
+				err1 := i.execSql(item)
 				if err1 != nil {
+					i.tableError(item.TableName, err1)
 					log.Printf("[worker-read-%03d][error] readSql:%s %s", workerId, err1, item.ReadSql)
+					if item.Keyset == nil {
+						i.countLost(item.chunk, item, item.ReadSql)
+					}
 				}
+				i.chunkRead(item.chunk, err1)
 			}
 		}(c)
 	}
 
-	//多表并发写
-	i.cfg.ChWriteRow = make(chan *rowBatch, i.cfg.BatchCore)
+	//单个协程在事务中写入本地db
+	i.cfg.ChWriteRow = make(chan *rowBatch, i.cfg.BatchCore*batchSize(0))
+	writer := newLocalWriter(i, i.cfg.DbLocal)
 	var WgWrite sync.WaitGroup
-	WgWrite.Add(i.cfg.BatchCore)
-	for c := 1; c < i.cfg.BatchCore+1; c++ {
-		go func(workerId int) {
-			count := 0
-			buf := make(map[string]*rowsBatch, i.cfg.BatchSize)
-			defer func() {
-				WgWrite.Done()
-				buf = nil
-			}()
-			for item := range i.cfg.ChWriteRow {
-				count++
-				obj, ok := buf[item.TableName]
-				if !ok {
-					obj = &rowsBatch{TableName: item.TableName, Cols: item.Cols}
-					buf[item.TableName] = obj
-				}
-				obj.Items = append(obj.Items, item.Item)
-				if len(obj.Items) == i.cfg.BatchSize {
-					if i.cfg.Debug {
-						log.Printf("[worker-write-%03d] %s flush count:%d, size:%d\n ", workerId, item.TableName, count, len(obj.Items))
-					}
-					i.insertBatch(obj)
-					obj.Items = []map[string]any{}
-				}
-			}
-			for _, item := range buf {
-				i.insertBatch(item)
-			}
-			buf = nil
-		}(c)
-	}
+	WgWrite.Add(1)
+	go func() {
+		defer WgWrite.Done()
+		writer.run(i.cfg.ChWriteRow)
+	}()
 
-	for _, file := range sqlFiles {
-		err = i.loadDataFromSqlFile(file)
-		if err != nil {
-			log.Println(file, err)
+	for n, level := range levels {
+		log.Printf("import level %d: %d files", n, len(level))
+		for _, f := range level {
+			i.loadImportFile(f)
 		}
 	}
 
@@ -181,16 +303,60 @@ func (i *importerImplement) Run() error {
 
 	log.Println("waiting for all import workers...")
 	close(i.cfg.ChWriteRow)
-	select {
-	case <-i.cfg.Ctx.Done():
-		return i.cfg.Ctx.Err()
-	default:
-		WgWrite.Wait()
-		break
+	// 取消时也要等写入协程结束再生成报告, 写入协程会更新表的状态
+	WgWrite.Wait()
+	i.writeStats = writer.stats
+	if err := i.cfg.Ctx.Err(); err != nil {
+		return i.report(start), err
 	}
+	i.saveWatermarks()
 	i.sqliteReSize()
 
-	return nil
+	return i.report(start), nil
+}
+
+// loadImportFile 等待依赖的表导入完成后提交文件, 依赖失败时跳过
+func (i *importerImplement) loadImportFile(f *importFile) {
+	report := i.fileReport(f.Path)
+	err := i.waitDependencies(f)
+	if err != nil {
+		log.Printf("%s skipped: %v", f.Path, err)
+		i.tableError(report.Table, err)
+		return
+	}
+	// 耗时不含等待依赖的时间
+	report.start = time.Now()
+	before, _ := i.tables.Load(report.Table)
+	if isDataFile(f.Path) {
+		err = i.loadDataFromFile(report.Table, &readSql{File: &dataFile{Path: f.Path}})
+	} else {
+		err = i.loadDataFromSqlFile(f.Path)
+	}
+	if err != nil {
+		log.Println(f.Path, err)
+		i.tableError(report.Table, err)
+		// 分段没有全部提交, 结束表的进度, 依赖它的文件不再等待
+		if t, ok := i.tables.Load(report.Table); ok && t != before {
+			i.tableDone(t.(*tableState), true)
+		}
+	}
+}
+
+// 全部写入完成后保存增量水位, 出错的表下次重新拉取
+func (i *importerImplement) saveWatermarks() {
+	i.watermarks.Range(func(key, value any) bool {
+		w := value.(*watermark)
+		if err, failed := i.failedTables.Load(w.TableName); failed {
+			log.Println("skip save watermark:", key, err)
+			return true
+		}
+		if err := i.saveWatermark(w); err != nil {
+			log.Println("save watermark error:", key, err)
+		} else {
+			log.Printf("save watermark: %s %s=%s", key, w.Column, w.Value)
+		}
+		return true
+	})
 }
 
 // 经常删除数据,回收sqlite文件占用空间
@@ -203,48 +369,71 @@ func (i *importerImplement) sqliteReSize() {
 
 // 提交SQL到远程数据源抽取数据
 func (i *importerImplement) loadDataFromSqlFile(file string) error {
-	var exDb *sql.DB
-	defer func() {
-		if exDb != nil {
-			_ = exDb.Close()
-			exDb = nil
-		}
-	}()
 	log.Println("Load File:", file)
-	sqlf, err := os.ReadFile(file)
+	sqlStr, err := i.cfg.TplVars.RenderFile(file)
 	if err != nil {
 		return fmt.Errorf("error at load file:%v", err)
 	}
-	sqlStr := string(sqlf)
-	if strings.Contains(sqlStr, "{lang}") {
-		sqlStr = strings.ReplaceAll(sqlStr, "{lang}", i.cfg.SiteConf.Lang)
-	}
 
 	//sql文件名做新表名
-	fileNames := strings.Split(file, "/")
-	fName := fileNames[len(fileNames)-1]
-	tableName := fName[:strings.Index(fName, ".")]
+	tableName := fileTableName(file)
 	log.Println("tableName:", tableName)
 	if i.cfg.Debug {
 		log.Println("sql:", sqlStr)
 	}
+	indexes := parseIndexes(sqlStr)
+	types := parseTypes(sqlStr)
+	// 从数据文件导入: -- file=prices.csv, 相对于sql文件所在目录
+	if path := utils.SqlDirective(sqlStr, "file"); len(path) > 0 {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(file), path)
+		}
+		f := &dataFile{Path: path}
+		if delimiter := utils.SqlDirective(sqlStr, "delimiter"); len(delimiter) > 0 {
+			if delimiter == `\t` {
+				delimiter = "\t"
+			}
+			f.Delimiter = []rune(delimiter)[0]
+		}
+		return i.loadDataFromFile(tableName, &readSql{File: f, Indexes: indexes, Types: types})
+	}
 
 	primaryKey := "id"
-	keyPos := strings.Index(sqlStr, "-- key=")
-	if keyPos != -1 {
-		pos := keyPos + len("-- key=")
-		end := strings.Index(sqlStr[keyPos:], "\n")
-		primaryKey = strings.Trim(sqlStr[pos:end], " \t\r\n")
+	if key := utils.SqlDirective(sqlStr, "key"); len(key) > 0 {
+		primaryKey = key
+	}
+	// 增量导入: -- incremental=wp.post_modified
+	incrementalCol := utils.SqlDirective(sqlStr, "incremental")
+	// 多个数据源或数据源组时按分片导入: -- ds=shard_1, shard_2
+	sources, sharded, err := i.sourceShards(utils.SqlDirective(sqlStr, "ds"))
+	if err != nil {
+		return fmt.Errorf("error at connect datasource:%v", err)
+	}
+	// 分段方式: -- chunk=keyset, 多列主键只能用keyset
+	chunkMode := utils.SqlDirective(sqlStr, "chunk")
+	if strings.Contains(primaryKey, ",") {
+		chunkMode = chunkModeKeyset
+	}
+	fp := i.filePlan(tableName)
+	if fp != nil {
+		var names, drivers []string
+		for _, ds := range sources {
+			names = append(names, ds.Name)
+			if !slices.Contains(drivers, ds.Driver.Name()) {
+				drivers = append(drivers, ds.Driver.Name())
+			}
+		}
+		fp.DataSource, fp.Driver, fp.Key, fp.Incremental = strings.Join(names, ", "), strings.Join(drivers, ", "), primaryKey, incrementalCol
 	}
 
+	var setSqls []string
 	sqlList := strings.Split(sqlStr, ";")
 	sqlListLen := len(sqlList)
 	if sqlListLen > 1 {
-		// for set
+		// for set, 每次查询前在同一连接上执行
 		for _, sqlItem := range sqlList[0 : sqlListLen-1] {
-			_, err2 := i.execOnDb(exDb, sqlItem)
-			if err2 != nil {
-				log.Println(sqlItem, "Error:", err2.Error())
+			if len(strings.TrimSpace(sqlItem)) > 0 {
+				setSqls = append(setSqls, sqlItem)
 			}
 		}
 
@@ -255,65 +444,219 @@ func (i *importerImplement) loadDataFromSqlFile(file string) error {
 		return fmt.Errorf("invalid sql: do not start with SELECT")
 	}
 
+	// 每个分片都有水位时才增量导入, 否则全部分片重新导入
+	upsert := len(incrementalCol) > 0
+	lastMarks := make([]string, len(sources))
+	for n, ds := range sources {
+		if len(incrementalCol) == 0 {
+			break
+		}
+		shard := ""
+		if sharded {
+			shard = ds.Name
+		}
+		// 先记下数据源当前水位, 导入期间变更的数据下次会再次拉取; 生成计划时不查询
+		var newMark sql.NullString
+		if fp == nil {
+			newMark, err = i.getMaxValue(ds, setSqls, sqlStr, incrementalCol)
+			if err != nil {
+				return fmt.Errorf("error at max watermark:%v", err)
+			}
+		}
+		lastMark, ok := i.getWatermark(tableName, shard, incrementalCol)
+		if ok {
+			lastMarks[n] = lastMark
+		} else {
+			upsert = false
+		}
+		if newMark.Valid {
+			i.watermarks.Store(checkpoint(tableName, shard), &watermark{TableName: tableName, Shard: shard, Column: incrementalCol, Value: newMark.String})
+		}
+	}
+	if len(incrementalCol) > 0 && !upsert {
+		log.Printf("incremental import %s: no watermark, full import", tableName)
+	}
+	// 增量导入时不删除旧表
+	isFirst := !upsert
+	// 分段续传、游标分页和增量覆盖都依赖主键的原值
+	for _, col := range newKeysetPlan(primaryKey, nil).Cols {
+		if i.masks.masked(tableName, col) {
+			return fmt.Errorf("key column %s can not be masked", col)
+		}
+	}
+	keyCol := ""
+	if len(incrementalCol) > 0 {
+		keyCol = strings.Join(newKeysetPlan(primaryKey, nil).Cols, ", ")
+		if sharded {
+			// 各分片的主键可能重复
+			keyCol += ", " + shardColumn
+		}
+	}
+
+	var bases, chunks, keysets []*readSql
+	for n, ds := range sources {
+		base := &readSql{ReadSql: sqlStr, TableName: tableName, IsFirst: isFirst, Upsert: upsert, KeyCol: keyCol, Source: ds, SetSqls: setSqls, Indexes: indexes, Types: types}
+		if sharded {
+			base.Shard = ds.Name
+		}
+		if upsert {
+			log.Printf("incremental import %s: %s >= %s", checkpoint(tableName, base.Shard), incrementalCol, lastMarks[n])
+			base.ReadSql = appendCondition(ds.Driver, sqlStr, func(col func(string) string) string {
+				return fmt.Sprintf("%s >= %s", col(incrementalCol), ds.Driver.Literal(lastMarks[n]))
+			})
+		}
+		sourceChunks, keyset, err := i.sourceChunks(base, primaryKey, chunkMode)
+		if err != nil {
+			return err
+		}
+		bases = append(bases, base)
+		chunks = append(chunks, sourceChunks...)
+		if keyset != nil {
+			keysets = append(keysets, keyset)
+		}
+	}
+	if fp != nil {
+		if upsert {
+			fp.Watermark = lastMarks[0]
+		}
+		fp.Sql = bases[0].ReadSql
+		i.planSources(fp, bases, chunks, keysets)
+		return nil
+	}
+	if sharded {
+		return i.dispatchShards(tableName, chunks, keysets)
+	}
+	if len(keysets) > 0 {
+		return i.dispatchKeyset(keysets[0])
+	}
+	return i.dispatchChunks(tableName, localColumn(primaryKey), chunks)
+}
+
+// sourceChunks 一个数据源的分段: 整数主键按min/max区间分段, 否则返回游标分页任务
+func (i *importerImplement) sourceChunks(base *readSql, primaryKey, chunkMode string) ([]*readSql, *readSql, error) {
+	ds, name := base.Source, checkpoint(base.TableName, base.Shard)
+	if chunkMode == chunkModeKeyset {
+		log.Printf("keyset chunk %s by %s", name, primaryKey)
+		keyset := *base
+		keyset.Keyset = newKeysetPlan(primaryKey, ds.Driver)
+		return nil, &keyset, nil
+	}
+
 	// get min, max
-	upperSql := strings.ToUpper(sqlStr)
-	fromPos := strings.Index(upperSql, "FROM")
-	minMaxSql := fmt.Sprintf("SELECT MIN(%s) as minId, MAX(%s) as maxId %s ", primaryKey, primaryKey, sqlStr[fromPos:])
-	rowsMinMax, err := i.getRowsFromDb(exDb, minMaxSql)
+	minMaxSql, err := aggregateSql(ds.Driver, base.ReadSql, func(col func(string) string) string {
+		return fmt.Sprintf("MIN(%s) AS %s, MAX(%s) AS %s", col(primaryKey), ds.Driver.Quote("minId"), col(primaryKey), ds.Driver.Quote("maxId"))
+	})
 	if err != nil {
-		return fmt.Errorf("error at min max key:%v", err)
+		return nil, nil, fmt.Errorf("error at min max key:%v", err)
 	}
+	rowsMinMax, release, err := i.getRowsFromDb(ds, base.SetSqls, minMaxSql)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error at min max key:%v", err)
+	}
+	defer release()
 	minId, maxId := 0, 0
 	if rowsMinMax.Next() {
-		errMinmax := rowsMinMax.Scan(&minId, &maxId)
+		var minVal, maxVal sql.NullString
+		errMinmax := rowsMinMax.Scan(&minVal, &maxVal)
 		if errMinmax != nil {
-			return fmt.Errorf("error at scan min max key:%v", errMinmax)
+			return nil, nil, fmt.Errorf("error at scan min max key:%v", errMinmax)
+		}
+		minId, err = strconv.Atoi(minVal.String)
+		if err == nil {
+			maxId, err = strconv.Atoi(maxVal.String)
+		}
+		if fp := i.filePlan(base.TableName); fp != nil && len(base.Shard) == 0 {
+			fp.MinKey, fp.MaxKey = minVal.String, maxVal.String
+		}
+		if minVal.Valid && err != nil {
+			// 非整数主键不能按区间分段, 改用游标分页
+			log.Printf("key %s is not integer (%s), use keyset chunk", primaryKey, minVal.String)
+			keyset := *base
+			keyset.Keyset = newKeysetPlan(primaryKey, ds.Driver)
+			return nil, &keyset, nil
 		}
-		log.Printf("minId: %d, maxId: %d", minId, maxId)
+		log.Printf("%s minId: %d, maxId: %d", name, minId, maxId)
 	} else {
 		log.Println("can not get min max key value")
 	}
 	if maxId-minId < 10000 {
-		i.cfg.ChReadSql <- &readSql{ReadSql: sqlStr, TableName: tableName, IsFirst: true}
-		return nil
+		return []*readSql{base}, nil, nil
 	}
+	var chunks []*readSql
 	limit := 1000
 	for id := minId; id < maxId; id += limit + 1 {
-		betweenSql := sqlStr
-		if !strings.Contains(upperSql, "WHERE") {
-			betweenSql += " WHERE 1=1"
-		}
-		betweenSql += fmt.Sprintf(" AND %s between %d and %d", primaryKey, id, id+limit)
-		i.cfg.ChReadSql <- &readSql{ReadSql: betweenSql, TableName: tableName, IsFirst: id == minId}
+		item := *base
+		item.ReadSql = appendCondition(ds.Driver, base.ReadSql, func(col func(string) string) string {
+			return fmt.Sprintf("%s between %d and %d", col(primaryKey), id, id+limit)
+		})
+		item.IsFirst = base.IsFirst && id == minId
+		item.RangeStart, item.RangeEnd = strconv.Itoa(id), strconv.Itoa(id+limit)
+		chunks = append(chunks, &item)
 	}
-	return nil
+	return chunks, nil, nil
 }
 
-func (i *importerImplement) execSql(tableName, sqlStr string, isFirst bool) error {
-	var exDb *sql.DB
-	var err error
-	//sql文件中指定数据源时，要连接新数据源
-	dsPos := strings.Index(sqlStr, "-- ds=")
-	if dsPos != -1 {
-		end := strings.Index(sqlStr[dsPos:], "\n")
-		ds := sqlStr[dsPos+len("-- ds=") : end]
-		ds = strings.Trim(ds, " \t\r")
-		log.Println("special external data source=", ds)
-
-		exDb, err = svc.NewDbConn(ds)
-		if err != nil {
-			return fmt.Errorf("error at connect exDb:%v", err)
-		}
+// getMaxValue 查询远程字段的最大值
+func (i *importerImplement) getMaxValue(ds *svc.DataSource, setSqls []string, sqlStr string, column string) (sql.NullString, error) {
+	var maxVal sql.NullString
+	maxSql, err := aggregateSql(ds.Driver, sqlStr, func(col func(string) string) string {
+		return fmt.Sprintf("MAX(%s) AS %s", col(column), ds.Driver.Quote("maxVal"))
+	})
+	if err != nil {
+		return maxVal, err
+	}
+	rows, release, err := i.getRowsFromDb(ds, setSqls, maxSql)
+	if err != nil {
+		return maxVal, err
 	}
+	defer release()
+	if rows.Next() {
+		err = rows.Scan(&maxVal)
+	}
+	return maxVal, err
+}
+
+// fileTableName 文件名做表名: posts.sql => posts
+func fileTableName(file string) string {
+	fName := filepath.Base(file)
+	if pos := strings.Index(fName, "."); pos != -1 {
+		return fName[:pos]
+	}
+	return fName
+}
+
+func (i *importerImplement) execSql(item *readSql) error {
+	if item.File != nil {
+		return i.execFile(item)
+	}
+	if item.Keyset != nil {
+		err := i.execKeyset(item)
+		// 全部分页已提交
+		i.tableDone(item.table, err != nil)
+		return err
+	}
+	_, _, err := i.execChunk(item)
+	return err
+}
+
+// execChunk 读取一个分段并提交给写入协程, 返回最后一行和行数
+func (i *importerImplement) execChunk(item *readSql) (map[string]any, int, error) {
+	if item.IsFirst {
+		// 出错时也要放行其他分段
+		defer item.table.markReady()
+	}
+	// 先等建表再查询, 避免占用数据源的并发名额
+	if err := i.waitReady(item); err != nil {
+		return nil, 0, err
+	}
+	tableName, sqlStr := item.writeTable(), item.ReadSql
 
 	//读取远程数据
-	rows, err := i.getRowsFromDb(exDb, sqlStr)
+	rows, release, err := i.getRowsFromDb(item.Source, item.SetSqls, sqlStr)
 	if err != nil {
-		return fmt.Errorf("error at getRowsFromDb:%v", err)
+		return nil, 0, fmt.Errorf("error at getRowsFromDb:%v", err)
 	}
-	defer func() {
-		_ = rows.Close()
-	}()
+	defer release()
 	//空行时要建空表, 避免导出查询报错
 
 	// 创建新表
@@ -321,43 +664,59 @@ func (i *importerImplement) execSql(tableName, sqlStr string, isFirst bool) erro
 	// 获取每列的数据类型
 	cTypes, err := rows.ColumnTypes()
 	if err != nil {
-		return fmt.Errorf("error at get columns types:%v", err)
-	}
-	if isFirst {
-		columnsList := make([]string, len(cTypes))
-		for i, col := range cTypes {
-			t := col.DatabaseTypeName()
-			f := col.Name()
-			sqlLiteType, err1 := utils.MapMySQLTypeToSQLite(t)
-			if err1 != nil {
-				log.Println(err1)
-				columnsList[i] = fmt.Sprintf("%s TEXT", f)
-			} else {
-				// 处理是否可为空
-				nullable, ok := col.Nullable()
-				if ok && !nullable {
-					sqlLiteType += " NOT NULL"
-				}
-				if sqlLiteType == "INTEGER" || sqlLiteType == "REAL" {
-					sqlLiteType += " DEFAULT 0"
-				}
-				columnsList[i] = fmt.Sprintf("%s %s", f, sqlLiteType)
+		return nil, 0, fmt.Errorf("error at get columns types:%v", err)
+	}
+	columns, _ := rows.Columns()
+	// 站点配置的脱敏规则, 写入本地db前替换
+	masks := i.masks.columns(item.TableName, columns)
+	// 每列的值转换, -- type= 指定的类型优先
+	converters := make([]func(any) any, len(cTypes))
+	columnsList := make([]string, len(cTypes))
+	for i, col := range cTypes {
+		t := col.DatabaseTypeName()
+		f := col.Name()
+		if decl, ok := item.Types[f]; ok {
+			st := utils.DeclType(decl)
+			converters[i] = st.Convert
+			columnsList[i] = fmt.Sprintf("%s %s", f, st.Decl)
+		} else if st, err1 := svc.ColumnType(item.Source.Driver, t); err1 != nil {
+			log.Println(err1)
+			columnsList[i] = fmt.Sprintf("%s TEXT", f)
+		} else {
+			converters[i] = st.Convert
+			sqlLiteType := st.Decl
+			// 处理是否可为空
+			nullable, ok := col.Nullable()
+			if ok && !nullable {
+				sqlLiteType += " NOT NULL"
 			}
+			if st.Decl == "INTEGER" || st.Decl == "REAL" {
+				sqlLiteType += " DEFAULT 0"
+			}
+			columnsList[i] = fmt.Sprintf("%s %s", f, sqlLiteType)
 		}
-		_, _ = i.cfg.DbLocal.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", tableName))
-		createTableSQL := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s"+" (%s);", tableName, strings.Join(columnsList, ", "))
-		// 执行CREATE TABLE语句
-		if i.cfg.Debug {
-			log.Println(createTableSQL)
+		if masks != nil && masks[i] != nil {
+			// 脱敏后的值按文本保存, 可以为空, -- type= 指定的类型也不例外
+			columnsList[i] = fmt.Sprintf("%s TEXT", f)
 		}
-		_, err = i.cfg.DbLocal.Exec(createTableSQL)
+	}
+	// 分片导入记录每行来自哪个数据源
+	writeCols := columns
+	if len(item.Shard) > 0 {
+		columnsList = append(columnsList, shardColumn+" TEXT NOT NULL DEFAULT ''")
+		writeCols = append(columns[:len(columns):len(columns)], shardColumn)
+	}
+	if item.IsFirst {
+		err = i.createLocalTable(item, columnsList)
+		item.table.markReady()
 		if err != nil {
-			return fmt.Errorf("error at creating SQLite table:%v", err)
+			return nil, 0, err
 		}
 	}
 
-	columns, _ := rows.Columns()
-	// 读取MySQL数据并写入SQLite
+	var lastRow map[string]any
+	count := 0
+	// 读取数据源数据并写入SQLite
 	for rows.Next() {
 		// 创建一个切片来存储每个字段的地址
 		values := make([]interface{}, len(cTypes))
@@ -368,61 +727,62 @@ func (i *importerImplement) execSql(tableName, sqlStr string, isFirst bool) erro
 
 		// 扫描每一行数据
 		if err := rows.Scan(valuePtrs...); err != nil {
-			return fmt.Errorf("error scanning row: %v", err)
+			return nil, 0, fmt.Errorf("error scanning row: %v", err)
 		}
 
 		// 将结果存储到map中
-		rowMap := make(map[string]interface{}, len(columns))
+		rowMap := make(map[string]interface{}, len(writeCols))
 		for p, col := range columns {
 			var v interface{}
 			val := values[p]
-			if b, ok := val.([]byte); ok {
+			if converters[p] != nil {
+				v = converters[p](val)
+			} else if b, ok := val.([]byte); ok {
 				v = string(b)
 			} else {
 				v = val
 			}
+			if masks != nil && masks[p] != nil {
+				v = masks[p](v)
+			}
 			rowMap[col] = v
 		}
+		if len(item.Shard) > 0 {
+			rowMap[shardColumn] = item.Shard
+		}
 
 		//多表并发写
-		i.cfg.ChWriteRow <- &rowBatch{TableName: tableName, Cols: columns, Item: rowMap}
-
+		item.chunk.read()
+		i.cfg.ChWriteRow <- &rowBatch{TableName: tableName, Cols: writeCols, Item: rowMap, Upsert: item.Upsert, chunk: item.chunk}
+		lastRow = rowMap
+		count++
 	}
-	return nil
-}
-
-// insertBatch 批量插入数据到SQLite
-func (i *importerImplement) insertBatch(rows *rowsBatch) {
-	if len(rows.Items) == 0 {
-		log.Println("empty data")
-		return
+	if err = rows.Err(); err != nil {
+		return nil, count, fmt.Errorf("error reading rows: %v", err)
 	}
+	return lastRow, count, nil
+}
 
-	// 构建INSERT语句
-	columnsList := strings.Join(rows.Cols, ", ")
-	placeholdersList := strings.Repeat("?,", len(rows.Cols))
-	var valSql []string
-
-	// 准备参数
-	args := make([]interface{}, 0, len(rows.Items))
-	for _, row := range rows.Items {
-		for _, col := range rows.Cols {
-			args = append(args, row[col])
-		}
-		valSql = append(valSql, fmt.Sprintf("(%s)", placeholdersList[:len(placeholdersList)-1]))
+// createLocalTable 重建本地表, 增量导入时为主键建唯一索引
+// 全量导入建的是临时表, 唯一索引在替换正式表时再建
+func (i *importerImplement) createLocalTable(item *readSql, columnsList []string) error {
+	tableName := item.writeTable()
+	_, _ = i.cfg.DbLocal.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", tableName))
+	createTableSQL := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s"+" (%s);", tableName, strings.Join(columnsList, ", "))
+	// 执行CREATE TABLE语句
+	if i.cfg.Debug {
+		log.Println(createTableSQL)
 	}
-
-	// 执行批量插入
-	insertSql := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", rows.TableName, columnsList, strings.Join(valSql, ","))
-	stmt, err := i.cfg.DbLocal.Prepare(insertSql)
+	_, err := i.cfg.DbLocal.Exec(createTableSQL)
 	if err != nil {
-		log.Printf("error preparing statement: %v, SQL:%s", err, insertSql)
-		return
+		return fmt.Errorf("error at creating SQLite table:%v", err)
 	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(args...)
-	if err != nil {
-		log.Printf("error executing batch insert: %v", err)
+	// 增量导入按主键覆盖, 需要唯一索引
+	if len(item.KeyCol) > 0 && !item.staging() {
+		_, err = i.cfg.DbLocal.Exec(fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS ux_%s_key ON %s (%s)", tableName, tableName, item.KeyCol))
+		if err != nil {
+			return fmt.Errorf("error at creating unique index:%v", err)
+		}
 	}
+	return nil
 }
@@ -1,15 +1,23 @@
 package importer
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"sqlsyncify/internal/config"
 	"sqlsyncify/internal/svc"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/parquet-go/parquet-go"
 	"github.com/zeromicro/go-zero/core/conf"
 )
 
@@ -29,7 +37,8 @@ func TestImportDb(t *testing.T) {
 	if err != nil {
 		t.Fatal(site, " failed to load site conf: ", err)
 	}
-	conn, err := svc.NewDbConn(siteConf.DataSource)
+	dataSources := svc.NewDataSources()
+	conn, err := dataSources.Get(siteConf.DataSource)
 	if err != nil {
 		t.Fatalf("%s failed to connect DataSource: %v", site, err)
 	}
@@ -39,22 +48,999 @@ func TestImportDb(t *testing.T) {
 	}
 	defer func() {
 		_ = dbLocal.Close()
-		_ = conn.Close()
+		dataSources.Close()
 	}()
 
 	impCfg := &Config{
-		Ctx:      context.Background(),
-		Db:       conn,
-		DbLocal:  dbLocal,
-		Site:     site,
-		Debug:    true,
-		AppConf:  appConf,
-		SiteConf: siteConf,
+		Ctx:         context.Background(),
+		Db:          conn,
+		DataSources: dataSources,
+		DbLocal:     dbLocal,
+		Site:        site,
+		Debug:       true,
+		AppConf:     appConf,
+		SiteConf:    siteConf,
 	}
 	imp := NewImporter(impCfg)
 
-	err = imp.Run()
+	report, err := imp.Run()
+	if err == nil {
+		err = report.Err()
+	}
 	if err != nil {
 		t.Errorf("imp.Run  error = %v", err)
 	}
 }
+
+func TestKeysetPageSql(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		after []any
+		want  string
+	}{
+		{name: "first", key: "wp.ID", want: "select * from wp_posts as wp order by wp.ID asc limit 1000"},
+		{name: "single", key: "wp.ID", after: []any{int64(10)}, want: "select * from wp_posts as wp where wp.ID > 10 order by wp.ID asc limit 1000"},
+		{name: "composite", key: "a.x, a.y", after: []any{int64(1), "b"}, want: "select * from wp_posts as wp where (a.x, a.y) > (1, 'b') order by a.x asc, a.y asc limit 1000"},
+	}
+	drv, err := svc.GetSourceDriver("mysql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := newKeysetPlan(tt.key, drv)
+			if got := plan.pageSql("SELECT * FROM wp_posts wp", tt.after); got != tt.want {
+				t.Errorf("pageSql() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestFallbackSql 不能改写语法树的数据源, 有GROUP BY/ORDER BY/LIMIT的查询包成子查询
+func TestFallbackSql(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	_, err = db.Exec(`CREATE TABLE meta (post_id INTEGER, k TEXT);
+		INSERT INTO meta VALUES (1, 'a'), (1, 'b'), (2, 'a'), (3, 'a'), (3, 'b'), (3, 'c')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drv, err := svc.GetSourceDriver("sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := func(sqlStr string) string {
+		rows, err := db.Query(sqlStr)
+		if err != nil {
+			t.Fatalf("%v\n%s", err, sqlStr)
+		}
+		defer func() {
+			_ = rows.Close()
+		}()
+		var ret []string
+		for rows.Next() {
+			var a, b any
+			if err = rows.Scan(&a, &b); err != nil {
+				t.Fatal(err)
+			}
+			ret = append(ret, fmt.Sprint(a, ":", b))
+		}
+		return strings.Join(ret, ",")
+	}
+	grouped := "SELECT m.post_id, COUNT(*) AS cnt FROM meta m GROUP BY m.post_id -- 注释\n"
+	between := appendCondition(drv, grouped, func(col func(string) string) string {
+		return fmt.Sprintf("%s between %d and %d", col("m.post_id"), 2, 3)
+	})
+	if got := query(between); got != "2:1,3:3" {
+		t.Errorf("between = %s\n%s", got, between)
+	}
+	plan := newKeysetPlan("m.post_id", drv)
+	plan.Size = 1
+	if got := query(plan.pageSql(grouped+" ORDER BY cnt DESC", []any{int64(1)})); got != "2:1" {
+		t.Errorf("page = %s", got)
+	}
+	minMax, err := aggregateSql(drv, grouped+" HAVING cnt > 1", func(col func(string) string) string {
+		return fmt.Sprintf("MIN(%s), MAX(%s)", col("m.post_id"), col("m.post_id"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := query(minMax); got != "1:3" {
+		t.Errorf("min max = %s\n%s", got, minMax)
+	}
+	// 没有WHERE和尾部子句时直接拼接在末尾
+	simple := appendCondition(drv, "SELECT post_id, k FROM meta", func(col func(string) string) string {
+		return col("post_id") + " = 2"
+	})
+	if simple != "SELECT post_id, k FROM meta\nWHERE post_id = 2" || query(simple) != "2:a" {
+		t.Errorf("simple = %s", simple)
+	}
+}
+
+// newTestSite 切换到临时目录, 写入站点demo的文件(路径相对于临时目录), 打开本地db
+func newTestSite(t *testing.T, files map[string]string) *sql.DB {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll("storage", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dbLocal, err := svc.NewSqliteConn("demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = dbLocal.Close()
+	})
+	return dbLocal
+}
+
+// execTestSource 在SQLite数据源文件上执行语句, 文件不存在时创建
+func execTestSource(t *testing.T, file string, stmts ...string) {
+	t.Helper()
+	src, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+	for _, s := range stmts {
+		if _, err = src.Exec(s); err != nil {
+			t.Fatal(s, err)
+		}
+	}
+}
+
+// TestImportSqliteSource 以SQLite文件为数据源跑完整的导入流程, 不需要MySQL
+func TestImportSqliteSource(t *testing.T) {
+	dbLocal := newTestSite(t, map[string]string{
+		"etc/datasources/src.yaml":            "Driver: sqlite3\nDbname: source.db\n",
+		"etc/sites/demo/sql-import/posts.sql": "-- unique=p.id\n-- index=title, created\nSELECT p.id, p.title, p.price, p.created FROM posts p WHERE p.id > 0",
+		"etc/sites/demo/sql-import/tags.sql":  "-- key=t.name\n-- type=t.hits:TEXT\nSELECT t.name, t.hits FROM tags t",
+		"etc/sites/demo/sql-index/tags.sql":   "-- 按点击数排序\nCREATE INDEX IF NOT EXISTS ix_tags_hits ON tags (hits);\n",
+	})
+	execTestSource(t, "source.db",
+		"CREATE TABLE posts (id INTEGER PRIMARY KEY, title VARCHAR(50) NOT NULL, price REAL, created DATETIME)",
+		"WITH RECURSIVE n(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM n WHERE x < 12000) INSERT INTO posts SELECT x, 'post ' || x, x / 10.0, '2024-01-01 00:00:00' FROM n",
+		"CREATE TABLE tags (name TEXT PRIMARY KEY, hits INT)",
+		"INSERT INTO tags VALUES ('go', 3), ('it''s', 1), ('sql', 2)",
+	)
+
+	dataSources := svc.NewDataSources()
+	defer dataSources.Close()
+	ds, err := dataSources.Get("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imp := NewImporter(&Config{
+		Ctx:         context.Background(),
+		Db:          ds,
+		DataSources: dataSources,
+		DbLocal:     dbLocal,
+		Site:        "demo",
+		SiteConf:    &config.SiteConfig{DataSource: "src", Site: "demo"},
+	})
+	report, err := imp.Run()
+	if err == nil {
+		err = report.Err()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for table, want := range map[string]int{"posts": 12000, "tags": 3} {
+		var got int
+		if err = dbLocal.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&got); err != nil {
+			t.Fatal(table, err)
+		}
+		if got != want {
+			t.Errorf("%s rows = %d, want %d", table, got, want)
+		}
+	}
+	var title string
+	var price float64
+	if err = dbLocal.QueryRow("SELECT title, price FROM posts WHERE id = 11001").Scan(&title, &price); err != nil {
+		t.Fatal(err)
+	}
+	if title != "post 11001" || price != 1100.1 {
+		t.Errorf("posts row = %s %v", title, price)
+	}
+	var hitsType string
+	if err = dbLocal.QueryRow("SELECT typeof(hits) FROM tags LIMIT 1").Scan(&hitsType); err != nil || hitsType != "text" {
+		t.Errorf("tags.hits type = %s %v, want text", hitsType, err)
+	}
+	for _, index := range []string{"ux_posts_id", "ix_posts_title_created", "ix_tags_hits"} {
+		var n int
+		if err = dbLocal.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = ?", index).Scan(&n); err != nil || n != 1 {
+			t.Errorf("index %s not created: %v", index, err)
+		}
+	}
+}
+
+// TestImportDataFiles csv/jsonl/parquet文件和 -- file= 指令导入为同名表
+func TestImportDataFiles(t *testing.T) {
+	type event struct {
+		Id   int32     `parquet:"id"`
+		Name string    `parquet:"name"`
+		Tags []string  `parquet:"tags,list"`
+		At   time.Time `parquet:"at,timestamp(millisecond)"`
+	}
+	var events bytes.Buffer
+	if err := parquet.Write(&events, []event{
+		{Id: 1, Name: "open", Tags: []string{"a", "b"}, At: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{Id: 2, Name: "close", At: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	dbLocal := newTestSite(t, map[string]string{
+		"etc/sites/demo/sql-import/prices.csv":     "\ufeffsku,price,note,order,zip,ratio\nA1,10,\"x, y\",3,01234,0.5\nB2,12.5,,,10000,0\n",
+		"etc/sites/demo/sql-import/trans.jsonl":    "{\"id\": 1, \"lang\": \"en\", \"tags\": [\"a\"], \"ok\": true}\n{\"id\": 2, \"lang\": \"de\"}\n",
+		"etc/sites/demo/sql-import/events.parquet": events.String(),
+		"etc/sites/demo/sql-import/curated.sql":    "-- file=../data/list.csv\n-- delimiter=;\n",
+		"etc/sites/demo/data/list.csv":             "post id;rank\n7;1\n9;2\n",
+	})
+	imp := NewImporter(&Config{
+		Ctx:      context.Background(),
+		DbLocal:  dbLocal,
+		Site:     "demo",
+		SiteConf: &config.SiteConfig{Site: "demo"},
+	})
+	report, err := imp.Run()
+	if err == nil {
+		err = report.Err()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT typeof(price) || ':' || SUM(price) FROM prices", "real:22.5"},
+		{"SELECT note FROM prices WHERE sku = 'A1'", "x, y"},
+		{"SELECT COUNT(*) FROM prices WHERE note IS NULL", "1"},
+		{"SELECT \"order\" FROM prices WHERE sku = 'A1'", "3"},
+		{"SELECT tags || ok FROM trans WHERE id = 1", "[\"a\"]1"},
+		{"SELECT typeof(id) FROM trans WHERE lang = 'de'", "integer"},
+		{"SELECT SUM(post_id) FROM curated", "16"},
+		// 以0开头的编号按文本保存, 0 和 0.5 是数字
+		{"SELECT typeof(zip) || ':' || zip FROM prices WHERE sku = 'A1'", "text:01234"},
+		{"SELECT typeof(ratio) || ':' || SUM(ratio) FROM prices", "real:0.5"},
+		{"SELECT typeof(id) || ':' || name || ':' || tags || ':' || at FROM events WHERE id = 1", "integer:open:[\"a\",\"b\"]:2024-01-02 03:04:05"},
+		{"SELECT at FROM events WHERE id = 2", "2024-01-03 00:00:00"},
+	}
+	for _, tt := range tests {
+		var got string
+		if err = dbLocal.QueryRow(tt.query).Scan(&got); err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+
+	// 替换后重名的列
+	dups := map[string]string{"dup.csv": "post id,post_id\n1,2\n", "dup.jsonl": "{\"a-b\": 1, \"A_B\": 2}\n"}
+	for name, content := range dups {
+		if err = os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		reader, err := openDataFile(&dataFile{Path: name})
+		if err == nil {
+			_, err = reader.Next()
+			_ = reader.Close()
+		}
+		if err == nil || !strings.Contains(err.Error(), "duplicate column") {
+			t.Errorf("%s: want duplicate column error, got %v", name, err)
+		}
+	}
+}
+
+// TestImportDependencies -- after= 的文件在依赖导入完成后导入, 依赖失败时跳过
+func TestImportDependencies(t *testing.T) {
+	dbLocal := newTestSite(t, map[string]string{
+		"etc/sites/demo/sql-import/cates.csv":     "id,name\n1,news\n2,blog\n",
+		"etc/sites/demo/sql-import/a_posts.sql":   "-- after=cates, b_tags\n-- file=posts.csv\n",
+		"etc/sites/demo/sql-import/b_tags.sql":    "-- priority=10\n-- file=posts.csv\n",
+		"etc/sites/demo/sql-import/posts.csv":     "id,cate\n1,1\n2,2\n",
+		"etc/sites/demo/sql-import/broken.sql":    "-- file=missing.csv\n",
+		"etc/sites/demo/sql-import/c_after.sql":   "-- after=broken\n-- file=posts.csv\n",
+		"etc/sites/demo/sql-import/loop_a.sql":    "-- after=loop_b\n-- file=posts.csv\n",
+		"etc/sites/demo/sql-import/loop_b.sql":    "-- after=loop_a\n-- file=posts.csv\n",
+		"etc/sites/demo/sql-import/d_unknown.sql": "-- after=not_exists\n-- file=posts.csv\n",
+	})
+	imp := NewImporter(&Config{
+		Ctx:      context.Background(),
+		DbLocal:  dbLocal,
+		Site:     "demo",
+		SiteConf: &config.SiteConfig{Site: "demo"},
+	})
+	report, err := imp.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reports := make(map[string]*FileReport)
+	for _, f := range report.Files {
+		reports[f.Table] = f
+	}
+	tables := &imp.(*importerImplement).tables
+	for _, dep := range []string{"cates", "b_tags"} {
+		value, _ := tables.Load(dep)
+		if finished := value.(*tableState).finished; reports["a_posts"].start.Before(finished) {
+			t.Errorf("a_posts imported before %s finished", dep)
+		}
+	}
+	// 同一层中优先级高的先导入
+	if reports["b_tags"].start.After(reports["cates"].start) {
+		t.Error("b_tags should be imported before cates")
+	}
+	for _, table := range []string{"a_posts", "b_tags", "cates", "d_unknown"} {
+		if f := reports[table]; f == nil || f.Failed() || f.RowsWritten != 2 {
+			t.Errorf("%s = %+v", table, f)
+		}
+	}
+	tests := map[string]string{
+		"broken":  "missing.csv",
+		"c_after": "dependency broken failed",
+		"loop_a":  "circular dependency",
+		"loop_b":  "circular dependency",
+	}
+	for table, want := range tests {
+		f := reports[table]
+		if f == nil || len(f.Errors) == 0 || !strings.Contains(f.Errors[0], want) {
+			t.Errorf("%s = %+v, want error %q", table, f, want)
+		}
+	}
+	var n int
+	if err = dbLocal.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'c_after'").Scan(&n); err != nil || n != 0 {
+		t.Errorf("c_after should not be imported: %d %v", n, err)
+	}
+}
+
+// TestImportPlan 生成导入计划时只执行min/max查询, 不建本地表
+func TestImportPlan(t *testing.T) {
+	dbLocal := newTestSite(t, map[string]string{
+		"etc/datasources/src.yaml":            "Driver: sqlite3\nDbname: source.db\n",
+		"etc/sites/demo/sql-import/posts.sql": "-- ds=src\nSELECT p.id, p.title FROM posts p",
+		"etc/sites/demo/sql-import/tags.sql":  "-- ds=src\n-- key=t.name\n-- after=posts\nSELECT t.name FROM tags t",
+		"etc/sites/demo/sql-import/cates.csv": "id,name\n1,news\n",
+		"etc/sites/demo/sql-import/bad.sql":   "-- ds=src\nSELECT nothing FROM missing_table",
+	})
+	execTestSource(t, "source.db",
+		"CREATE TABLE posts (id INTEGER PRIMARY KEY, title TEXT)",
+		"WITH RECURSIVE n(x) AS (SELECT 5 UNION ALL SELECT x+1 FROM n WHERE x < 12004) INSERT INTO posts SELECT x, 'post ' || x FROM n",
+		"CREATE TABLE tags (name TEXT PRIMARY KEY)",
+		"INSERT INTO tags VALUES ('go'), ('sql')",
+	)
+	dataSources := svc.NewDataSources()
+	defer dataSources.Close()
+	plan, err := NewImporter(&Config{
+		Ctx:         context.Background(),
+		DataSources: dataSources,
+		DbLocal:     dbLocal,
+		Site:        "demo",
+		SiteConf:    &config.SiteConfig{Site: "demo"},
+	}).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plans := make(map[string]*FilePlan)
+	for _, f := range plan.Files {
+		plans[f.Table] = f
+	}
+	posts := plans["posts"]
+	if posts.DataSource != "src" || posts.Driver != "sqlite3" || posts.ChunkMode != chunkModeRange || posts.MinKey != "5" || posts.MaxKey != "12004" {
+		t.Errorf("posts plan = %+v", posts)
+	}
+	if posts.Chunks != 12 || len(posts.Sqls) != 12 || !strings.Contains(posts.Sqls[0], "id between 5 and 1005") || posts.EstimatedRows != -1 {
+		t.Errorf("posts chunks = %d, sqls: %v", posts.Chunks, posts.Sqls)
+	}
+	tags := plans["tags"]
+	if tags.ChunkMode != chunkModeKeyset || tags.Level != 1 || len(tags.Sqls) != 1 || !strings.Contains(tags.Sqls[0], "ORDER BY") {
+		t.Errorf("tags plan = %+v", tags)
+	}
+	if f := plans["cates"]; f.ChunkMode != "file" || f.Chunks != 1 {
+		t.Errorf("cates plan = %+v", f)
+	}
+	if f := plans["bad"]; len(f.Error) == 0 || plan.Err() == nil {
+		t.Errorf("bad plan = %+v", f)
+	}
+	var n int
+	if err = dbLocal.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&n); err != nil || n != 0 {
+		t.Errorf("plan should not create local tables: %d %v", n, err)
+	}
+}
+
+// TestImportDumpFile 以mysqldump文件为数据源, 不需要MySQL
+func TestImportDumpFile(t *testing.T) {
+	files := map[string]string{
+		"prod.sql": "CREATE TABLE `wp_posts` (\n  `ID` bigint unsigned NOT NULL,\n  `post_title` text NOT NULL,\n  `post_date` datetime NOT NULL,\n  `price` decimal(20,2) DEFAULT NULL,\n  `hits` bigint unsigned NOT NULL,\n  PRIMARY KEY (`ID`)\n) ENGINE=InnoDB;\n" +
+			"INSERT INTO `wp_posts` VALUES (1,'Hello','2024-01-01 00:00:00',12345678901234567.25,18446744073709551615),(2,'it\\'s','2024-01-02 00:00:00',10.00,7);\n" +
+			"CREATE TABLE `wp_postmeta` (\n  `meta_id` bigint NOT NULL,\n  `post_id` bigint NOT NULL,\n  `meta_value` longtext,\n  PRIMARY KEY (`meta_id`),\n  KEY `post_id` (`post_id`)\n);\n" +
+			"INSERT INTO `wp_postmeta` VALUES (1,1,'red'),(2,2,NULL);\n",
+		"etc/datasources/prod.yaml":           "Driver: dumpfile\nDbname: prod.sql\n",
+		"etc/sites/demo/sql-import/posts.sql": "-- key=p.ID\nSELECT p.ID, CONCAT(p.post_title, '-', IFNULL(m.meta_value, 'none')) AS title, p.post_date, p.price, p.hits FROM `wp_posts` p LEFT JOIN `wp_postmeta` m ON m.post_id = p.ID",
+	}
+	dbLocal := newTestSite(t, files)
+
+	dataSources := svc.NewDataSources()
+	defer dataSources.Close()
+	ds, err := dataSources.Get("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imp := NewImporter(&Config{
+		Ctx:         context.Background(),
+		Db:          ds,
+		DataSources: dataSources,
+		DbLocal:     dbLocal,
+		Site:        "demo",
+		SiteConf:    &config.SiteConfig{DataSource: "prod", Site: "demo"},
+	})
+	report, err := imp.Run()
+	if err == nil {
+		err = report.Err()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles string
+	if err = dbLocal.QueryRow("SELECT group_concat(title, '|') FROM (SELECT title FROM posts ORDER BY ID)").Scan(&titles); err != nil {
+		t.Fatal(err)
+	}
+	if titles != "Hello-red|it's-none" {
+		t.Errorf("titles = %s", titles)
+	}
+	// DECIMAL和BIGINT UNSIGNED按数值保存, 超出精度的值按BLOB精确保存, 排在数值之后
+	var prices string
+	if err = dbLocal.QueryRow("SELECT group_concat(typeof(price) || ':' || price || ',' || typeof(hits) || ':' || hits, '|') FROM (SELECT price, hits FROM posts ORDER BY price)").Scan(&prices); err != nil {
+		t.Fatal(err)
+	}
+	if prices != "integer:10,integer:7|blob:12345678901234567.25,blob:18446744073709551615" {
+		t.Errorf("prices = %s", prices)
+	}
+
+	// dump替换为修改时间更早的文件, 同时获取时只还原一次到新的临时库
+	if err = os.WriteFile("prod.sql", []byte(strings.ReplaceAll(files["prod.sql"], "Hello", "Bye")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err = os.Chtimes("prod.sql", old, old); err != nil {
+		t.Fatal(err)
+	}
+	oldDs := ds
+	got := make([]*svc.DataSource, 4)
+	var wg sync.WaitGroup
+	for n := range got {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got[n], _ = dataSources.Get("prod")
+		}()
+	}
+	wg.Wait()
+	for _, g := range got {
+		if g == nil || g != got[0] || g == oldDs {
+			t.Fatalf("reopened datasources = %v, old %p", got, oldDs)
+		}
+	}
+	if err = got[0].Db.QueryRow("SELECT post_title FROM wp_posts WHERE ID = 1").Scan(&titles); err != nil || titles != "Bye" {
+		t.Errorf("restored again = %s %v", titles, err)
+	}
+	// 旧连接池在使用者归还前仍读旧的临时库
+	if err = oldDs.Db.QueryRow("SELECT post_title FROM wp_posts WHERE ID = 1").Scan(&titles); err != nil || titles != "Hello" {
+		t.Errorf("old datasource = %s %v", titles, err)
+	}
+	if scratch, _ := filepath.Glob("storage/dump_*.db"); len(scratch) != 2 {
+		t.Errorf("restored dumps = %v", scratch)
+	}
+	dataSources.Put(oldDs)
+	if oldDs.Db.Ping() == nil {
+		t.Error("old datasource should be closed")
+	}
+	if scratch, _ := filepath.Glob("storage/dump_*.db"); len(scratch) != 1 {
+		t.Errorf("old restored dump should be removed: %v", scratch)
+	}
+}
+
+// TestImportStaging 导入失败时保留上次完整的表
+func TestImportStaging(t *testing.T) {
+	dbLocal := newTestSite(t, map[string]string{
+		"etc/datasources/src.yaml":            "Driver: sqlite3\nDbname: source.db\n",
+		"etc/sites/demo/sql-import/items.sql": "SELECT id, abs(v) AS v FROM items",
+	})
+	execTestSource(t, "source.db", "CREATE TABLE items (id INTEGER PRIMARY KEY, v INTEGER); INSERT INTO items VALUES (1, 1), (2, -2), (3, 3)")
+	run := func(maxMismatchRate float64) (*Report, error) {
+		dataSources := svc.NewDataSources()
+		defer dataSources.Close()
+		ds, err := dataSources.Get("src")
+		if err != nil {
+			t.Fatal(err)
+		}
+		imp := NewImporter(&Config{
+			Ctx:         context.Background(),
+			Db:          ds,
+			DataSources: dataSources,
+			DbLocal:     dbLocal,
+			Site:        "demo",
+			SiteConf:    &config.SiteConfig{DataSource: "src", Site: "demo", MaxMismatchRate: maxMismatchRate},
+		})
+		report, err := imp.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report, report.Err()
+	}
+	count := func(table string) int {
+		var n int
+		if err := dbLocal.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+			return -1
+		}
+		return n
+	}
+
+	if _, err := run(0); err != nil {
+		t.Fatal(err)
+	}
+	if n := count("items"); n != 3 {
+		t.Fatalf("items = %d, want 3", n)
+	}
+	// abs溢出, 读取中途出错
+	execTestSource(t, "source.db", "INSERT INTO items VALUES (4, 5), (5, -9223372036854775808)")
+	report, err := run(0)
+	if err == nil {
+		t.Error("failed import: want error")
+	}
+	if len(report.Files) != 1 || report.Files[0].ChunksFailed != 1 || report.Files[0].RowsWritten != 4 || len(report.Files[0].Errors) == 0 {
+		t.Errorf("file report = %+v", report.Files)
+	}
+	if len(report.Tables) != 1 || report.Tables[0].SourceRows != 5 || report.Tables[0].LocalRows != 4 || report.Tables[0].Missing != 1 {
+		t.Errorf("reconciliation = %+v", report.Tables)
+	}
+	if err = (&Report{Tables: report.Tables, MaxMismatchRate: 0.5}).Err(); err != nil {
+		t.Errorf("mismatch within max rate: %v", err)
+	}
+	if n := count("items"); n != 3 {
+		t.Errorf("failed import: items = %d, want the previous 3", n)
+	}
+	execTestSource(t, "source.db", "DELETE FROM items WHERE id = 5")
+	if _, err = run(0); err != nil {
+		t.Fatal(err)
+	}
+	if n := count("items"); n != 4 {
+		t.Errorf("items = %d, want 4", n)
+	}
+	if n := count(stagingTable("items")); n != -1 {
+		t.Errorf("staging table should be renamed, rows = %d", n)
+	}
+}
+
+// TestImportResume resume=1 只重新导入未完成的分段: 按范围分段清除失败分段已写入的行, 游标分页从最后连续完成的一页之后继续
+func TestImportResume(t *testing.T) {
+	dbLocal := newTestSite(t, map[string]string{
+		"etc/datasources/src.yaml":            "Driver: sqlite3\nDbname: source.db\n",
+		"etc/sites/demo/sql-import/items.sql": "SELECT id, abs(v) AS v FROM items",
+		"etc/sites/demo/sql-import/pages.sql": "-- chunk=keyset\nSELECT id, abs(v) AS v FROM pages",
+	})
+	// 主键跨度超过10000才按范围分段: 1~1001, 1002~2002, ...; 分页每页1000行; id=1500 的abs溢出, 读取中途出错
+	var stmts []string
+	for _, table := range []string{"items", "pages"} {
+		stmts = append(stmts,
+			fmt.Sprintf("CREATE TABLE %s (id INTEGER PRIMARY KEY, v INTEGER)", table),
+			fmt.Sprintf("WITH RECURSIVE n(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM n WHERE x < 2500) INSERT INTO %s SELECT x, x FROM n", table),
+			fmt.Sprintf("UPDATE %s SET v = -9223372036854775808 WHERE id = 1500", table),
+		)
+	}
+	stmts = append(stmts, "INSERT INTO items VALUES (11000, 11000)")
+	execTestSource(t, "source.db", stmts...)
+	run := func(resume bool) map[string]*FileReport {
+		dataSources := svc.NewDataSources()
+		defer dataSources.Close()
+		ds, err := dataSources.Get("src")
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := NewImporter(&Config{
+			Ctx:         context.Background(),
+			Db:          ds,
+			DataSources: dataSources,
+			DbLocal:     dbLocal,
+			Site:        "demo",
+			Resume:      resume,
+			SiteConf:    &config.SiteConfig{DataSource: "src", Site: "demo"},
+		}).Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret := make(map[string]*FileReport)
+		for _, f := range report.Files {
+			ret[f.Table] = f
+		}
+		return ret
+	}
+	query := func(q string) string {
+		var ret sql.NullString
+		if err := dbLocal.QueryRow(q).Scan(&ret); err != nil {
+			t.Fatal(q, err)
+		}
+		return ret.String
+	}
+	// 未完成的分段
+	status := func(table string) string {
+		return query(fmt.Sprintf("SELECT group_concat(seq || ':' || status, ',') FROM (SELECT seq, status FROM %s WHERE table_name = '%s' AND status <> 'done' ORDER BY seq)", chunkTable, table))
+	}
+	count := func(table string) string {
+		return query(fmt.Sprintf("SELECT COUNT(*) || '/' || COUNT(DISTINCT id) FROM %s", table))
+	}
+
+	run(false)
+	if got := status("items") + " " + status("pages"); got != "1:failed 1:failed" {
+		t.Errorf("unfinished chunks = %s", got)
+	}
+	if got := count(stagingTable("items")) + " " + count(stagingTable("pages")); got != "1998/1998 1499/1499" {
+		t.Errorf("staging rows = %s", got)
+	}
+	// 已完成分段中的修改不会被重新读取
+	execTestSource(t, "source.db",
+		"UPDATE items SET v = 1500 WHERE id = 1500", "UPDATE items SET v = 999 WHERE id IN (10, 2200)",
+		"UPDATE pages SET v = 1500 WHERE id = 1500", "UPDATE pages SET v = 999 WHERE id = 10",
+	)
+	reports := run(true)
+	if f := reports["items"]; f.Failed() || f.RowsRead != 1001 {
+		t.Errorf("resume items = %+v", f)
+	}
+	if f := reports["pages"]; f.Failed() || f.RowsRead != 1500 {
+		t.Errorf("resume pages = %+v", f)
+	}
+	if got := count("items") + " " + count("pages"); got != "2501/2501 2500/2500" {
+		t.Errorf("resumed rows = %s", got)
+	}
+	if got := query("SELECT group_concat(v, ',') FROM (SELECT v FROM items WHERE id IN (10, 1500, 2200) ORDER BY id)"); got != "10,1500,2200" {
+		t.Errorf("resumed items = %s", got)
+	}
+	if got := query("SELECT group_concat(v, ',') FROM (SELECT v FROM pages WHERE id IN (10, 1500) ORDER BY id)"); got != "10,1500" {
+		t.Errorf("resumed pages = %s", got)
+	}
+	if got := status("items") + status("pages"); got != "" {
+		t.Errorf("resumed chunks = %s", got)
+	}
+
+	// 分段全部完成但还没有替换正式表时, 续传只替换
+	if err := os.Remove("etc/sites/demo/sql-import/pages.sql"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbLocal.Exec(fmt.Sprintf("CREATE TABLE %s AS SELECT id, v + 1 AS v FROM items", stagingTable("items"))); err != nil {
+		t.Fatal(err)
+	}
+	if f := run(true)["items"]; f.Failed() || f.RowsRead != 0 {
+		t.Errorf("resume swap = %+v", f)
+	}
+	if got := query("SELECT v FROM items WHERE id = 10") + " " + count("items"); got != "11 2501/2501" {
+		t.Errorf("swapped items = %s", got)
+	}
+	if dbLocal.QueryRow(fmt.Sprintf("SELECT 1 FROM %s", stagingTable("items"))).Scan(new(int)) == nil {
+		t.Error("staging table should be renamed")
+	}
+}
+
+// TestImportWatermark 第一次全量导入并记录水位, 之后只拉取不小于水位的行, 按 -- key= 覆盖写入
+func TestImportWatermark(t *testing.T) {
+	dbLocal := newTestSite(t, map[string]string{
+		"etc/datasources/src.yaml":            "Driver: sqlite3\nDbname: source.db\n",
+		"etc/sites/demo/sql-import/posts.sql": "-- key=p.id\n-- incremental=p.modified\nSELECT p.id, p.title, p.modified FROM posts p",
+	})
+	execTestSource(t, "source.db", "CREATE TABLE posts (id INTEGER PRIMARY KEY, title TEXT, modified TEXT); INSERT INTO posts VALUES (1, 'a', '2024-01-01'), (2, 'b', '2024-01-02')")
+	run := func() *FileReport {
+		dataSources := svc.NewDataSources()
+		defer dataSources.Close()
+		ds, err := dataSources.Get("src")
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := NewImporter(&Config{
+			Ctx:         context.Background(),
+			Db:          ds,
+			DataSources: dataSources,
+			DbLocal:     dbLocal,
+			Site:        "demo",
+			SiteConf:    &config.SiteConfig{DataSource: "src", Site: "demo"},
+		}).Run()
+		if err == nil {
+			err = report.Err()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report.Files[0]
+	}
+	query := func(q string) string {
+		var ret string
+		if err := dbLocal.QueryRow(q).Scan(&ret); err != nil {
+			t.Fatal(q, err)
+		}
+		return ret
+	}
+	watermark := "SELECT watermark_col || '=' || watermark FROM " + watermarkTable + " WHERE table_name = 'posts'"
+
+	if f := run(); f.RowsRead != 2 || f.RowsWritten != 2 {
+		t.Errorf("full import = %+v", f)
+	}
+	if got := query(watermark); got != "p.modified=2024-01-02" {
+		t.Errorf("watermark = %s", got)
+	}
+	// 水位之前的修改不拉取, 等于水位的行重新拉取
+	execTestSource(t, "source.db",
+		"UPDATE posts SET title = 'a2', modified = '2024-01-01' WHERE id = 1",
+		"UPDATE posts SET title = 'b2' WHERE id = 2",
+		"INSERT INTO posts VALUES (3, 'c', '2024-01-03')",
+	)
+	if f := run(); f.RowsRead != 2 || f.RowsWritten != 2 {
+		t.Errorf("incremental import = %+v", f)
+	}
+	if got := query("SELECT group_concat(id || ':' || title, ',') FROM (SELECT * FROM posts ORDER BY id)"); got != "1:a,2:b2,3:c" {
+		t.Errorf("posts = %s", got)
+	}
+	if got := query(watermark); got != "p.modified=2024-01-03" {
+		t.Errorf("watermark = %s", got)
+	}
+}
+
+// TestReconcileGroupBy GROUP BY查询的分段读取失败时, 数据源行数按分组后的行数统计
+func TestReconcileGroupBy(t *testing.T) {
+	newTestSite(t, map[string]string{"etc/datasources/src.yaml": "Driver: sqlite3\nDbname: source.db\n"})
+	// 分段1~3中有6行meta, 3个分组
+	execTestSource(t, "source.db", `CREATE TABLE meta (post_id INTEGER, v INTEGER);
+		INSERT INTO meta VALUES (1, 1), (1, 2), (2, 3), (2, 4), (3, 5), (3, 6), (4, 7)`)
+	dataSources := svc.NewDataSources()
+	defer dataSources.Close()
+	ds, err := dataSources.Get("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imp := NewImporter(&Config{
+		Ctx:      context.Background(),
+		Db:       ds,
+		Site:     "demo",
+		SiteConf: &config.SiteConfig{DataSource: "src", Site: "demo"},
+	}).(*importerImplement)
+	// 分段1~3读取2行后失败
+	item := &readSql{TableName: "post_meta", Source: ds}
+	item.ReadSql = appendCondition(ds.Driver, "SELECT m.post_id, COUNT(*) AS cnt FROM meta m GROUP BY m.post_id;", func(col func(string) string) string {
+		return fmt.Sprintf("%s between 1 and 3", col("m.post_id"))
+	})
+	c := &chunkState{TableName: "post_meta", table: &tableState{Name: "post_meta"}}
+	c.read()
+	c.read()
+	imp.countLost(c, item, item.ReadSql)
+	if r := newReconciliation("post_meta", "", &c.table.rowCounters); r.Unknown || r.SourceRows != 3 || r.Missing != 3 {
+		t.Errorf("reconciliation = %+v", r)
+	}
+}
+
+// TestImportShards 两个SQLite分片写入同一张表, 按分片核对行数
+func TestImportShards(t *testing.T) {
+	dbLocal := newTestSite(t, map[string]string{
+		"etc/datasources/shard_a.yaml":        "Driver: sqlite3\nDbname: shard_a.db\n",
+		"etc/datasources/shard_b.yaml":        "Driver: sqlite3\nDbname: shard_b.db\n",
+		"etc/datasources/groups/tenants.yaml": "DataSources:\n  - shard_a\n  - shard_b\n",
+		"etc/sites/demo/sql-import/posts.sql": "-- ds=tenants\n-- incremental=p.modified\nSELECT p.id, p.title, p.modified FROM posts p",
+		"etc/sites/demo/sql-import/tags.sql":  "-- ds=shard_a, shard_b\n-- key=t.name\n-- chunk=keyset\nSELECT t.name FROM tags t",
+	})
+	shards := map[string][]string{
+		"shard_a": {"INSERT INTO posts VALUES (1, 'a1', 1), (2, 'a2', 1), (3, 'a3', 1)", "INSERT INTO tags VALUES ('go'), ('sql')"},
+		"shard_b": {"INSERT INTO posts VALUES (2, 'b2', 1), (3, 'b3', 1)", "INSERT INTO tags VALUES ('go')"},
+	}
+	for name, inserts := range shards {
+		execTestSource(t, name+".db", append([]string{"CREATE TABLE posts (id INTEGER PRIMARY KEY, title TEXT, modified INTEGER)", "CREATE TABLE tags (name TEXT PRIMARY KEY)"}, inserts...)...)
+	}
+	run := func() *Report {
+		dataSources := svc.NewDataSources()
+		defer dataSources.Close()
+		report, err := NewImporter(&Config{
+			Ctx:         context.Background(),
+			DataSources: dataSources,
+			DbLocal:     dbLocal,
+			Site:        "demo",
+			SiteConf:    &config.SiteConfig{Site: "demo"},
+		}).Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = report.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	query := func(q string) string {
+		var ret string
+		if err := dbLocal.QueryRow(q).Scan(&ret); err != nil {
+			t.Fatal(q, err)
+		}
+		return ret
+	}
+
+	report := run()
+	if got := query("SELECT group_concat(_shard || ':' || id, ',') FROM (SELECT * FROM posts ORDER BY _shard, id)"); got != "shard_a:1,shard_a:2,shard_a:3,shard_b:2,shard_b:3" {
+		t.Errorf("posts = %s", got)
+	}
+	if got := query("SELECT group_concat(_shard || ':' || name, ',') FROM (SELECT * FROM tags ORDER BY _shard, name)"); got != "shard_a:go,shard_a:sql,shard_b:go" {
+		t.Errorf("tags = %s", got)
+	}
+	var tables []string
+	for _, r := range report.Tables {
+		tables = append(tables, fmt.Sprintf("%s@%s:%d/%d", r.Table, r.Shard, r.LocalRows, r.SourceRows))
+	}
+	if got := strings.Join(tables, ","); got != "posts@:5/5,posts@shard_a:3/3,posts@shard_b:2/2,tags@:3/3,tags@shard_a:2/2,tags@shard_b:1/1" {
+		t.Errorf("reconciliation = %s", got)
+	}
+	if got := query(fmt.Sprintf("SELECT group_concat(table_name, ',') FROM (SELECT DISTINCT table_name FROM %s ORDER BY table_name)", chunkTable)); got != "posts@shard_a,posts@shard_b,tags@shard_a,tags@shard_b" {
+		t.Errorf("chunk checkpoints = %s", got)
+	}
+
+	// 每个分片按自己的水位增量导入, 相同主键的行按分片区分
+	execTestSource(t, "shard_b.db", "INSERT INTO posts VALUES (4, 'b4', 2); UPDATE posts SET title = 'b3 updated', modified = 2 WHERE id = 3")
+	run()
+	if got := query("SELECT group_concat(_shard || ':' || title, ',') FROM (SELECT * FROM posts ORDER BY _shard, id)"); got != "shard_a:a1,shard_a:a2,shard_a:a3,shard_b:b2,shard_b:b3 updated,shard_b:b4" {
+		t.Errorf("incremental posts = %s", got)
+	}
+	if got := query(fmt.Sprintf("SELECT group_concat(table_name || '=' || watermark, ',') FROM (SELECT * FROM %s ORDER BY table_name)", watermarkTable)); got != "posts@shard_a=1,posts@shard_b=2" {
+		t.Errorf("watermarks = %s", got)
+	}
+}
+
+// TestImportMasks 脱敏规则在写入本地db前生效
+func TestImportMasks(t *testing.T) {
+	dbLocal := newTestSite(t, map[string]string{
+		"etc/datasources/src.yaml":             "Driver: sqlite3\nDbname: source.db\n",
+		"etc/datasources/prod.yaml":            "Driver: dumpfile\nDbname: prod.sql\n",
+		"etc/sites/demo/sql-import/users.sql":  "-- ds=src\n-- type=phone:INTEGER,address:TEXT NOT NULL\nSELECT u.id, u.email, u.phone, u.address, u.name FROM users u",
+		"etc/sites/demo/sql-import/orders.sql": "-- file=../orders.csv\n-- type=email:INTEGER",
+		"etc/sites/demo/orders.csv":            "id,email\n1,a@shop.com\n",
+		"prod.sql":                             "CREATE TABLE `users` (`id` int NOT NULL, `email` text);\nINSERT INTO `users` VALUES (1,'a@shop.com');\n",
+	})
+	execTestSource(t, "source.db", "CREATE TABLE users (id INTEGER PRIMARY KEY, email TEXT, phone TEXT, address TEXT NOT NULL, name TEXT); INSERT INTO users VALUES (1, 'a@shop.com', '+1 555-0100', 'No.1 Road', 'Alice'), (2, NULL, '555', 'No.2 Road', 'Bob')")
+	run := func(masks []config.MaskRule) (*Report, error) {
+		dataSources := svc.NewDataSources()
+		defer dataSources.Close()
+		return NewImporter(&Config{
+			Ctx:         context.Background(),
+			DataSources: dataSources,
+			DbLocal:     dbLocal,
+			Site:        "demo",
+			SiteConf:    &config.SiteConfig{Site: "demo", Masks: masks},
+		}).Run()
+	}
+	masks := []config.MaskRule{
+		{Table: "users", Columns: []string{"email"}, Method: "hash", Salt: "s"},
+		{Table: "orders", Columns: []string{"email"}, Method: "hash", Salt: "s"},
+		{Table: "users", Columns: []string{"phone"}, Method: "fake"},
+		{Table: "users", Columns: []string{"address"}, Method: "null"},
+		{Table: "users", Columns: []string{"Name"}, Method: "truncate", Length: 1},
+	}
+	report, err := run(masks)
+	if err != nil || report.Err() != nil {
+		t.Fatal(err, report.Err())
+	}
+	var email, orderEmail, phone, name sql.NullString
+	var nulls int
+	if err = dbLocal.QueryRow("SELECT u.email, o.email, u.phone, u.name FROM users u, orders o WHERE u.id = 1 AND o.id = 1").Scan(&email, &orderEmail, &phone, &name); err != nil {
+		t.Fatal(err)
+	}
+	if len(email.String) != 64 || email.String != orderEmail.String || strings.Contains(email.String, "shop") {
+		t.Errorf("hashed email = %s, orders = %s", email.String, orderEmail.String)
+	}
+	if len(phone.String) != len("+1 555-0100") || phone.String[:1] != "+" || phone.String == "+1 555-0100" {
+		t.Errorf("fake phone = %s", phone.String)
+	}
+	if name.String != "A" {
+		t.Errorf("truncated name = %s", name.String)
+	}
+	if err = dbLocal.QueryRow("SELECT COUNT(*) FROM users WHERE address IS NULL AND (id = 1 OR email IS NULL)").Scan(&nulls); err != nil || nulls != 2 {
+		t.Errorf("masked nulls = %d %v", nulls, err)
+	}
+	// -- type= 指定的类型不影响脱敏列按文本保存
+	var decls string
+	if err = dbLocal.QueryRow("SELECT GROUP_CONCAT(type, ',') FROM (SELECT type FROM pragma_table_info('users') WHERE name IN ('phone', 'address') UNION ALL SELECT type FROM pragma_table_info('orders') WHERE name = 'email')").Scan(&decls); err != nil || decls != "TEXT,TEXT,TEXT" {
+		t.Errorf("masked column types = %s %v", decls, err)
+	}
+
+	if _, err = run([]config.MaskRule{{Table: "users", Columns: []string{"name"}, Method: "truncate"}}); err == nil {
+		t.Error("truncate without length: want error")
+	}
+	report, err = run([]config.MaskRule{{Table: "users", Columns: []string{"id"}, Method: "hash"}})
+	if err != nil || report.Err() == nil || !strings.Contains(report.Err().Error(), "can not be masked") {
+		t.Errorf("mask key column: %v %v", err, report.Err())
+	}
+
+	// dump还原的临时库是原始数据, 有脱敏规则时不还原
+	if err = os.WriteFile("etc/sites/demo/sql-import/users.sql", []byte("-- ds=prod\nSELECT u.id, u.email FROM users u"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err = run(masks)
+	if err != nil || report.Err() == nil || !strings.Contains(report.Err().Error(), "unmasked") {
+		t.Errorf("masked dumpfile source: %v %v", err, report.Err())
+	}
+	if files, _ := filepath.Glob("storage/dump_*.db"); len(files) != 0 {
+		t.Errorf("dump restored: %v", files)
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	for cols, want := range map[int]int{0: maxBatchRows, 3: maxBatchRows, 100: 327, 40000: 1} {
+		if got := batchSize(cols); got != want {
+			t.Errorf("batchSize(%d) = %d, want %d", cols, got, want)
+		}
+	}
+}
+
+// TestWriterFlush 剩余的行按2的幂拆成多行INSERT
+func TestWriterFlush(t *testing.T) {
+	db, err := sql.Open("sqlite3", t.TempDir()+"/local.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	if _, err = db.Exec(`CREATE TABLE items (id INTEGER, "order" INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	w := newLocalWriter(&importerImplement{cfg: &Config{}}, db)
+	c := &chunkState{TableName: "items"}
+	for n := range 137 {
+		c.read()
+		w.add(&rowBatch{TableName: "items", Cols: []string{"id", "order"}, Item: map[string]any{"id": n, "order": n}, chunk: c})
+	}
+	w.commit()
+	w.close()
+	var count int
+	if err = db.QueryRow("SELECT COUNT(*) FROM items").Scan(&count); err != nil || count != 137 {
+		t.Errorf("rows = %d %v", count, err)
+	}
+	// 128 + 8 + 1
+	if w.stats.Statements != 3 || w.stats.Transactions != 1 || c.pending.Load() != 0 {
+		t.Errorf("stats = %+v", w.stats)
+	}
+}
+
+// TestIndexHooks 增量导入只执行有 -- incremental=1 的 sql-index 文件
+func TestIndexHooks(t *testing.T) {
+	dbLocal := newTestSite(t, map[string]string{
+		"etc/sites/demo/sql-index/posts.sql": "INSERT INTO hook_log VALUES ('posts')",
+		"etc/sites/demo/sql-index/tags.sql":  "-- incremental=1\nINSERT INTO hook_log VALUES ('tags')",
+	})
+	_, err := dbLocal.Exec("CREATE TABLE hook_log (name TEXT)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imp := NewImporter(&Config{Ctx: context.Background(), DbLocal: dbLocal, Site: "demo", SiteConf: &config.SiteConfig{Site: "demo"}}).(*importerImplement)
+	for _, staging := range []bool{true, false} {
+		for _, name := range []string{"posts", "tags"} {
+			if err = imp.createIndexes(&tableState{Name: name, Staging: staging}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var got string
+	if err = dbLocal.QueryRow("SELECT group_concat(name, ',') FROM hook_log").Scan(&got); err != nil || got != "posts,tags,tags" {
+		t.Errorf("hooks = %s %v, want posts,tags,tags", got, err)
+	}
+}
@@ -0,0 +1,85 @@
+package importer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sqlsyncify/internal/utils"
+	"strings"
+)
+
+// localIndex sql文件中的索引指令: -- index=ID, -- unique=cat_id, 多列用逗号分隔
+type localIndex struct {
+	Columns []string
+	Unique  bool
+}
+
+// parseIndexes 每行索引指令建一个索引
+func parseIndexes(sqlStr string) []localIndex {
+	var ret []localIndex
+	for _, name := range []string{"index", "unique"} {
+		for _, val := range utils.SqlDirectives(sqlStr, name) {
+			var cols []string
+			for _, col := range strings.Split(val, ",") {
+				if col = localColumn(col); len(col) > 0 {
+					cols = append(cols, col)
+				}
+			}
+			if len(cols) > 0 {
+				ret = append(ret, localIndex{Columns: cols, Unique: name == "unique"})
+			}
+		}
+	}
+	return ret
+}
+
+func (ix localIndex) createSql(tableName string) string {
+	create, prefix := "CREATE INDEX", "ix"
+	if ix.Unique {
+		create, prefix = "CREATE UNIQUE INDEX", "ux"
+	}
+	return fmt.Sprintf("%s IF NOT EXISTS %s_%s_%s ON %s (%s)", create, prefix, tableName, strings.Join(ix.Columns, "_"), tableName, strings.Join(ix.Columns, ", "))
+}
+
+// createIndexes 表导入完成后, 创建索引指令和站点 sql-index/{表名}.sql 中的索引
+// 增量导入时表没有重建, sql-index中的语句只在文件有 -- incremental=1 时执行
+func (i *importerImplement) createIndexes(t *tableState) error {
+	stmts := make([]string, 0, len(t.Indexes))
+	for _, ix := range t.Indexes {
+		stmts = append(stmts, ix.createSql(t.Name))
+	}
+	hook := fmt.Sprintf("./etc/sites/%s/sql-index/%s.sql", i.cfg.Site, t.Name)
+	if content, err := i.cfg.TplVars.RenderFile(hook); err == nil {
+		if !t.Staging && utils.SqlDirective(content, "incremental") != "1" {
+			log.Printf("incremental import %s: skip %s", t.Name, hook)
+			content = ""
+		}
+		for _, stmt := range strings.Split(content, ";") {
+			if !onlyComments(stmt) {
+				stmts = append(stmts, stmt)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("error at load index file:%v", err)
+	}
+	for _, stmt := range stmts {
+		if _, err := i.cfg.DbLocal.Exec(stmt); err != nil {
+			return fmt.Errorf("error at create index:%v, SQL:%s", err, strings.TrimSpace(stmt))
+		}
+	}
+	if len(stmts) > 0 {
+		log.Printf("create indexes on %s: %d", t.Name, len(stmts))
+	}
+	return nil
+}
+
+// onlyComments 语句为空或只有注释行
+func onlyComments(stmt string) bool {
+	for _, line := range strings.Split(stmt, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) > 0 && !strings.HasPrefix(line, "--") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,240 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sqlsyncify/internal/svc"
+	"sqlsyncify/internal/utils"
+	"strings"
+	"time"
+)
+
+// 分段方式: range 按整数主键的min/max区间分段(默认), keyset 按主键游标分页
+const (
+	chunkModeRange  = "range"
+	chunkModeKeyset = "keyset"
+)
+
+const keysetPageSize = 1000
+
+// keysetPlan 按主键游标分页抽取: WHERE key > last ORDER BY key LIMIT n
+// 适用于VARCHAR/UUID等非整数主键和多列主键, 只能顺序读取
+type keysetPlan struct {
+	// 远程字段表达式
+	Keys []string
+	// 结果集中对应的列名
+	Cols []string
+	Size int
+	// 续传时的起点, 为空时从头读取
+	After []any
+	// 续传时的起始分段序号
+	Seq int
+	// 数据源引擎, 决定字面量写法和能否改写语法树
+	Driver svc.SourceDriver
+}
+
+func newKeysetPlan(primaryKey string, drv svc.SourceDriver) *keysetPlan {
+	plan := &keysetPlan{Size: keysetPageSize, Driver: drv}
+	for _, key := range strings.Split(primaryKey, ",") {
+		key = strings.TrimSpace(key)
+		if len(key) == 0 {
+			continue
+		}
+		plan.Keys = append(plan.Keys, key)
+		plan.Cols = append(plan.Cols, localColumn(key))
+	}
+	return plan
+}
+
+// pageSql 生成下一页的查询
+func (p *keysetPlan) pageSql(sqlStr string, after []any) string {
+	if p.Driver.Rewritable() {
+		ret := sqlStr
+		if len(after) > 0 {
+			ret = appendCondition(p.Driver, ret, keysetCondition(p.Driver, p.Keys, after))
+		}
+		ret, err := utils.SqlOrderLimit(ret, p.Keys, p.Size)
+		if err == nil {
+			return ret
+		}
+		log.Println("rewrite sql error, order by on subquery:", err)
+	}
+	// 不能改写语法树时, 有排序或分组的查询包成子查询再排序
+	sqlStr, col := wrapQuery(p.Driver, sqlStr)
+	if len(after) > 0 {
+		sqlStr += "\nWHERE " + keysetCondition(p.Driver, p.Keys, after)(col)
+	}
+	orderBy := make([]string, len(p.Keys))
+	for n, key := range p.Keys {
+		orderBy[n] = col(key)
+	}
+	return fmt.Sprintf("%s\nORDER BY %s LIMIT %d", sqlStr, strings.Join(orderBy, ", "), p.Size)
+}
+
+// keysetCondition 游标条件, 多列主键用行比较: (a, b) > (1, 'x')
+func keysetCondition(drv svc.SourceDriver, keys []string, after []any) sqlExpr {
+	values := make([]string, len(after))
+	for n, v := range after {
+		values[n] = drv.Literal(v)
+	}
+	return func(col func(string) string) string {
+		cols := make([]string, len(keys))
+		for n, key := range keys {
+			cols[n] = col(key)
+		}
+		if len(keys) == 1 {
+			return fmt.Sprintf("%s > %s", cols[0], values[0])
+		}
+		return fmt.Sprintf("(%s) > (%s)", strings.Join(cols, ", "), strings.Join(values, ", "))
+	}
+}
+
+// lastKey 从本页最后一行取出游标值
+func (p *keysetPlan) lastKey(row map[string]any) ([]any, error) {
+	after := make([]any, len(p.Cols))
+	for n, col := range p.Cols {
+		v, ok := row[col]
+		if !ok {
+			return nil, fmt.Errorf("keyset key column %s must be selected", col)
+		}
+		after[n] = v
+	}
+	return after, nil
+}
+
+func encodeKey(key []any) string {
+	b, _ := json.Marshal(key)
+	return string(b)
+}
+
+func decodeKey(str string) ([]any, error) {
+	var key []any
+	dec := json.NewDecoder(bytes.NewReader([]byte(str)))
+	// 保持大整数精度
+	dec.UseNumber()
+	err := dec.Decode(&key)
+	return key, err
+}
+
+// execKeyset 逐页读取, 每页作为一个分段记录进度
+func (i *importerImplement) execKeyset(item *readSql) error {
+	plan := item.Keyset
+	after := plan.After
+	total := 0
+	for seq := plan.Seq; ; seq++ {
+		select {
+		case <-i.cfg.Ctx.Done():
+			return i.cfg.Ctx.Err()
+		default:
+		}
+		page := *item
+		page.Keyset = nil
+		page.ReadSql = plan.pageSql(item.ReadSql, after)
+		page.IsFirst = item.IsFirst && seq == plan.Seq
+		page.RangeStart = encodeKey(after)
+		page.chunk = &chunkState{TableName: item.TableName, Shard: item.Shard, Seq: seq, RangeStart: page.RangeStart, table: item.table}
+		item.table.add()
+		if len(item.Shard) > 0 {
+			page.chunk.shard = item.table.shard(item.Shard)
+			page.chunk.shard.chunks.Add(1)
+		}
+		i.addChunk(page.chunk)
+
+		start := time.Now()
+		lastRow, count, err := i.execChunk(&page)
+		if err == nil && count > 0 {
+			after, err = plan.lastKey(lastRow)
+		}
+		if err == nil && count > 0 {
+			page.chunk.RangeEnd = encodeKey(after)
+			i.saveChunkRange(page.chunk)
+		}
+		if err != nil {
+			// 当前页和之后的行都没有读取
+			countSql := item.ReadSql
+			if len(after) > 0 {
+				countSql = appendCondition(plan.Driver, countSql, keysetCondition(plan.Driver, plan.Keys, after))
+			}
+			i.countLost(page.chunk, &page, countSql)
+		}
+		i.chunkRead(page.chunk, err)
+		if err != nil {
+			return err
+		}
+		total += count
+		if i.cfg.Debug {
+			log.Printf("keyset %s page:%d rows:%d %s", checkpoint(item.TableName, item.Shard), seq, count, time.Since(start))
+		}
+		if count < plan.Size {
+			break
+		}
+		if i.cfg.SiteConf.EnabledImportLimit() && total >= i.cfg.SiteConf.ImportLimit {
+			break
+		}
+	}
+	log.Printf("keyset %s done, rows:%d", checkpoint(item.TableName, item.Shard), total)
+	return nil
+}
+
+// dispatchKeyset 提交顺序分页任务, 续传时从最后一个连续完成的分页之后继续
+func (i *importerImplement) dispatchKeyset(item *readSql) error {
+	plan := item.Keyset
+	// 全量导入写入临时表
+	item.table = newTableState(item.TableName, item.KeyCol, item.IsFirst)
+	item.table.Indexes = item.Indexes
+	i.tables.Store(item.TableName, item.table)
+	if i.cfg.Resume && i.localTableExists(item.writeTable()) {
+		seq, end, err := i.loadKeysetProgress(item.TableName)
+		if err != nil {
+			log.Println("load keyset progress error, full import", item.TableName, err)
+		} else if seq > 0 {
+			after, err := decodeKey(end)
+			if err == nil {
+				_, err = i.cfg.DbLocal.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", item.writeTable(), keysetCondition(svc.LocalDriver(), plan.Cols, after)(queryColumn)))
+			}
+			if err == nil {
+				log.Printf("resume keyset %s from page:%d after:%s", item.TableName, seq, end)
+				plan.After = after
+				plan.Seq = seq
+				item.IsFirst = false
+			} else {
+				log.Println("resume keyset error, full import", item.TableName, err)
+			}
+		}
+	}
+	if !item.IsFirst {
+		item.table.markReady()
+	}
+	_, err := i.cfg.DbLocal.Exec(fmt.Sprintf("DELETE FROM %s WHERE table_name = ? AND seq >= ?", chunkTable), item.TableName, plan.Seq)
+	if err != nil {
+		return fmt.Errorf("error at reset chunks:%v", err)
+	}
+	i.cfg.ChReadSql <- item
+	return nil
+}
+
+// loadKeysetProgress 返回连续完成的分页数和最后一页的游标
+func (i *importerImplement) loadKeysetProgress(tableName string) (int, string, error) {
+	rows, err := i.cfg.DbLocal.Query(fmt.Sprintf("SELECT seq, range_end, status FROM %s WHERE table_name = ? ORDER BY seq", chunkTable), tableName)
+	if err != nil {
+		return 0, "", err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	done, end := 0, ""
+	for rows.Next() {
+		var seq int
+		var rangeEnd, status string
+		if err = rows.Scan(&seq, &rangeEnd, &status); err != nil {
+			return 0, "", err
+		}
+		if seq != done || status != chunkDone || len(rangeEnd) == 0 {
+			break
+		}
+		done, end = seq+1, rangeEnd
+	}
+	return done, end, rows.Err()
+}
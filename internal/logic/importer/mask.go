@@ -0,0 +1,157 @@
+package importer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sqlsyncify/internal/config"
+	"strings"
+	"unicode"
+)
+
+// 脱敏方式
+const (
+	maskHash     = "hash"
+	maskNull     = "null"
+	maskFake     = "fake"
+	maskTruncate = "truncate"
+)
+
+// maskFunc 一列的脱敏, NULL保持为NULL
+type maskFunc func(v any) any
+
+// masker 站点的脱敏规则: 表名 => 小写列名 => 脱敏函数
+type masker map[string]map[string]maskFunc
+
+// newMasker 检查站点配置中的规则, 同一列有多条规则时后面的生效
+func newMasker(rules []config.MaskRule) (masker, error) {
+	m := make(masker)
+	for n, rule := range rules {
+		if len(rule.Table) == 0 || len(rule.Columns) == 0 {
+			return nil, fmt.Errorf("mask rule %d: table and columns are required", n)
+		}
+		if m[rule.Table] == nil {
+			m[rule.Table] = make(map[string]maskFunc)
+		}
+		for _, col := range rule.Columns {
+			f, err := newMaskFunc(rule, col)
+			if err != nil {
+				return nil, fmt.Errorf("mask rule %s.%s: %v", rule.Table, col, err)
+			}
+			m[rule.Table][strings.ToLower(col)] = f
+		}
+	}
+	return m, nil
+}
+
+func newMaskFunc(rule config.MaskRule, col string) (maskFunc, error) {
+	switch strings.ToLower(rule.Method) {
+	case maskNull:
+		return func(any) any {
+			return nil
+		}, nil
+	case maskHash:
+		return func(v any) any {
+			if v == nil {
+				return nil
+			}
+			sum := maskSum(rule.Salt, v)
+			return hex.EncodeToString(sum[:])
+		}, nil
+	case maskTruncate:
+		if rule.Length <= 0 {
+			return nil, fmt.Errorf("truncate length must be greater than 0")
+		}
+		return func(v any) any {
+			if v == nil {
+				return nil
+			}
+			s := []rune(fmt.Sprint(v))
+			if len(s) > rule.Length {
+				s = s[:rule.Length]
+			}
+			return string(s)
+		}, nil
+	case maskFake:
+		kind := strings.ToLower(rule.Fake)
+		if len(kind) == 0 {
+			kind = fakeKind(col)
+		}
+		switch kind {
+		case "email", "phone", "name", "address", "text":
+		default:
+			return nil, fmt.Errorf("unknown fake type: %s", rule.Fake)
+		}
+		return func(v any) any {
+			if v == nil {
+				return nil
+			}
+			return fakeValue(kind, col, rule.Salt, v)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown mask method: %s", rule.Method)
+}
+
+// columns 按结果集的列返回脱敏函数, 表没有规则时返回nil
+func (m masker) columns(tableName string, columns []string) []maskFunc {
+	rules := m[tableName]
+	if len(rules) == 0 {
+		return nil
+	}
+	ret := make([]maskFunc, len(columns))
+	for n, col := range columns {
+		ret[n] = rules[strings.ToLower(col)]
+	}
+	return ret
+}
+
+// masked 列是否有脱敏规则
+func (m masker) masked(tableName, column string) bool {
+	_, ok := m[tableName][strings.ToLower(column)]
+	return ok
+}
+
+func maskSum(salt string, v any) [32]byte {
+	return sha256.Sum256([]byte(salt + fmt.Sprint(v)))
+}
+
+// fakeKind 按列名判断假数据的类型
+func fakeKind(col string) string {
+	col = strings.ToLower(col)
+	switch {
+	case strings.Contains(col, "mail"):
+		return "email"
+	case strings.Contains(col, "phone"), strings.Contains(col, "mobile"), strings.Contains(col, "tel"):
+		return "phone"
+	case strings.Contains(col, "addr"):
+		return "address"
+	case strings.Contains(col, "name"):
+		return "name"
+	}
+	return "text"
+}
+
+// fakeValue 由原值的哈希生成假数据, 相同的值结果相同
+func fakeValue(kind, col, salt string, v any) string {
+	sum := maskSum(salt, v)
+	h := hex.EncodeToString(sum[:])
+	switch kind {
+	case "email":
+		return fmt.Sprintf("user_%s@example.com", h[:10])
+	case "phone":
+		// 保留长度和分隔符, 只替换数字
+		s := []rune(fmt.Sprint(v))
+		for n, r := range s {
+			if unicode.IsDigit(r) {
+				s[n] = rune('0' + sum[n%len(sum)]%10)
+			}
+		}
+		return string(s)
+	case "name":
+		return "User " + h[:6]
+	case "address":
+		return fmt.Sprintf("%d Example Street", binary.BigEndian.Uint16(sum[:2])%9999+1)
+	}
+	return col + "_" + h[:10]
+}
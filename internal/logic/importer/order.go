@@ -0,0 +1,110 @@
+package importer
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sqlsyncify/internal/svc"
+	"sqlsyncify/internal/utils"
+	"strconv"
+	"strings"
+)
+
+// importFile sql-import中的一个文件和它的依赖
+type importFile struct {
+	Path  string
+	Table string
+	// -- after=cates, post_meta 先导入完成的表
+	After []string
+	// -- priority=10 同一层中数值大的先导入, 默认0
+	Priority int
+}
+
+// loadImportFile 读取文件中的依赖和优先级, 数据文件没有指令
+func loadImportFile(file string, vars *svc.TemplateVars) (*importFile, error) {
+	f := &importFile{Path: file, Table: fileTableName(file)}
+	if isDataFile(file) {
+		return f, nil
+	}
+	sqlStr, err := vars.RenderFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error at load file:%v", err)
+	}
+	for _, after := range utils.SqlDirectives(sqlStr, "after") {
+		for _, dep := range strings.Split(after, ",") {
+			if dep = strings.TrimSpace(dep); len(dep) > 0 {
+				f.After = append(f.After, dep)
+			}
+		}
+	}
+	if priority := utils.SqlDirective(sqlStr, "priority"); len(priority) > 0 {
+		if f.Priority, err = strconv.Atoi(priority); err != nil {
+			return nil, fmt.Errorf("invalid priority: %s", priority)
+		}
+	}
+	return f, nil
+}
+
+// planImportFiles 按依赖分层, 同一层按优先级和文件名排序
+// 循环依赖的文件不导入, 和错误一起返回
+func planImportFiles(files []*importFile) ([][]*importFile, []*importFile, error) {
+	// 同名的数据文件和sql文件导入同一张表
+	byTable := make(map[string][]*importFile)
+	var tables []string
+	deps := make(map[string][]string)
+	for _, f := range files {
+		if _, ok := byTable[f.Table]; !ok {
+			tables = append(tables, f.Table)
+		}
+		byTable[f.Table] = append(byTable[f.Table], f)
+		deps[f.Table] = append(deps[f.Table], f.After...)
+	}
+	for _, f := range files {
+		for _, dep := range f.After {
+			if _, ok := byTable[dep]; !ok {
+				log.Printf("%s: dependency %s is not in sql-import, ignored", f.Path, dep)
+			}
+		}
+	}
+	tableLevels, err := utils.DependencyLevels(tables, deps)
+	var levels [][]*importFile
+	planned := make(map[string]bool, len(tables))
+	for _, group := range tableLevels {
+		var level []*importFile
+		for _, table := range group {
+			planned[table] = true
+			level = append(level, byTable[table]...)
+		}
+		sort.SliceStable(level, func(a, b int) bool {
+			if level[a].Priority != level[b].Priority {
+				return level[a].Priority > level[b].Priority
+			}
+			return level[a].Path < level[b].Path
+		})
+		levels = append(levels, level)
+	}
+	var blocked []*importFile
+	for _, f := range files {
+		if !planned[f.Table] {
+			blocked = append(blocked, f)
+		}
+	}
+	return levels, blocked, err
+}
+
+// waitDependencies 等待依赖的表导入完成, 依赖失败时返回错误
+func (i *importerImplement) waitDependencies(f *importFile) error {
+	for _, dep := range f.After {
+		if value, ok := i.tables.Load(dep); ok {
+			select {
+			case <-value.(*tableState).done:
+			case <-i.cfg.Ctx.Done():
+				return i.cfg.Ctx.Err()
+			}
+		}
+		if err, failed := i.failedTables.Load(dep); failed {
+			return fmt.Errorf("dependency %s failed: %v", dep, err)
+		}
+	}
+	return nil
+}
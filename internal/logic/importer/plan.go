@@ -0,0 +1,187 @@
+package importer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sqlsyncify/internal/svc"
+	"sqlsyncify/internal/utils"
+	"strings"
+	"time"
+)
+
+// Plan 导入计划: 每个文件的数据源、分段和将要执行的SQL, 不建本地表, 不拉取数据
+type Plan struct {
+	Site     string        `json:"site"`
+	Duration time.Duration `json:"duration"`
+	Files    []*FilePlan   `json:"files"`
+}
+
+// FilePlan sql-import中一个文件的导入计划
+type FilePlan struct {
+	File  string `json:"file"`
+	Table string `json:"table"`
+	// 依赖层级, 从0开始
+	Level    int      `json:"level"`
+	After    []string `json:"after,omitempty"`
+	Priority int      `json:"priority"`
+	// 数据源名称和引擎, 分片导入时为逗号分隔的多个数据源, 数据文件为文件路径
+	DataSource string `json:"dataSource"`
+	Driver     string `json:"driver"`
+	Key        string `json:"key"`
+	// range, keyset, file; 分片导入时可能为 range+keyset
+	ChunkMode   string `json:"chunkMode"`
+	Incremental string `json:"incremental,omitempty"`
+	// 上次导入的水位, 为空时全量导入
+	Watermark string `json:"watermark,omitempty"`
+	MinKey    string `json:"minKey,omitempty"`
+	MaxKey    string `json:"maxKey,omitempty"`
+	// 分段数, keyset按估算行数计算, 不能估算时为-1
+	Chunks int `json:"chunks"`
+	// EXPLAIN估算的行数, 引擎不支持时为-1
+	EstimatedRows int64 `json:"estimatedRows"`
+	// 渲染模板后的查询
+	Sql string `json:"sql"`
+	// 每个分段执行的SQL, keyset只有第一页
+	Sqls  []string `json:"sqls"`
+	Error string   `json:"error,omitempty"`
+}
+
+// Err 出错的文件, 全部可以导入时返回nil
+func (p *Plan) Err() error {
+	for _, f := range p.Files {
+		if len(f.Error) > 0 {
+			return fmt.Errorf("plan %s: %s", f.File, f.Error)
+		}
+	}
+	return nil
+}
+
+func (i *importerImplement) Plan() (*Plan, error) {
+	start := time.Now()
+	defer i.putSources()
+	dirPath := fmt.Sprintf("./etc/sites/%s/sql-import/", i.cfg.Site)
+	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("[Import] site:%s does not found", i.cfg.Site)
+	} else if err != nil {
+		return nil, err
+	}
+	sqlFiles, err := utils.ScanDir(dirPath, append([]string{".sql"}, dataFileExts...)...)
+	if err != nil {
+		return nil, err
+	}
+	i.masks, err = newMasker(i.cfg.SiteConf.Masks)
+	if err != nil {
+		return nil, fmt.Errorf("error at mask rules:%v", err)
+	}
+	plan := &Plan{Site: i.cfg.Site}
+	i.planFiles = make(map[string]*FilePlan)
+	defer func() {
+		i.planFiles = nil
+	}()
+
+	var files []*importFile
+	for _, file := range sqlFiles {
+		f, err := loadImportFile(file, i.cfg.TplVars)
+		if err != nil {
+			plan.Files = append(plan.Files, &FilePlan{File: filepath.Base(file), Table: fileTableName(file), Error: err.Error()})
+			continue
+		}
+		files = append(files, f)
+	}
+	levels, blocked, err := planImportFiles(files)
+	for _, f := range blocked {
+		plan.Files = append(plan.Files, &FilePlan{File: filepath.Base(f.Path), Table: f.Table, After: f.After, Priority: f.Priority, Error: err.Error()})
+	}
+	for n, level := range levels {
+		for _, f := range level {
+			fp := &FilePlan{File: filepath.Base(f.Path), Table: f.Table, Level: n, After: f.After, Priority: f.Priority, EstimatedRows: -1}
+			plan.Files = append(plan.Files, fp)
+			i.planFiles[f.Table] = fp
+			if isDataFile(f.Path) {
+				err = i.loadDataFromFile(f.Table, &readSql{File: &dataFile{Path: f.Path}})
+			} else {
+				err = i.loadDataFromSqlFile(f.Path)
+			}
+			if err != nil {
+				fp.Error = err.Error()
+			}
+		}
+	}
+	plan.Duration = time.Since(start)
+	return plan, nil
+}
+
+// filePlan 生成计划时返回表的计划, 导入时为nil
+func (i *importerImplement) filePlan(tableName string) *FilePlan {
+	if i.planFiles == nil {
+		return nil
+	}
+	return i.planFiles[tableName]
+}
+
+// planSources 记录每个数据源的分段SQL, 游标分页只记录第一页
+// 估算行数为各数据源之和, 有一个数据源不能估算时为-1; 游标分页的分页数按估算行数计算
+func (i *importerImplement) planSources(fp *FilePlan, bases, chunks, keysets []*readSql) {
+	var modes []string
+	if len(chunks) > 0 {
+		modes = append(modes, chunkModeRange)
+	}
+	if len(keysets) > 0 {
+		modes = append(modes, chunkModeKeyset)
+	}
+	fp.ChunkMode = strings.Join(modes, "+")
+	fp.Chunks = len(chunks)
+	for _, item := range chunks {
+		fp.Sqls = append(fp.Sqls, i.limitSql(item.Source, item.ReadSql))
+	}
+	keysetPlans := make(map[*svc.DataSource]*keysetPlan, len(keysets))
+	for _, item := range keysets {
+		keysetPlans[item.Source] = item.Keyset
+		fp.Sqls = append(fp.Sqls, i.limitSql(item.Source, item.Keyset.pageSql(item.ReadSql, nil)))
+	}
+	fp.EstimatedRows = 0
+	for _, base := range bases {
+		n := i.estimateRows(base.Source, base.SetSqls, base.ReadSql)
+		if plan, ok := keysetPlans[base.Source]; ok {
+			if n >= 0 && fp.Chunks >= 0 {
+				fp.Chunks += max(1, int((n+int64(plan.Size)-1)/int64(plan.Size)))
+			} else {
+				fp.Chunks = -1
+			}
+		}
+		if n >= 0 && fp.EstimatedRows >= 0 {
+			fp.EstimatedRows += n
+		} else {
+			fp.EstimatedRows = -1
+		}
+	}
+}
+
+// planFile 数据文件不查询数据源
+func planFile(fp *FilePlan, item *readSql) {
+	fp.ChunkMode = "file"
+	fp.DataSource = item.File.Path
+	fp.Chunks = 1
+}
+
+// estimateRows 用EXPLAIN估算查询的行数, 引擎不支持或出错时返回-1
+func (i *importerImplement) estimateRows(ds *svc.DataSource, setSqls []string, sqlStr string) int64 {
+	explainSql, ok := svc.ExplainSql(ds.Driver, i.limitSql(ds, sqlStr))
+	if !ok {
+		return -1
+	}
+	rows, release, err := i.getRowsFromDb(ds, setSqls, explainSql)
+	if err != nil {
+		log.Println("explain error:", err)
+		return -1
+	}
+	defer release()
+	n, err := svc.EstimateRows(ds.Driver, rows)
+	if err != nil {
+		log.Println("explain error:", err)
+		return -1
+	}
+	return n
+}
@@ -0,0 +1,125 @@
+package importer
+
+import (
+	"log"
+	"sort"
+)
+
+// TableReconciliation 本次导入数据源行数和写入本地db行数的核对
+type TableReconciliation struct {
+	Table string `json:"table"`
+	// 分片的数据源名称, 分片导入时每个分片另有一条核对
+	Shard        string `json:"shard,omitempty"`
+	Chunks       int64  `json:"chunks"`
+	FailedChunks int64  `json:"failedChunks"`
+	// 数据源行数: 读取成功的行数, 加上读取失败的分段在数据源中的行数
+	SourceRows int64 `json:"sourceRows"`
+	LocalRows  int64 `json:"localRows"`
+	Missing    int64 `json:"missing"`
+	// 读取失败且无法统计数据源行数
+	Unknown bool `json:"unknown,omitempty"`
+}
+
+// MismatchRate 丢失行数占数据源行数的比例
+func (r *TableReconciliation) MismatchRate() float64 {
+	if r.Unknown {
+		return 1
+	}
+	if r.Missing <= 0 {
+		return 0
+	}
+	if r.SourceRows == 0 {
+		return 1
+	}
+	return float64(r.Missing) / float64(r.SourceRows)
+}
+
+// read 分段读取到一行
+func (c *chunkState) read() {
+	c.pending.Add(1)
+	c.rows.Add(1)
+	for _, rc := range c.counters() {
+		rc.readRows.Add(1)
+	}
+}
+
+// countLost 分段读取失败, 统计数据源中未读取的行数
+func (i *importerImplement) countLost(c *chunkState, item *readSql, sqlStr string) {
+	if c == nil || c.table == nil {
+		return
+	}
+	if item.File != nil || item.Source == nil {
+		for _, rc := range c.counters() {
+			rc.unknown.Store(true)
+		}
+		return
+	}
+	n, err := i.countSourceRows(item, sqlStr)
+	if err != nil {
+		for _, rc := range c.counters() {
+			rc.unknown.Store(true)
+		}
+		log.Println("count source rows error:", item.TableName, err)
+		return
+	}
+	if lost := n - c.rows.Load(); lost > 0 {
+		for _, rc := range c.counters() {
+			rc.lostRows.Add(lost)
+		}
+	}
+}
+
+// countSourceRows 查询数据源中的行数
+// 在分段查询的结果上计数, 保留GROUP BY/HAVING/DISTINCT, 与分段读取的行数一致
+func (i *importerImplement) countSourceRows(item *readSql, sqlStr string) (int64, error) {
+	countSql := subquery(i.limitSql(item.Source, sqlStr), "COUNT(*)")
+	rows, release, err := i.getRowsFromDb(item.Source, item.SetSqls, countSql)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	var n int64
+	if rows.Next() {
+		if err = rows.Scan(&n); err != nil {
+			return 0, err
+		}
+	}
+	return n, rows.Err()
+}
+
+// reconcile 核对每张表的行数, 按表名和分片排序
+func (i *importerImplement) reconcile() []*TableReconciliation {
+	var ret []*TableReconciliation
+	i.tables.Range(func(_, value any) bool {
+		t := value.(*tableState)
+		ret = append(ret, newReconciliation(t.Name, "", &t.rowCounters))
+		t.shards.Range(func(key, value any) bool {
+			ret = append(ret, newReconciliation(t.Name, key.(string), value.(*rowCounters)))
+			return true
+		})
+		return true
+	})
+	sort.Slice(ret, func(a, b int) bool {
+		if ret[a].Table != ret[b].Table {
+			return ret[a].Table < ret[b].Table
+		}
+		return ret[a].Shard < ret[b].Shard
+	})
+	return ret
+}
+
+func newReconciliation(tableName, shard string, rc *rowCounters) *TableReconciliation {
+	r := &TableReconciliation{
+		Table:        tableName,
+		Shard:        shard,
+		Chunks:       rc.chunks.Load(),
+		FailedChunks: rc.failedChunks.Load(),
+		SourceRows:   rc.readRows.Load() + rc.lostRows.Load(),
+		LocalRows:    rc.writtenRows.Load(),
+		Unknown:      rc.unknown.Load(),
+	}
+	r.Missing = r.SourceRows - r.LocalRows
+	log.Printf("reconcile %s: chunks:%d failed:%d source:%d local:%d missing:%d unknown:%v",
+		checkpoint(r.Table, r.Shard), r.Chunks, r.FailedChunks, r.SourceRows, r.LocalRows, r.Missing, r.Unknown)
+	return r
+}
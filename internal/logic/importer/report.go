@@ -0,0 +1,135 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 每个文件最多保留的错误数
+const reportMaxErrors = 10
+
+// Report 一次导入的结果
+type Report struct {
+	Site     string                 `json:"site"`
+	Start    time.Time              `json:"start"`
+	Duration time.Duration          `json:"duration"`
+	Files    []*FileReport          `json:"files"`
+	Tables   []*TableReconciliation `json:"tables"`
+	// 行数核对允许的差异比例
+	MaxMismatchRate float64     `json:"maxMismatchRate"`
+	Writer          WriterStats `json:"writer"`
+}
+
+// FileReport sql-import中一个文件的导入结果
+type FileReport struct {
+	File            string        `json:"file"`
+	Table           string        `json:"table"`
+	ChunksPlanned   int64         `json:"chunksPlanned"`
+	ChunksSucceeded int64         `json:"chunksSucceeded"`
+	ChunksFailed    int64         `json:"chunksFailed"`
+	RowsRead        int64         `json:"rowsRead"`
+	RowsWritten     int64         `json:"rowsWritten"`
+	Duration        time.Duration `json:"duration"`
+	// 前reportMaxErrors个错误, ErrorCount为错误总数
+	Errors     []string `json:"errors,omitempty"`
+	ErrorCount int      `json:"errorCount"`
+
+	start time.Time
+	mu    sync.Mutex
+}
+
+// Failed 文件出错或有分段失败
+func (f *FileReport) Failed() bool {
+	return f.ErrorCount > 0 || f.ChunksFailed > 0
+}
+
+func (f *FileReport) addError(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ErrorCount++
+	if len(f.Errors) < reportMaxErrors {
+		f.Errors = append(f.Errors, err.Error())
+	}
+}
+
+// Err 导入失败的文件和行数核对超出差异比例的表, 全部成功时返回nil
+func (r *Report) Err() error {
+	var errs []error
+	for _, f := range r.Files {
+		if f.Failed() {
+			msg := fmt.Sprintf("%d chunks failed", f.ChunksFailed)
+			if len(f.Errors) > 0 {
+				msg = f.Errors[0]
+			}
+			errs = append(errs, fmt.Errorf("import %s failed: %s", f.File, msg))
+		}
+	}
+	var mismatched []string
+	for _, t := range r.Tables {
+		if t.MismatchRate() > r.MaxMismatchRate {
+			mismatched = append(mismatched, fmt.Sprintf("%s(%d/%d)", checkpoint(t.Table, t.Shard), t.Missing, t.SourceRows))
+		}
+	}
+	if len(mismatched) > 0 {
+		errs = append(errs, fmt.Errorf("import rows mismatch, max rate %g: %s", r.MaxMismatchRate, strings.Join(mismatched, ", ")))
+	}
+	return errors.Join(errs...)
+}
+
+// Success 全部文件导入成功且行数核对通过
+func (r *Report) Success() bool {
+	return r.Err() == nil
+}
+
+// fileReport 开始导入一个文件
+func (i *importerImplement) fileReport(file string) *FileReport {
+	f := &FileReport{File: file, Table: fileTableName(file), start: time.Now()}
+	i.files = append(i.files, f)
+	i.fileReports.Store(f.Table, f)
+	return f
+}
+
+// tableError 记录表的错误, 出错的表不保存水位
+func (i *importerImplement) tableError(tableName string, err error) {
+	i.failedTables.Store(tableName, err)
+	if f, ok := i.fileReports.Load(tableName); ok {
+		f.(*FileReport).addError(err)
+	}
+}
+
+// report 汇总每个文件的分段和行数
+func (i *importerImplement) report(start time.Time) *Report {
+	r := &Report{
+		Site:            i.cfg.Site,
+		Start:           start,
+		Duration:        time.Since(start),
+		Files:           i.files,
+		Tables:          i.reconcile(),
+		MaxMismatchRate: i.cfg.SiteConf.MaxMismatchRate,
+		Writer:          i.writeStats,
+	}
+	for _, f := range r.Files {
+		f.Duration = time.Since(f.start)
+		value, ok := i.tables.Load(f.Table)
+		if !ok {
+			continue
+		}
+		t := value.(*tableState)
+		f.ChunksPlanned = t.chunks.Load()
+		f.ChunksFailed = t.failedChunks.Load()
+		f.ChunksSucceeded = t.doneChunks.Load()
+		f.RowsRead = t.readRows.Load()
+		f.RowsWritten = t.writtenRows.Load()
+		if !t.finished.IsZero() {
+			f.Duration = t.finished.Sub(f.start)
+		}
+	}
+	sort.Slice(r.Files, func(a, b int) bool {
+		return r.Files[a].File < r.Files[b].File
+	})
+	return r
+}
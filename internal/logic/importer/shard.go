@@ -0,0 +1,113 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sqlsyncify/internal/svc"
+	"strings"
+)
+
+// 分片导入时本地表增加的列, 值为数据源名称
+const shardColumn = "_shard"
+
+// sourceShards 解析 -- ds=, 可以是数据源、逗号分隔的多个数据源或 etc/datasources/groups 中的数据源组
+// 多个数据源或数据源组时按分片导入, 同一张本地表增加 _shard 列
+func (i *importerImplement) sourceShards(directive string) ([]*svc.DataSource, bool, error) {
+	if len(strings.TrimSpace(directive)) == 0 {
+		return []*svc.DataSource{i.cfg.Db}, false, nil
+	}
+	var names []string
+	sharded := false
+	for _, name := range strings.Split(directive, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		group, err := svc.LoadDataSourceGroup(name)
+		if err == nil {
+			sharded = true
+			names = append(names, group...)
+		} else if errors.Is(err, os.ErrNotExist) {
+			names = append(names, name)
+		} else {
+			return nil, false, fmt.Errorf("datasource group %s: %v", name, err)
+		}
+	}
+	var sources []*svc.DataSource
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		ds, err := i.dataSource(name)
+		if err != nil {
+			return nil, false, err
+		}
+		sources = append(sources, ds)
+	}
+	if len(sources) == 0 {
+		return []*svc.DataSource{i.cfg.Db}, false, nil
+	}
+	return sources, sharded || len(sources) > 1, nil
+}
+
+// checkpoint 分段进度和水位的记录名, 分片为 表名@数据源
+func checkpoint(tableName, shard string) string {
+	if len(shard) == 0 {
+		return tableName
+	}
+	return tableName + "@" + shard
+}
+
+// dispatchShards 各分片的分段写入同一张表, 只有第一个分段建表
+// 分片的表不续传, 重新全部导入
+func (i *importerImplement) dispatchShards(tableName string, chunks []*readSql, keysets []*readSql) error {
+	items := append(append([]*readSql{}, keysets...), chunks...)
+	if len(items) == 0 {
+		return nil
+	}
+	if i.cfg.Resume {
+		log.Printf("resume is not supported for sharded table %s, full import", tableName)
+	}
+	first := items[0]
+	table := newTableState(tableName, first.KeyCol, first.IsFirst)
+	table.Indexes = first.Indexes
+	i.tables.Store(tableName, table)
+	// 分段进度按分片记录
+	byShard := make(map[string][]*readSql)
+	var shards []string
+	for n, item := range items {
+		item.table = table
+		item.IsFirst = item.IsFirst && n == 0
+		if _, ok := byShard[item.Shard]; !ok {
+			shards = append(shards, item.Shard)
+			byShard[item.Shard] = nil
+		}
+		// 游标分页的分段在读取时逐页记录
+		if item.Keyset == nil {
+			item.chunk = &chunkState{TableName: tableName, Shard: item.Shard, Seq: len(byShard[item.Shard]), RangeStart: item.RangeStart, RangeEnd: item.RangeEnd, table: table, shard: table.shard(item.Shard)}
+			byShard[item.Shard] = append(byShard[item.Shard], item)
+		}
+	}
+	for _, shard := range shards {
+		if err := i.resetChunks(checkpoint(tableName, shard), byShard[shard], byShard[shard]); err != nil {
+			return fmt.Errorf("error at reset chunks:%v", err)
+		}
+		table.shard(shard).chunks.Add(int64(len(byShard[shard])))
+	}
+	log.Printf("%s shards: %d, chunks: %d, keyset: %d", tableName, len(shards), len(chunks), len(keysets))
+	table.pending.Add(int64(len(items)))
+	table.chunks.Add(int64(len(chunks)))
+	if !first.IsFirst {
+		table.markReady()
+	}
+	for _, item := range items {
+		i.cfg.ChReadSql <- item
+	}
+	// 全部分段已提交
+	i.tableDone(table, false)
+	return nil
+}
@@ -0,0 +1,176 @@
+package importer
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 全量导入先写入临时表, 全部分段成功后替换正式表, 失败时保留上次完整的数据
+const stagingSuffix = "__staging"
+
+func stagingTable(tableName string) string {
+	return tableName + stagingSuffix
+}
+
+// logicalTable 临时表对应的正式表名
+func logicalTable(tableName string) string {
+	return strings.TrimSuffix(tableName, stagingSuffix)
+}
+
+// tableState 一张表全部分段的进度
+type tableState struct {
+	Name string
+	// 增量导入的唯一索引列, 替换后在正式表上建索引
+	KeyCol  string
+	Staging bool
+	// 导入完成后创建的索引
+	Indexes []localIndex
+	// 未结束的分段数, 另加1表示分段还在提交中
+	pending atomic.Int64
+	failed  atomic.Bool
+	once    sync.Once
+	// 行数核对
+	rowCounters
+	// 分片的行数核对: 数据源名称 => *rowCounters
+	shards sync.Map
+	// 全部分段结束的时间
+	finished time.Time
+	// 第一个分段建表后关闭, 其他分段等建表后再写入
+	ready     chan struct{}
+	readyOnce sync.Once
+	// 全部分段结束, 替换正式表和建索引后关闭, 依赖这张表的文件等待后再导入
+	done chan struct{}
+}
+
+// rowCounters 表或分片的分段数和行数
+type rowCounters struct {
+	chunks       atomic.Int64
+	failedChunks atomic.Int64
+	readRows     atomic.Int64
+	lostRows     atomic.Int64
+	writtenRows  atomic.Int64
+	unknown      atomic.Bool
+	doneChunks   atomic.Int64
+}
+
+// shard 分片的计数, 第一次使用时创建
+func (t *tableState) shard(name string) *rowCounters {
+	value, _ := t.shards.LoadOrStore(name, &rowCounters{})
+	return value.(*rowCounters)
+}
+
+func newTableState(tableName, keyCol string, staging bool) *tableState {
+	t := &tableState{Name: tableName, KeyCol: keyCol, Staging: staging, ready: make(chan struct{}), done: make(chan struct{})}
+	t.pending.Store(1)
+	return t
+}
+
+func (t *tableState) markReady() {
+	if t != nil {
+		t.readyOnce.Do(func() {
+			close(t.ready)
+		})
+	}
+}
+
+// waitReady 等待第一个分段建表
+func (i *importerImplement) waitReady(item *readSql) error {
+	if item.IsFirst || item.table == nil {
+		return nil
+	}
+	select {
+	case <-item.table.ready:
+		return nil
+	case <-i.cfg.Ctx.Done():
+		return i.cfg.Ctx.Err()
+	}
+}
+
+// writeTable 实际写入的本地表
+func (r *readSql) writeTable() string {
+	if r.table != nil && r.table.Staging {
+		return stagingTable(r.TableName)
+	}
+	return r.TableName
+}
+
+func (r *readSql) staging() bool {
+	return r.table != nil && r.table.Staging
+}
+
+// add 表新增一个分段
+func (t *tableState) add() {
+	if t != nil {
+		t.pending.Add(1)
+		t.chunks.Add(1)
+	}
+}
+
+// tableDone 一个分段结束, 或分段全部提交完成; 全部结束且没有失败时替换正式表并建索引
+func (i *importerImplement) tableDone(t *tableState, failed bool) {
+	if t == nil {
+		return
+	}
+	if failed {
+		t.failed.Store(true)
+	}
+	if t.pending.Add(-1) != 0 {
+		return
+	}
+	t.once.Do(func() {
+		defer close(t.done)
+		t.finished = time.Now()
+		if t.failed.Load() {
+			if t.Staging {
+				log.Printf("import %s failed, keep the previous table, staging: %s", t.Name, stagingTable(t.Name))
+			}
+			return
+		}
+		if t.Staging {
+			if err := i.swapStaging(t); err != nil {
+				i.tableError(t.Name, err)
+				log.Printf("swap staging table %s error: %v", t.Name, err)
+				return
+			}
+			log.Printf("swap staging table: %s", t.Name)
+		}
+		if err := i.createIndexes(t); err != nil {
+			i.tableError(t.Name, err)
+			log.Printf("create indexes on %s error: %v", t.Name, err)
+		}
+	})
+}
+
+// swapStaging 在一个事务中删除正式表, 把临时表改名为正式表
+func (i *importerImplement) swapStaging(t *tableState) error {
+	staging := stagingTable(t.Name)
+	if !i.localTableExists(staging) {
+		// 续传时已经替换过
+		return nil
+	}
+	tx, err := i.cfg.DbLocal.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	stmts := []string{
+		fmt.Sprintf("DROP TABLE IF EXISTS %s", t.Name),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", staging, t.Name),
+	}
+	// 增量导入按主键覆盖, 需要唯一索引
+	if len(t.KeyCol) > 0 {
+		stmts = append(stmts, fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS ux_%s_key ON %s (%s)", t.Name, t.Name, t.KeyCol))
+	}
+	for _, stmt := range stmts {
+		if _, err = tx.Exec(stmt); err != nil {
+			return fmt.Errorf("%s: %v", stmt, err)
+		}
+	}
+	return tx.Commit()
+}
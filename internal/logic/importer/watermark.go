@@ -0,0 +1,68 @@
+package importer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// 增量导入水位表, 保存在站点本地db中
+const watermarkTable = "_sqlsyncify_watermark"
+
+type watermark struct {
+	TableName string
+	// 分片导入时每个分片各有水位
+	Shard  string
+	Column string
+	Value  string
+}
+
+// key 水位表中的记录名
+func (w *watermark) key() string {
+	return checkpoint(w.TableName, w.Shard)
+}
+
+func (i *importerImplement) initWatermarkTable() error {
+	_, err := i.cfg.DbLocal.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		table_name TEXT PRIMARY KEY,
+		watermark_col TEXT NOT NULL,
+		watermark TEXT NOT NULL,
+		updated_at TEXT NOT NULL
+	)`, watermarkTable))
+	return err
+}
+
+// getWatermark 读取上次导入的水位, 字段变化或本地表不存在时视为没有水位
+func (i *importerImplement) getWatermark(tableName, shard, column string) (string, bool) {
+	var col, val string
+	row := i.cfg.DbLocal.QueryRow(fmt.Sprintf("SELECT watermark_col, watermark FROM %s WHERE table_name = ?", watermarkTable), checkpoint(tableName, shard))
+	err := row.Scan(&col, &val)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false
+	} else if err != nil {
+		log.Println("read watermark error:", tableName, err)
+		return "", false
+	}
+	if col != column {
+		log.Printf("watermark column changed: %s -> %s, full import %s", col, column, tableName)
+		return "", false
+	}
+	if !i.localTableExists(tableName) {
+		return "", false
+	}
+	return val, true
+}
+
+func (i *importerImplement) saveWatermark(w *watermark) error {
+	_, err := i.cfg.DbLocal.Exec(fmt.Sprintf(`INSERT OR REPLACE INTO %s (table_name, watermark_col, watermark, updated_at) VALUES (?, ?, ?, ?)`, watermarkTable),
+		w.key(), w.Column, w.Value, time.Now().Format(time.DateTime))
+	return err
+}
+
+func (i *importerImplement) localTableExists(tableName string) bool {
+	var name string
+	err := i.cfg.DbLocal.QueryRow("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", tableName).Scan(&name)
+	return err == nil
+}
@@ -0,0 +1,275 @@
+package importer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"sqlsyncify/internal/svc"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// SQLite单条语句的变量数上限, 3.32.0起默认32766
+	sqliteMaxVariables = 32766
+	// 单条INSERT的最大行数
+	maxBatchRows = 500
+	// 写事务最长持续时间和最大行数, 到达后提交, 避免长时间占用写锁
+	commitInterval = 500 * time.Millisecond
+	commitRows     = 50000
+	// 写锁冲突时的重试次数
+	busyRetries = 20
+)
+
+// batchSize 按列数计算单条INSERT的行数, 不超过SQLite的变量数上限
+func batchSize(cols int) int {
+	if cols <= 0 {
+		return maxBatchRows
+	}
+	return max(1, min(maxBatchRows, sqliteMaxVariables/cols))
+}
+
+// WriterStats 写入本地db的吞吐和锁冲突
+type WriterStats struct {
+	Rows         int64 `json:"rows"`
+	FailedRows   int64 `json:"failedRows"`
+	Statements   int64 `json:"statements"`
+	Transactions int64 `json:"transactions"`
+	// 写锁冲突的重试次数和等待时间, 包括开始事务的时间
+	BusyRetries int64         `json:"busyRetries"`
+	LockWait    time.Duration `json:"lockWait"`
+	// 写入协程运行的时间
+	Elapsed       time.Duration `json:"elapsed"`
+	RowsPerSecond float64       `json:"rowsPerSecond"`
+}
+
+// writtenChunks 已执行的行, 事务提交后才更新分段进度
+type writtenChunks struct {
+	chunks []*chunkState
+	err    error
+}
+
+// localWriter 每个本地db只有一个写入协程, 在事务中用缓存的预编译语句批量写入
+type localWriter struct {
+	i       *importerImplement
+	db      *sql.DB
+	tx      *sql.Tx
+	txRows  int
+	stmts   map[string]*sql.Stmt
+	buf     map[string]*rowsBatch
+	written []writtenChunks
+	stats   WriterStats
+}
+
+func newLocalWriter(i *importerImplement, db *sql.DB) *localWriter {
+	return &localWriter{i: i, db: db, stmts: make(map[string]*sql.Stmt), buf: make(map[string]*rowsBatch)}
+}
+
+// run 写入通道中的行, 通道关闭后提交并返回
+func (w *localWriter) run(ch <-chan *rowBatch) {
+	start := time.Now()
+	ticker := time.NewTicker(commitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case item, ok := <-ch:
+			if !ok {
+				w.commit()
+				w.close()
+				w.stats.Elapsed = time.Since(start)
+				if secs := w.stats.Elapsed.Seconds(); secs > 0 {
+					w.stats.RowsPerSecond = float64(w.stats.Rows) / secs
+				}
+				log.Printf("[writer] rows:%d failed:%d statements:%d transactions:%d busy:%d lockWait:%s elapsed:%s rows/s:%.0f",
+					w.stats.Rows, w.stats.FailedRows, w.stats.Statements, w.stats.Transactions,
+					w.stats.BusyRetries, w.stats.LockWait, w.stats.Elapsed, w.stats.RowsPerSecond)
+				return
+			}
+			w.add(item)
+		case <-ticker.C:
+			w.commit()
+		}
+	}
+}
+
+func (w *localWriter) add(item *rowBatch) {
+	obj, ok := w.buf[item.TableName]
+	if !ok {
+		obj = &rowsBatch{TableName: item.TableName, Cols: item.Cols, Upsert: item.Upsert}
+		w.buf[item.TableName] = obj
+	}
+	obj.Items = append(obj.Items, item.Item)
+	obj.Chunks = append(obj.Chunks, item.chunk)
+	if len(obj.Items) >= batchSize(len(obj.Cols)) {
+		w.flush(obj, len(obj.Items))
+	}
+	if w.txRows >= commitRows {
+		w.commit()
+	}
+}
+
+// flush 在当前事务中写入缓存的行, 每条语句最多写入n行
+// 不足n行的剩余部分按2的幂拆成几条多行INSERT, 预编译语句的行数种类有限
+func (w *localWriter) flush(rows *rowsBatch, n int) {
+	if len(rows.Items) == 0 {
+		return
+	}
+	err := w.begin()
+	for start, end := 0, 0; start < len(rows.Items); start = end {
+		size := n
+		if rest := len(rows.Items) - start; rest < n {
+			size = 1 << (bits.Len(uint(rest)) - 1)
+		}
+		end = start + size
+		execErr := err
+		if execErr == nil {
+			execErr = w.insert(rows, rows.Items[start:end])
+		}
+		if execErr != nil {
+			w.stats.FailedRows += int64(end - start)
+			w.i.tableError(logicalTable(rows.TableName), execErr)
+			log.Printf("error executing batch insert %s: %v", rows.TableName, execErr)
+		}
+		w.written = append(w.written, writtenChunks{chunks: rows.Chunks[start:end], err: execErr})
+		w.txRows += end - start
+	}
+	rows.Items = nil
+	rows.Chunks = nil
+}
+
+// insert 用缓存的预编译语句写入多行
+func (w *localWriter) insert(rows *rowsBatch, items []map[string]any) error {
+	stmt, err := w.stmt(rows, len(items))
+	if err != nil {
+		return err
+	}
+	args := make([]any, 0, len(items)*len(rows.Cols))
+	for _, row := range items {
+		for _, col := range rows.Cols {
+			args = append(args, row[col])
+		}
+	}
+	txStmt := w.tx.Stmt(stmt)
+	defer func() {
+		_ = txStmt.Close()
+	}()
+	err = w.retry(func() error {
+		_, err := txStmt.Exec(args...)
+		return err
+	})
+	if err == nil {
+		w.stats.Statements++
+		w.stats.Rows += int64(len(items))
+	}
+	return err
+}
+
+// stmt 按表、列和行数缓存预编译的INSERT, 增量导入时按唯一索引覆盖
+func (w *localWriter) stmt(rows *rowsBatch, n int) (*sql.Stmt, error) {
+	key := fmt.Sprintf("%s|%s|%v|%d", rows.TableName, strings.Join(rows.Cols, ","), rows.Upsert, n)
+	if stmt, ok := w.stmts[key]; ok {
+		return stmt, nil
+	}
+	insert := "INSERT"
+	if rows.Upsert {
+		insert = "INSERT OR REPLACE"
+	}
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?,", len(rows.Cols)), ",") + ")"
+	values := strings.TrimSuffix(strings.Repeat(placeholders+",", n), ",")
+	cols := make([]string, len(rows.Cols))
+	for n, col := range rows.Cols {
+		cols[n] = svc.LocalDriver().Quote(col)
+	}
+	insertSql := fmt.Sprintf("%s INTO %s (%s) VALUES %s", insert, rows.TableName, strings.Join(cols, ", "), values)
+	stmt, err := w.db.Prepare(insertSql)
+	if err != nil {
+		return nil, fmt.Errorf("error preparing statement: %v", err)
+	}
+	w.stmts[key] = stmt
+	return stmt, nil
+}
+
+func (w *localWriter) begin() error {
+	if w.tx != nil {
+		return nil
+	}
+	return w.retry(func() error {
+		start := time.Now()
+		tx, err := w.db.Begin()
+		w.stats.LockWait += time.Since(start)
+		if err != nil {
+			return err
+		}
+		w.tx = tx
+		return nil
+	})
+}
+
+// commit 写入未满一批的行并提交事务, 然后更新分段进度
+func (w *localWriter) commit() {
+	for _, rows := range w.buf {
+		w.flush(rows, batchSize(len(rows.Cols)))
+	}
+	var err error
+	if w.tx != nil {
+		err = w.retry(w.tx.Commit)
+		if err != nil {
+			_ = w.tx.Rollback()
+			log.Println("error commit local db:", err)
+		}
+		w.tx = nil
+		w.stats.Transactions++
+	}
+	written := w.written
+	w.written, w.txRows = nil, 0
+	failedTables := make(map[string]bool)
+	for _, batch := range written {
+		batchErr := batch.err
+		if batchErr == nil && err != nil {
+			// 提交失败, 事务中的行都没有写入
+			batchErr = err
+			w.stats.Rows -= int64(len(batch.chunks))
+			w.stats.FailedRows += int64(len(batch.chunks))
+			for _, c := range batch.chunks {
+				if !failedTables[c.TableName] {
+					failedTables[c.TableName] = true
+					w.i.tableError(c.TableName, err)
+				}
+			}
+		}
+		for _, c := range batch.chunks {
+			w.i.chunkWritten(c, batchErr)
+		}
+	}
+}
+
+func (w *localWriter) close() {
+	for _, stmt := range w.stmts {
+		_ = stmt.Close()
+	}
+	w.stmts = nil
+}
+
+// retry 写锁冲突时等待后重试
+func (w *localWriter) retry(fn func() error) error {
+	var err error
+	for n := 1; n <= busyRetries; n++ {
+		if err = fn(); !isBusy(err) {
+			return err
+		}
+		wait := time.Duration(n) * 10 * time.Millisecond
+		w.stats.BusyRetries++
+		w.stats.LockWait += wait
+		time.Sleep(wait)
+	}
+	return err
+}
+
+func isBusy(err error) bool {
+	var e sqlite3.Error
+	return errors.As(err, &e) && (e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked)
+}
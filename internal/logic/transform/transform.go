@@ -0,0 +1,330 @@
+package transform
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sqlsyncify/internal/config"
+	"sqlsyncify/internal/svc"
+	"sqlsyncify/internal/utils"
+	"strings"
+	"time"
+)
+
+// Config 导入后、导出前在本地db上执行 sql-transform 中的sql文件
+type Config struct {
+	Ctx      context.Context
+	DbLocal  *sql.DB
+	Site     string
+	Debug    bool
+	SiteConf *config.SiteConfig
+	// sql文件模板中的变量, 为空时只用站点配置和环境变量
+	TplVars *svc.TemplateVars
+}
+
+type Transformer interface {
+	// Run 按依赖顺序执行, 每个文件一个事务, 出错的文件和依赖它的文件记录在Report中
+	Run() (*Report, error)
+}
+
+// Report 一次转换的结果
+type Report struct {
+	Duration time.Duration `json:"duration"`
+	Files    []*FileReport `json:"files"`
+}
+
+// FileReport sql-transform中一个文件的执行结果
+type FileReport struct {
+	File string `json:"file"`
+	// 依赖层级, 从0开始
+	Level    int           `json:"level"`
+	Duration time.Duration `json:"duration"`
+	// 依赖的文件失败, 没有执行
+	Skipped bool   `json:"skipped"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Err 出错或跳过的文件, 全部成功时返回nil
+func (r *Report) Err() error {
+	var errs []error
+	for _, f := range r.Files {
+		if len(f.Error) > 0 {
+			errs = append(errs, fmt.Errorf("transform %s: %s", f.File, f.Error))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type transformFile struct {
+	Path string
+	// 文件名做表名: category_tree.sql => category_tree
+	Name   string
+	SqlStr string
+	// -- after=cates, post_meta
+	After []string
+	// 查询语句, 结果建表
+	IsSelect bool
+}
+
+type transformerImplement struct {
+	cfg *Config
+}
+
+func NewTransformer(cfg *Config) Transformer {
+	if cfg.TplVars == nil {
+		cfg.TplVars = svc.NewTemplateVars(cfg.Ctx, config.Config{}, cfg.SiteConf)
+	}
+	return &transformerImplement{cfg: cfg}
+}
+
+func (t *transformerImplement) Run() (*Report, error) {
+	start := time.Now()
+	report := &Report{}
+	dirPath := fmt.Sprintf("./etc/sites/%s/sql-transform/", t.cfg.Site)
+	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+		// 没有转换
+		return report, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sqlFiles, err := utils.ScanDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]*transformFile, len(sqlFiles))
+	names := make([]string, 0, len(sqlFiles))
+	deps := make(map[string][]string, len(sqlFiles))
+	for _, file := range sqlFiles {
+		f, err := loadTransformFile(file, t.cfg.TplVars)
+		if err != nil {
+			report.Files = append(report.Files, &FileReport{File: filepath.Base(file), Error: err.Error()})
+			continue
+		}
+		if _, ok := files[f.Name]; ok {
+			report.Files = append(report.Files, &FileReport{File: filepath.Base(file), Error: "duplicate name: " + f.Name})
+			continue
+		}
+		files[f.Name] = f
+		names = append(names, f.Name)
+		deps[f.Name] = f.After
+	}
+	levels, cycleErr := utils.DependencyLevels(names, deps)
+
+	// 失败或跳过的文件, 依赖它们的文件跳过
+	failed := make(map[string]string)
+	for _, r := range report.Files {
+		failed[strings.TrimSuffix(r.File, filepath.Ext(r.File))] = r.Error
+	}
+	done := make(map[string]bool, len(names))
+	for level, group := range levels {
+		for _, name := range group {
+			done[name] = true
+			f := files[name]
+			r := &FileReport{File: filepath.Base(f.Path), Level: level}
+			report.Files = append(report.Files, r)
+			if dep := failedDependency(f, failed); len(dep) > 0 {
+				r.Skipped = true
+				r.Error = fmt.Sprintf("dependency %s failed", dep)
+				failed[name] = r.Error
+				log.Printf("transform %s skipped: %s", r.File, r.Error)
+				continue
+			}
+			fileStart := time.Now()
+			err = t.exec(f)
+			r.Duration = time.Since(fileStart)
+			if err != nil {
+				r.Error = err.Error()
+				failed[name] = r.Error
+				log.Printf("transform %s error: %v", r.File, err)
+				continue
+			}
+			log.Printf("transform %s done: %s", r.File, r.Duration)
+		}
+	}
+	if cycleErr != nil {
+		// 循环依赖中的文件没有执行
+		for _, name := range names {
+			if !done[name] {
+				report.Files = append(report.Files, &FileReport{File: filepath.Base(files[name].Path), Skipped: true, Error: cycleErr.Error()})
+			}
+		}
+	}
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+func loadTransformFile(file string, vars *svc.TemplateVars) (*transformFile, error) {
+	content, err := vars.RenderFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error at load file:%v", err)
+	}
+	sqlStr := strings.TrimSpace(content)
+	stmts := sqlStatements(sqlStr)
+	if len(stmts) == 0 {
+		return nil, fmt.Errorf("empty sql file")
+	}
+	name := filepath.Base(file)
+	f := &transformFile{Path: file, Name: strings.TrimSuffix(name, filepath.Ext(name)), SqlStr: sqlStr}
+	for _, after := range utils.SqlDirectives(sqlStr, "after") {
+		for _, dep := range strings.Split(after, ",") {
+			if dep = strings.TrimSpace(dep); len(dep) > 0 {
+				f.After = append(f.After, dep)
+			}
+		}
+	}
+	// 只有一条查询语句(包括 WITH ... SELECT)时结果建表, 末尾只有注释的空语句不算
+	if len(stmts) == 1 && isQuery(stmts[0]) {
+		f.IsSelect = true
+		f.SqlStr = stmts[0]
+	}
+	return f, nil
+}
+
+// exec 在一个事务中执行文件, 查询语句的结果重建为同名表
+func (t *transformerImplement) exec(f *transformFile) error {
+	sqlStr := f.SqlStr
+	if f.IsSelect {
+		sqlStr = fmt.Sprintf("DROP TABLE IF EXISTS %s;\nCREATE TABLE %s AS\n%s", f.Name, f.Name, strings.TrimSuffix(sqlStr, ";"))
+	}
+	if t.cfg.Debug {
+		log.Println(sqlStr)
+	}
+	tx, err := t.cfg.DbLocal.BeginTx(t.cfg.Ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error at begin transaction:%v", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if _, err = tx.ExecContext(t.cfg.Ctx, sqlStr); err != nil {
+		return fmt.Errorf("error at exec sql:%v", err)
+	}
+	return tx.Commit()
+}
+
+// failedDependency 第一个失败的依赖, 没有时返回空字符串
+func failedDependency(f *transformFile, failed map[string]string) string {
+	for _, dep := range f.After {
+		if _, ok := failed[dep]; ok {
+			return dep
+		}
+	}
+	return ""
+}
+
+// sqlStatements 按分号拆分语句, 引号和注释中的分号不拆分, 只有注释的空语句去掉
+func sqlStatements(sqlStr string) []string {
+	var stmts []string
+	start := 0
+	add := func(end int) {
+		if stmt := strings.TrimSpace(sqlStr[start:end]); len(sqlWords(stmt)) > 0 {
+			stmts = append(stmts, stmt)
+		}
+	}
+	for i := 0; i < len(sqlStr); {
+		if next := skipQuoted(sqlStr, i); next > i {
+			i = next
+			continue
+		}
+		if sqlStr[i] == ';' {
+			add(i)
+			start = i + 1
+		}
+		i++
+	}
+	add(len(sqlStr))
+	return stmts
+}
+
+// isQuery 语句是否为查询: SELECT, VALUES, 或CTE之后是SELECT的 WITH 语句
+func isQuery(stmt string) bool {
+	words := sqlWords(stmt)
+	if len(words) == 0 {
+		return false
+	}
+	switch words[0] {
+	case "SELECT", "VALUES":
+		return true
+	case "WITH":
+		// CTE的查询在括号中, 括号外第一个语句关键字是主语句
+		for _, w := range words[1:] {
+			switch w {
+			case "SELECT", "VALUES":
+				return true
+			case "INSERT", "REPLACE", "UPDATE", "DELETE":
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// sqlWords 括号外的单词(大写), 跳过引号和注释
+func sqlWords(stmt string) []string {
+	var words []string
+	depth := 0
+	for i := 0; i < len(stmt); {
+		if next := skipQuoted(stmt, i); next > i {
+			i = next
+			continue
+		}
+		c := stmt[i]
+		switch {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			end := i
+			for end < len(stmt) && (stmt[end] == '_' || stmt[end] >= 'a' && stmt[end] <= 'z' || stmt[end] >= 'A' && stmt[end] <= 'Z' || stmt[end] >= '0' && stmt[end] <= '9') {
+				end++
+			}
+			if depth == 0 {
+				words = append(words, strings.ToUpper(stmt[i:end]))
+			}
+			i = end
+			continue
+		}
+		i++
+	}
+	return words
+}
+
+// skipQuoted 跳过位置i开始的SQLite引号内容(重复的引号为转义)或注释, 返回之后的位置; 不是引号或注释时返回i
+func skipQuoted(sqlStr string, i int) int {
+	var end int
+	switch c := sqlStr[i]; {
+	case c == '\'' || c == '"' || c == '`' || c == '[':
+		closing := c
+		if c == '[' {
+			closing = ']'
+		}
+		for end = i + 1; end < len(sqlStr); end++ {
+			if sqlStr[end] != closing {
+				continue
+			}
+			if closing != ']' && end+1 < len(sqlStr) && sqlStr[end+1] == closing {
+				end++
+				continue
+			}
+			return end + 1
+		}
+		return len(sqlStr)
+	case strings.HasPrefix(sqlStr[i:], "--"):
+		if end = strings.IndexByte(sqlStr[i:], '\n'); end != -1 {
+			return i + end + 1
+		}
+		return len(sqlStr)
+	case strings.HasPrefix(sqlStr[i:], "/*"):
+		if end = strings.Index(sqlStr[i+2:], "*/"); end != -1 {
+			return i + end + 4
+		}
+		return len(sqlStr)
+	}
+	return i
+}
@@ -0,0 +1,88 @@
+package transform
+
+import (
+	"context"
+	"os"
+	"sqlsyncify/internal/config"
+	"sqlsyncify/internal/svc"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, p := range []string{"etc/sites/demo/sql-transform", "storage"} {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		// 按文件名排序会先执行cate_tree, 依赖要求先执行cate_flat
+		"cate_tree.sql": "-- after=cate_flat\nSELECT parent, group_concat(id) AS children FROM cate_flat GROUP BY parent",
+		"cate_flat.sql": "DROP TABLE IF EXISTS cate_flat;\nCREATE TABLE cate_flat AS SELECT id, parent FROM cates WHERE id > 0;\nCREATE INDEX ix_cate_flat_parent ON cate_flat (parent);",
+		"broken.sql":    "CREATE TABLE broken (id INTEGER);\nINSERT INTO missing_table VALUES (1);",
+		"after_bad.sql": "-- after=broken\nSELECT 1 AS x",
+		"loop_a.sql":    "-- after=loop_b\nSELECT 1 AS x",
+		"loop_b.sql":    "-- after=loop_a\nSELECT 1 AS x",
+		// WITH ... SELECT 也是查询, 引号中的分号和末尾只有注释的语句不拆分出新语句
+		"cate_sub.sql": "-- after=cate_flat\nWITH RECURSIVE sub(id) AS (SELECT 1 UNION ALL SELECT c.id FROM cate_flat c JOIN sub ON c.parent = sub.id)\nSELECT id, 'a;b' AS note FROM sub;\n-- 子分类\n",
+		"comment.sql":  "-- after=cate_flat\n/* 还没有语句; */\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile("etc/sites/demo/sql-transform/"+name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dbLocal, err := svc.NewSqliteConn("demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = dbLocal.Close()
+	}()
+	if _, err = dbLocal.Exec("CREATE TABLE cates (id INTEGER, parent INTEGER); INSERT INTO cates VALUES (1, 0), (2, 1), (3, 1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := NewTransformer(&Config{Ctx: context.Background(), DbLocal: dbLocal, Site: "demo", SiteConf: &config.SiteConfig{Site: "demo"}}).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]*FileReport)
+	for _, f := range report.Files {
+		got[f.File] = f
+	}
+	if len(got) != len(files) {
+		t.Fatalf("report files = %d, want %d", len(got), len(files))
+	}
+	if f := got["cate_tree.sql"]; f.Error != "" || f.Level != 1 {
+		t.Errorf("cate_tree = %+v", f)
+	}
+	if f := got["broken.sql"]; f.Error == "" || f.Skipped {
+		t.Errorf("broken = %+v", f)
+	}
+	if f := got["comment.sql"]; f.Error != "empty sql file" {
+		t.Errorf("comment = %+v", f)
+	}
+	for _, name := range []string{"after_bad.sql", "loop_a.sql", "loop_b.sql"} {
+		if f := got[name]; !f.Skipped || f.Error == "" {
+			t.Errorf("%s = %+v, want skipped", name, f)
+		}
+	}
+	if report.Err() == nil {
+		t.Error("want report error")
+	}
+
+	var children string
+	if err = dbLocal.QueryRow("SELECT children FROM cate_tree WHERE parent = 1").Scan(&children); err != nil || children != "2,3" {
+		t.Errorf("cate_tree children = %s %v", children, err)
+	}
+	var sub string
+	if err = dbLocal.QueryRow("SELECT group_concat(id || note) FROM (SELECT id, note FROM cate_sub ORDER BY id)").Scan(&sub); err != nil || sub != "1a;b,2a;b,3a;b" {
+		t.Errorf("cate_sub = %s %v", sub, err)
+	}
+	// 出错的文件整个事务回滚
+	var n int
+	if err = dbLocal.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'broken'").Scan(&n); err != nil || n != 0 {
+		t.Errorf("broken table should be rolled back: %d %v", n, err)
+	}
+}
@@ -5,10 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"os"
 	"sqlsyncify/internal/config"
-	"strings"
 
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 	"github.com/zeromicro/go-zero/core/conf"
 )
 
@@ -34,7 +35,24 @@ func NewSiteConf(site string) (*config.SiteConfig, error) {
 	return &cfg, nil
 }
 
-func NewDbConn(ds string) (*sql.DB, error) {
+// LoadDocTransforms 读取 etc/sites/{site}/transforms.yaml, 不存在时返回nil
+func LoadDocTransforms(site string) ([]config.DocTransform, error) {
+	ymlFile := fmt.Sprintf("./etc/sites/%s/transforms.yaml", site)
+	if _, err := os.Stat(ymlFile); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	log.Println("load transforms:", ymlFile)
+	var cfg config.DocTransforms
+	if err := conf.Load(ymlFile, &cfg); err != nil {
+		return nil, err
+	}
+	return cfg.Transforms, nil
+}
+
+// LoadDataSourceConf 读取数据源配置
+func LoadDataSourceConf(ds string) (*config.DataSource, error) {
 	// 用于不同的数据源
 	ymlFile := fmt.Sprintf("etc/datasources/%s.yaml", ds)
 	log.Println("load datasource:", ymlFile)
@@ -43,23 +61,32 @@ func NewDbConn(ds string) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	return &dsConf, nil
+}
 
-	//TimeZone = Asia/Shanghai
-	dsConf.TimeZone = strings.ReplaceAll(dsConf.TimeZone, "/", "%2F")
-	// Connect to MySQL
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=False&loc=%s", dsConf.Username, dsConf.Password, dsConf.Host, dsConf.Port, dsConf.Dbname, dsConf.TimeZone)
-	log.Println("DSN", dsn)
-	db, err := sql.Open(dsConf.Driver, dsn)
-	if err != nil {
+// LoadDataSourceGroup 读取 etc/datasources/groups/{name}.yaml 中的分片数据源, 不存在时返回os.ErrNotExist
+func LoadDataSourceGroup(name string) ([]string, error) {
+	ymlFile := fmt.Sprintf("etc/datasources/groups/%s.yaml", name)
+	if _, err := os.Stat(ymlFile); err != nil {
 		return nil, err
 	}
-	if len(dsConf.InitSql) > 0 {
-		_, err = db.Exec(dsConf.InitSql)
-		log.Println("InitSql ", dsConf.InitSql)
-		if err != nil {
-			_ = db.Close()
-			return nil, err
-		}
+	log.Println("load datasource group:", ymlFile)
+	var group config.DataSourceGroup
+	if err := conf.Load(ymlFile, &group); err != nil {
+		return nil, err
+	}
+	if len(group.DataSources) == 0 {
+		return nil, fmt.Errorf("datasource group %s: no datasources", name)
+	}
+	return group.DataSources, nil
+}
+
+// NewDbConn 打开独立的连接, 同步任务应使用ServiceContext.DataSources中共享的连接池
+func NewDbConn(ds string) (*sql.DB, error) {
+	dsConf, err := LoadDataSourceConf(ds)
+	if err != nil {
+		return nil, err
 	}
-	return db, nil
+	db, _, _, err := openDb(dsConf)
+	return db, err
 }
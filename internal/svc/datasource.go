@@ -0,0 +1,253 @@
+package svc
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"log"
+	"sync"
+	"time"
+
+	"sqlsyncify/internal/config"
+)
+
+// DataSource 共享的数据源连接池
+type DataSource struct {
+	Name   string
+	Conf   config.DataSource
+	Db     *sql.DB
+	Driver SourceDriver
+	// 同时执行的查询数上限, 为空时不限制
+	sem chan struct{}
+	// 打开连接池时的连接串, 准备的数据按版本区分
+	dsn string
+	// 正在使用的同步数, 由DataSources.mu保护; 替换后最后一个使用者归还时关闭
+	refs    int
+	retired bool
+}
+
+// Acquire 占用一个查询名额, 超过MaxConcurrency时等待
+func (ds *DataSource) Acquire(ctx context.Context) error {
+	if ds.sem == nil {
+		return nil
+	}
+	select {
+	case ds.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release 释放查询名额
+func (ds *DataSource) Release() {
+	if ds.sem == nil {
+		return
+	}
+	<-ds.sem
+}
+
+// close 关闭连接池, 删除只有这个连接池使用的准备数据
+func (ds *DataSource) close() {
+	_ = ds.Db.Close()
+	if p, ok := ds.Driver.(sourcePreparer); ok && ds.retired {
+		p.Cleanup(ds.dsn)
+	}
+}
+
+// DataSources 数据源注册表
+// 每个 etc/datasources/*.yaml 只打开一次, 在分段之间和多次同步之间共享
+type DataSources struct {
+	mu    sync.Mutex
+	items map[string]*DataSource
+	// 正在打开的数据源, 同名的Get等待同一次打开
+	opening map[string]*openCall
+}
+
+type openCall struct {
+	done chan struct{}
+	err  error
+}
+
+func NewDataSources() *DataSources {
+	return &DataSources{items: make(map[string]*DataSource), opening: make(map[string]*openCall)}
+}
+
+// Get 获取数据源, 第一次使用时打开连接池, 用完后调用Put归还
+// dump文件等需要准备数据的数据源, 数据过期时在锁外重新准备并打开新连接池, 旧连接池在使用者都归还后关闭
+func (d *DataSources) Get(name string) (*DataSource, error) {
+	d.mu.Lock()
+	for {
+		if call, ok := d.opening[name]; ok {
+			d.mu.Unlock()
+			<-call.done
+			if call.err != nil {
+				return nil, call.err
+			}
+			d.mu.Lock()
+			continue
+		}
+		ds, ok := d.items[name]
+		if !ok {
+			break
+		}
+		if p, ok := ds.Driver.(sourcePreparer); !ok || !p.Stale(&ds.Conf) {
+			ds.refs++
+			d.mu.Unlock()
+			return ds, nil
+		}
+		log.Println("datasource changed, reopen:", name)
+		break
+	}
+	call := &openCall{done: make(chan struct{})}
+	d.opening[name] = call
+	d.mu.Unlock()
+
+	ds, err := openDataSource(name)
+
+	d.mu.Lock()
+	delete(d.opening, name)
+	call.err = err
+	close(call.done)
+	if err != nil {
+		d.mu.Unlock()
+		return nil, err
+	}
+	old := d.items[name]
+	d.items[name] = ds
+	ds.refs++
+	if old != nil {
+		// 正在使用旧连接池的同步继续读旧的数据, 不会读到新旧混合的数据
+		old.retired = true
+		if old.refs > 0 {
+			old = nil
+		}
+	}
+	d.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+	return ds, nil
+}
+
+// Put 归还Get得到的数据源, 已被替换的连接池在最后一个使用者归还后关闭
+func (d *DataSources) Put(ds *DataSource) {
+	d.mu.Lock()
+	ds.refs--
+	closing := ds.retired && ds.refs == 0
+	d.mu.Unlock()
+	if closing {
+		ds.close()
+	}
+}
+
+// Close 关闭全部数据源
+func (d *DataSources) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for name, ds := range d.items {
+		_ = ds.Db.Close()
+		delete(d.items, name)
+	}
+}
+
+func openDataSource(name string) (*DataSource, error) {
+	dsConf, err := LoadDataSourceConf(name)
+	if err != nil {
+		return nil, err
+	}
+	db, drv, dsn, err := openDb(dsConf)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	ds := &DataSource{Name: name, Conf: *dsConf, Db: db, Driver: drv, dsn: dsn}
+	if dsConf.MaxConcurrency > 0 {
+		ds.sem = make(chan struct{}, dsConf.MaxConcurrency)
+	}
+	log.Printf("open datasource: %s(%s), maxOpen:%d, maxIdle:%d, lifetime:%ds, concurrency:%d",
+		name, drv.Name(), dsConf.MaxOpenConns, dsConf.MaxIdleConns, dsConf.ConnMaxLifetime, dsConf.MaxConcurrency)
+	return ds, nil
+}
+
+// openDb 打开连接池, InitSql在每个新建的物理连接上执行
+// 需要准备数据的引擎先准备数据, 连接串指向准备好的版本
+func openDb(dsConf *config.DataSource) (*sql.DB, SourceDriver, string, error) {
+	drv, err := GetSourceDriver(dsConf.Driver)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if p, ok := drv.(sourcePreparer); ok {
+		if err = p.Prepare(dsConf); err != nil {
+			return nil, nil, "", err
+		}
+	}
+	dsn, drv, err := buildDsn(dsConf)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	connector, err := newConnector(drv.Name(), dsn)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if len(dsConf.InitSql) > 0 {
+		connector = &initSqlConnector{Connector: connector, initSql: dsConf.InitSql}
+	}
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(dsConf.MaxOpenConns)
+	db.SetMaxIdleConns(dsConf.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(dsConf.ConnMaxLifetime) * time.Second)
+	return db, drv, dsn, nil
+}
+
+func newConnector(driverName, dsn string) (driver.Connector, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	drv := db.Driver()
+	_ = db.Close()
+	if dc, ok := drv.(driver.DriverContext); ok {
+		return dc.OpenConnector(dsn)
+	}
+	return &dsnConnector{dsn: dsn, driver: drv}, nil
+}
+
+// dsnConnector 用于没有实现driver.DriverContext的驱动
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c *dsnConnector) Connect(_ context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// initSqlConnector 新建连接后执行InitSql, 保证连接池中每个连接的会话变量一致
+type initSqlConnector struct {
+	driver.Connector
+	initSql string
+}
+
+func (c *initSqlConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		return conn, nil
+	}
+	if _, err = execer.ExecContext(ctx, c.initSql, nil); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
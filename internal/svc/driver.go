@@ -0,0 +1,225 @@
+package svc
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"sqlsyncify/internal/config"
+	"sqlsyncify/internal/utils"
+)
+
+// SourceDriver 数据源引擎: 连接串, 类型映射到SQLite, 标识符和字面量的写法
+type SourceDriver interface {
+	// Name database/sql注册的驱动名
+	Name() string
+	Dsn(dsConf *config.DataSource) string
+	// MapType 把ColumnType.DatabaseTypeName映射为SQLite类型
+	MapType(dbType string) (string, error)
+	Quote(ident string) string
+	Literal(v any) string
+	// Rewritable 查询能否用MySQL语法树改写, 否则退回字符串拼接
+	Rewritable() bool
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]SourceDriver)
+)
+
+func init() {
+	RegisterSourceDriver(mysqlDriver{}, "mysql")
+	RegisterSourceDriver(postgresDriver{}, "postgres", "postgresql", "pgsql")
+	RegisterSourceDriver(sqliteDriver{}, "sqlite3", "sqlite")
+}
+
+// RegisterSourceDriver 注册数据源引擎, names为配置中Driver可用的名称
+func RegisterSourceDriver(d SourceDriver, names ...string) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	for _, name := range names {
+		drivers[strings.ToLower(name)] = d
+	}
+}
+
+// GetSourceDriver 按配置的Driver获取数据源引擎, 为空时是mysql
+func GetSourceDriver(name string) (SourceDriver, error) {
+	if len(name) == 0 {
+		name = "mysql"
+	}
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	d, ok := drivers[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(drivers))
+		for n := range drivers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unsupported driver: %s, available: %s", name, strings.Join(names, ", "))
+	}
+	return d, nil
+}
+
+// columnTyper 除声明类型外还需要转换值的引擎, 如MySQL的DECIMAL、BIT
+type columnTyper interface {
+	ColumnType(dbType string) (utils.SQLiteType, error)
+}
+
+// ColumnType 数据源列类型对应的本地列类型和值转换
+func ColumnType(drv SourceDriver, dbType string) (utils.SQLiteType, error) {
+	if typer, ok := drv.(columnTyper); ok {
+		return typer.ColumnType(dbType)
+	}
+	decl, err := drv.MapType(dbType)
+	return utils.SQLiteType{Decl: decl}, err
+}
+
+type mysqlDriver struct{}
+
+func (mysqlDriver) Name() string {
+	return "mysql"
+}
+
+func (mysqlDriver) Dsn(dsConf *config.DataSource) string {
+	//TimeZone = Asia/Shanghai
+	tz := strings.ReplaceAll(dsConf.TimeZone, "/", "%2F")
+	if len(tz) == 0 {
+		tz = "Local"
+	}
+	// Connect to MySQL
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=False&loc=%s", dsConf.Username, dsConf.Password, dsConf.Host, dsConf.Port, dsConf.Dbname, tz)
+	if len(dsConf.Params) > 0 {
+		dsn += "&" + dsConf.Params
+	}
+	return dsn
+}
+
+func (mysqlDriver) MapType(dbType string) (string, error) {
+	return utils.MapMySQLTypeToSQLite(dbType)
+}
+
+func (mysqlDriver) ColumnType(dbType string) (utils.SQLiteType, error) {
+	return utils.MySQLType(dbType)
+}
+
+func (mysqlDriver) Quote(ident string) string {
+	return "`" + strings.ReplaceAll(ident, "`", "``") + "`"
+}
+
+func (mysqlDriver) Literal(v any) string {
+	return utils.SqlValue(v)
+}
+
+func (mysqlDriver) Rewritable() bool {
+	return true
+}
+
+// postgresDriver 使用 github.com/lib/pq 注册的postgres驱动
+type postgresDriver struct{}
+
+func (postgresDriver) Name() string {
+	return "postgres"
+}
+
+func (postgresDriver) Dsn(dsConf *config.DataSource) string {
+	port := dsConf.Port
+	if port == 0 {
+		port = 5432
+	}
+	params := []string{
+		"host=" + pgDsnValue(dsConf.Host),
+		fmt.Sprintf("port=%d", port),
+		"user=" + pgDsnValue(dsConf.Username),
+		"password=" + pgDsnValue(dsConf.Password),
+		"dbname=" + pgDsnValue(dsConf.Dbname),
+	}
+	if len(dsConf.TimeZone) > 0 && dsConf.TimeZone != "Local" {
+		params = append(params, "timezone="+pgDsnValue(dsConf.TimeZone))
+	}
+	if !strings.Contains(dsConf.Params, "sslmode=") {
+		params = append(params, "sslmode=disable")
+	}
+	if len(dsConf.Params) > 0 {
+		params = append(params, dsConf.Params)
+	}
+	return strings.Join(params, " ")
+}
+
+// pgDsnValue 连接串中为空或含空格、引号的值要加单引号
+func pgDsnValue(v string) string {
+	if len(v) > 0 && !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	return "'" + strings.ReplaceAll(v, "'", `\'`) + "'"
+}
+
+func (postgresDriver) MapType(dbType string) (string, error) {
+	st, err := utils.PostgresType(dbType)
+	return st.Decl, err
+}
+
+func (postgresDriver) ColumnType(dbType string) (utils.SQLiteType, error) {
+	return utils.PostgresType(dbType)
+}
+
+func (postgresDriver) Quote(ident string) string {
+	return `"` + strings.ReplaceAll(ident, `"`, `""`) + `"`
+}
+
+func (postgresDriver) Literal(v any) string {
+	return utils.SqlStdValue(v)
+}
+
+func (postgresDriver) Rewritable() bool {
+	return false
+}
+
+// sqliteDriver 以另一个SQLite文件为数据源, Dbname为文件路径, 只读打开
+type sqliteDriver struct{}
+
+func (sqliteDriver) Name() string {
+	return "sqlite3"
+}
+
+func (sqliteDriver) Dsn(dsConf *config.DataSource) string {
+	dsn := fmt.Sprintf("file:%s?mode=ro", dsConf.Dbname)
+	if len(dsConf.Params) > 0 {
+		dsn += "&" + dsConf.Params
+	}
+	return dsn
+}
+
+func (sqliteDriver) MapType(dbType string) (string, error) {
+	return utils.MapSQLiteType(dbType)
+}
+
+func (sqliteDriver) Quote(ident string) string {
+	return `"` + strings.ReplaceAll(ident, `"`, `""`) + `"`
+}
+
+func (sqliteDriver) Literal(v any) string {
+	return utils.SqlStdValue(v)
+}
+
+func (sqliteDriver) Rewritable() bool {
+	return false
+}
+
+// LocalDriver 本地SQLite库的写法, 用于在本地库中拼接条件
+func LocalDriver() SourceDriver {
+	return sqliteDriver{}
+}
+
+func buildDsn(dsConf *config.DataSource) (string, SourceDriver, error) {
+	drv, err := GetSourceDriver(dsConf.Driver)
+	if err != nil {
+		return "", nil, err
+	}
+	dsn := drv.Dsn(dsConf)
+	log.Println("DSN", dsn)
+	return dsn, drv, nil
+}
@@ -0,0 +1,35 @@
+package svc
+
+import (
+	"database/sql"
+	"testing"
+
+	"sqlsyncify/internal/config"
+)
+
+func TestPostgresDriver(t *testing.T) {
+	drv, err := GetSourceDriver("pgsql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn := drv.Dsn(&config.DataSource{Driver: "pgsql", Host: "db", Username: "app", Password: "p w'd", Dbname: "blog", TimeZone: "Asia/Shanghai"})
+	if want := `host=db port=5432 user=app password='p w\'d' dbname=blog timezone=Asia/Shanghai sslmode=disable`; dsn != want {
+		t.Errorf("Dsn = %s, want %s", dsn, want)
+	}
+	if dsn := drv.Dsn(&config.DataSource{Host: "db", Port: 6432, Dbname: "blog", Params: "sslmode=require"}); dsn != "host=db port=6432 user='' password='' dbname=blog sslmode=require" {
+		t.Errorf("Dsn = %s", dsn)
+	}
+	// 驱动已注册, Open不连接数据库
+	db, err := sql.Open(drv.Name(), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Close()
+	if got := drv.Quote(`a"b`) + " " + drv.Literal("it's"); got != `"a""b" 'it''s'` {
+		t.Errorf("Quote/Literal = %s", got)
+	}
+	st, err := ColumnType(drv, "NUMERIC")
+	if err != nil || st.Decl != "NUMERIC" || st.Convert == nil {
+		t.Errorf("ColumnType(NUMERIC) = %+v, %v", st, err)
+	}
+}
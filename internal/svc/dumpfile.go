@@ -0,0 +1,271 @@
+package svc
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"sqlsyncify/internal/config"
+	"sqlsyncify/internal/utils"
+)
+
+// sourcePreparer 打开连接前需要先准备数据的引擎
+type sourcePreparer interface {
+	Prepare(dsConf *config.DataSource) error
+	// Stale 准备的数据已过期, 需要重新准备并打开连接池
+	Stale(dsConf *config.DataSource) bool
+	// Cleanup 被替换的连接池关闭后删除它使用的数据, dsn为打开连接池时的连接串
+	Cleanup(dsn string)
+}
+
+func init() {
+	RegisterSourceDriver(dumpfileDriver{}, "dumpfile")
+}
+
+// CheckMaskedSource 配置了脱敏的站点不能使用dumpfile数据源
+// 还原的临时库在 ./storage 中, 是未脱敏的原始数据; 脱敏规则按导入结果的列名匹配, 还原时无法生效
+func CheckMaskedSource(siteConf *config.SiteConfig, name string) error {
+	if len(siteConf.Masks) == 0 {
+		return nil
+	}
+	dsConf, err := LoadDataSourceConf(name)
+	if err != nil {
+		return err
+	}
+	drv, err := GetSourceDriver(dsConf.Driver)
+	if err != nil {
+		return err
+	}
+	if _, ok := drv.(sourcePreparer); ok {
+		return fmt.Errorf("datasource %s: %s restores unmasked data to ./storage, can not be used by a site with Masks", name, dsConf.Driver)
+	}
+	return nil
+}
+
+// dumpfileDriver 以mysqldump文件为数据源, Dbname为dump文件路径(可以是.gz)
+// 导入前把dump中的表还原到临时SQLite库, sql-import的查询在临时库上执行
+type dumpfileDriver struct {
+	sqliteDriver
+}
+
+func (dumpfileDriver) Dsn(dsConf *config.DataSource) string {
+	return sqliteDriver{}.Dsn(&config.DataSource{Dbname: dumpScratchFile(dsConf.Dbname), Params: dsConf.Params})
+}
+
+// MapType 临时库的列保留了MySQL的类型名
+func (dumpfileDriver) MapType(dbType string) (string, error) {
+	if t, err := utils.MapMySQLTypeToSQLite(dbType); err == nil {
+		return t, nil
+	}
+	return utils.MapSQLiteType(dbType)
+}
+
+// ColumnType 临时库中超出精度的数值是BLOB, 数值列都要保留BLOB
+func (d dumpfileDriver) ColumnType(dbType string) (utils.SQLiteType, error) {
+	t, err := utils.MySQLType(dbType)
+	if err != nil {
+		t.Decl, err = utils.MapSQLiteType(dbType)
+	}
+	if t.Convert == nil && (t.Decl == "INTEGER" || t.Decl == "REAL" || t.Decl == "NUMERIC") {
+		t.Convert = utils.ConvertNumber
+	}
+	return t, err
+}
+
+// Prepare 还原dump文件当前修改时间对应的临时库, 已存在时直接使用
+func (d dumpfileDriver) Prepare(dsConf *config.DataSource) error {
+	dump := dsConf.Dbname
+	if _, err := os.Stat(dump); err != nil {
+		return err
+	}
+	scratch := dumpScratchFile(dump)
+	if !d.Stale(dsConf) {
+		log.Println("use restored dump:", scratch)
+		return nil
+	}
+	start := time.Now()
+	tmp, err := os.CreateTemp(filepath.Dir(scratch), filepath.Base(scratch)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpFile := tmp.Name()
+	_ = tmp.Close()
+	if err = restoreDump(dump, tmpFile); err != nil {
+		_ = os.Remove(tmpFile)
+		return fmt.Errorf("error at restore dump %s:%v", dump, err)
+	}
+	if err = os.Rename(tmpFile, scratch); err != nil {
+		_ = os.Remove(tmpFile)
+		return err
+	}
+	log.Printf("restore dump: %s => %s %s", dump, scratch, time.Since(start))
+	return nil
+}
+
+// Stale dump文件当前修改时间(包括替换为更旧的文件)对应的临时库不存在
+func (dumpfileDriver) Stale(dsConf *config.DataSource) bool {
+	_, err := os.Stat(dumpScratchFile(dsConf.Dbname))
+	return err != nil
+}
+
+// Cleanup 删除旧连接池使用的临时库
+func (dumpfileDriver) Cleanup(dsn string) {
+	scratch, _, _ := strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+	if err := os.Remove(scratch); err != nil {
+		log.Println("remove restored dump:", err)
+		return
+	}
+	log.Println("remove restored dump:", scratch)
+}
+
+// dumpScratchFile 临时库路径: ./storage/dump_{文件名}_{路径hash}_{修改时间}.db
+// dump文件更新后还原到新的临时库, 正在使用旧临时库的同步不受影响
+func dumpScratchFile(dump string) string {
+	abs, err := filepath.Abs(dump)
+	if err != nil {
+		abs = dump
+	}
+	var version int64
+	if info, err := os.Stat(dump); err == nil {
+		version = info.ModTime().UnixNano()
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(abs))
+	name := filepath.Base(dump)
+	name = name[:len(name)-len(filepath.Ext(name))]
+	name = strings.TrimSuffix(name, ".sql")
+	return fmt.Sprintf("./storage/dump_%s_%08x_%d.db", name, h.Sum32(), version)
+}
+
+func restoreDump(dump, dbFile string) error {
+	f, err := os.Open(dump)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var r io.Reader = f
+	if strings.HasSuffix(dump, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = gz.Close()
+		}()
+		r = gz
+	}
+
+	db, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	// 临时库, 不需要日志和同步
+	db.SetMaxOpenConns(1)
+	for _, pragma := range []string{"PRAGMA journal_mode=OFF", "PRAGMA synchronous=OFF"} {
+		if _, err = db.Exec(pragma); err != nil {
+			return err
+		}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	loader := &dumpLoader{tx: tx, columns: make(map[string][]string), numbers: make(map[string]map[string]bool), stmts: make(map[string]*sql.Stmt)}
+	if err = utils.ScanDump(r, loader); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, stmt := range loader.stmts {
+		_ = stmt.Close()
+	}
+	return tx.Commit()
+}
+
+// dumpLoader 把dump中的表写入SQLite
+type dumpLoader struct {
+	tx      *sql.Tx
+	columns map[string][]string
+	// 数值列: 表名 => 列名, 超出精度的值按BLOB写入
+	numbers map[string]map[string]bool
+	stmts   map[string]*sql.Stmt
+}
+
+func (l *dumpLoader) CreateTable(table *utils.DumpTable) error {
+	q := sqliteDriver{}.Quote
+	defs := make([]string, len(table.Columns))
+	numbers := make(map[string]bool)
+	for n, col := range table.Columns {
+		decl := table.Types[n]
+		if t, err := utils.MySQLType(decl); err == nil && (t.Decl == "INTEGER" || t.Decl == "NUMERIC") {
+			numbers[col] = true
+		}
+		defs[n] = fmt.Sprintf("%s %s", q(col), decl)
+	}
+	l.numbers[table.Name] = numbers
+	_, err := l.tx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", q(table.Name)))
+	if err == nil {
+		_, err = l.tx.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", q(table.Name), strings.Join(defs, ", ")))
+	}
+	if err != nil {
+		return err
+	}
+	// 保留索引, 方便查询中的关联
+	for n, cols := range table.Indexes {
+		for p := range cols {
+			cols[p] = q(cols[p])
+		}
+		_, err = l.tx.Exec(fmt.Sprintf("CREATE INDEX %s ON %s (%s)", q(fmt.Sprintf("ix_%s_%d", table.Name, n)), q(table.Name), strings.Join(cols, ", ")))
+		if err != nil {
+			return err
+		}
+	}
+	l.columns[table.Name] = table.Columns
+	log.Printf("restore dump table: %s", table.Name)
+	return nil
+}
+
+func (l *dumpLoader) Insert(table string, columns []string, rows [][]any) error {
+	if len(columns) == 0 {
+		columns = l.columns[table]
+	}
+	key := table + "\x00" + strings.Join(columns, ",")
+	stmt, ok := l.stmts[key]
+	if !ok {
+		q := sqliteDriver{}.Quote
+		quoted := make([]string, len(columns))
+		for n, col := range columns {
+			quoted[n] = q(col)
+		}
+		var err error
+		stmt, err = l.tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", q(table), strings.Join(quoted, ", "), strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")))
+		if err != nil {
+			return err
+		}
+		l.stmts[key] = stmt
+	}
+	numbers := l.numbers[table]
+	for _, row := range rows {
+		for n, v := range row {
+			if n < len(columns) && numbers[columns[n]] {
+				// DECIMAL和超出int64的整数按字符串给出
+				row[n] = utils.ConvertNumber(v)
+			}
+		}
+		if _, err := stmt.Exec(row...); err != nil {
+			return fmt.Errorf("insert %s: %v", table, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package svc
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rowEstimator 能用EXPLAIN估算查询行数的引擎
+type rowEstimator interface {
+	// ExplainSql 估算行数的语句
+	ExplainSql(query string) string
+	// EstimateRows 从EXPLAIN的结果计算行数
+	EstimateRows(rows *sql.Rows) (int64, error)
+}
+
+// ExplainSql 引擎不支持估算行数时返回false
+func ExplainSql(drv SourceDriver, query string) (string, bool) {
+	if e, ok := drv.(rowEstimator); ok {
+		return e.ExplainSql(query), true
+	}
+	return "", false
+}
+
+// EstimateRows 按引擎解析EXPLAIN的结果
+func EstimateRows(drv SourceDriver, rows *sql.Rows) (int64, error) {
+	if e, ok := drv.(rowEstimator); ok {
+		return e.EstimateRows(rows)
+	}
+	return 0, errors.ErrUnsupported
+}
+
+func (mysqlDriver) ExplainSql(query string) string {
+	return "EXPLAIN " + query
+}
+
+// EstimateRows 最外层查询(id=1)中每张表的 rows * filtered% 相乘
+func (mysqlDriver) EstimateRows(rows *sql.Rows) (int64, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	idCol, rowsCol, filteredCol := -1, -1, -1
+	for n, col := range columns {
+		switch strings.ToLower(col) {
+		case "id":
+			idCol = n
+		case "rows":
+			rowsCol = n
+		case "filtered":
+			filteredCol = n
+		}
+	}
+	if rowsCol == -1 {
+		return 0, fmt.Errorf("EXPLAIN result has no rows column")
+	}
+	estimate, found := 1.0, false
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		ptrs := make([]any, len(columns))
+		for n := range values {
+			ptrs[n] = &values[n]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return 0, err
+		}
+		if idCol != -1 && values[idCol].String != "1" || !values[rowsCol].Valid {
+			continue
+		}
+		r, err := strconv.ParseFloat(values[rowsCol].String, 64)
+		if err != nil {
+			return 0, fmt.Errorf("EXPLAIN rows: %v", err)
+		}
+		if filteredCol != -1 && values[filteredCol].Valid {
+			if f, err := strconv.ParseFloat(values[filteredCol].String, 64); err == nil {
+				r = r * f / 100
+			}
+		}
+		estimate *= r
+		found = true
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, nil
+	}
+	return int64(math.Round(estimate)), nil
+}
+
+func (postgresDriver) ExplainSql(query string) string {
+	return "EXPLAIN " + query
+}
+
+// 第一行是最外层节点: Seq Scan on posts  (cost=0.00..35.50 rows=2550 width=4)
+var pgPlanRows = regexp.MustCompile(`rows=(\d+)`)
+
+func (postgresDriver) EstimateRows(rows *sql.Rows) (int64, error) {
+	if !rows.Next() {
+		return 0, rows.Err()
+	}
+	var line string
+	if err := rows.Scan(&line); err != nil {
+		return 0, err
+	}
+	m := pgPlanRows.FindStringSubmatch(line)
+	if m == nil {
+		return 0, fmt.Errorf("EXPLAIN result has no rows: %s", line)
+	}
+	return strconv.ParseInt(m[1], 10, 64)
+}
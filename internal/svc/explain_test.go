@@ -0,0 +1,41 @@
+package svc
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// TestEstimateRows 用SQLite构造EXPLAIN的结果
+func TestEstimateRows(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	tests := []struct {
+		drv   SourceDriver
+		query string
+		want  int64
+	}{
+		// posts 1000行过滤50%, 每篇关联4条meta; 子查询(id=2)不计入
+		{mysqlDriver{}, "SELECT 1 AS id, 'p' AS \"table\", 1000 AS \"rows\", 50.0 AS filtered UNION ALL SELECT 1, 'm', 4, 100.0 UNION ALL SELECT 2, 'c', 99, 100.0", 2000},
+		{mysqlDriver{}, "SELECT 1 AS id, NULL AS \"rows\", NULL AS filtered", 0},
+		{postgresDriver{}, "SELECT 'Hash Join  (cost=1.09..2.19 rows=4123 width=12)' AS \"QUERY PLAN\" UNION ALL SELECT '  ->  Seq Scan on posts  (cost=0.00..1.04 rows=4 width=8)'", 4123},
+	}
+	for _, tt := range tests {
+		rows, err := db.Query(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := EstimateRows(tt.drv, rows)
+		_ = rows.Close()
+		if err != nil || got != tt.want {
+			t.Errorf("%s: EstimateRows = %d %v, want %d", tt.drv.Name(), got, err, tt.want)
+		}
+	}
+	if _, ok := ExplainSql(sqliteDriver{}, "SELECT 1"); ok {
+		t.Error("sqlite should not support row estimates")
+	}
+}
@@ -6,10 +6,13 @@ import (
 
 type ServiceContext struct {
 	Config config.Config
+	// 共享的数据源连接池
+	DataSources *DataSources
 }
 
 func NewServiceContext(c config.Config) *ServiceContext {
 	return &ServiceContext{
-		Config: c,
+		Config:      c,
+		DataSources: NewDataSources(),
 	}
 }
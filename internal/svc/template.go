@@ -0,0 +1,201 @@
+package svc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"slices"
+	"sqlsyncify/internal/config"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type queryKey struct{}
+
+// 模板中可以使用的环境变量的前缀, 其他环境变量(如密码)不暴露给模板
+const envPrefix = "SQLSYNCIFY_"
+
+// WithQuery 把请求的query参数放入context, 用于sql和json文件中的 {{ .Query.Int "days" 30 }}
+func WithQuery(ctx context.Context, query url.Values) context.Context {
+	return context.WithValue(ctx, queryKey{}, query)
+}
+
+// TemplateVars sql和json文件模板中的变量
+type TemplateVars struct {
+	Host string
+	Site string
+	Lang string
+	// 站点yaml配置
+	Conf *config.SiteConfig
+	// 站点yaml中 Vars 的自定义变量
+	Vars map[string]string
+	// SQLSYNCIFY_ 开头的环境变量, 去掉前缀: SQLSYNCIFY_DB_NAME => .Env.DB_NAME
+	Env map[string]string
+	// 请求的query参数, 只能按类型读取
+	Query QueryParams
+	// 开始同步的时间, 按站点TimeZone
+	Now time.Time
+}
+
+// NewTemplateVars 站点配置、环境变量和请求参数
+func NewTemplateVars(ctx context.Context, appConf config.Config, siteConf *config.SiteConfig) *TemplateVars {
+	v := &TemplateVars{
+		Host:  appConf.AppHost,
+		Site:  siteConf.Site,
+		Lang:  siteConf.Lang,
+		Conf:  siteConf,
+		Vars:  siteConf.Vars,
+		Env:   make(map[string]string),
+		Query: QueryParams{values: make(map[string]string)},
+		Now:   time.Now(),
+	}
+	if len(siteConf.TimeZone) > 0 {
+		if loc, err := time.LoadLocation(siteConf.TimeZone); err == nil {
+			v.Now = v.Now.In(loc)
+		} else {
+			log.Println("load time zone error:", siteConf.TimeZone, err)
+		}
+	}
+	if v.Vars == nil {
+		v.Vars = make(map[string]string)
+	}
+	for _, kv := range os.Environ() {
+		if k, val, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, envPrefix) {
+			v.Env[strings.TrimPrefix(k, envPrefix)] = val
+		}
+	}
+	if ctx != nil {
+		if query, ok := ctx.Value(queryKey{}).(url.Values); ok {
+			for k, vals := range query {
+				if len(vals) > 0 {
+					v.Query.values[k] = vals[0]
+				}
+			}
+		}
+	}
+	return v
+}
+
+var templateFuncs = template.FuncMap{
+	// {{ .Now.AddDate 0 0 -30 | date }} => 2024-01-01
+	"date": func(t time.Time) string {
+		return t.Format(time.DateOnly)
+	},
+	"datetime": func(t time.Time) string {
+		return t.Format(time.DateTime)
+	},
+	// 变量为空时的默认值: {{ .Vars.days | default "30" }}
+	"default": func(def string, s string) string {
+		if len(s) == 0 {
+			return def
+		}
+		return s
+	},
+}
+
+// QueryParams 请求的query参数, 同名参数取第一个
+// 参数会拼接到SQL中, 只能按类型读取, 值不合法时渲染失败:
+// {{ .Query.Int "days" 30 }}, {{ .Query.Date "from" "2024-01-01" }}, '{{ .Query.Enum "cate" "news" "blog" }}'
+type QueryParams struct {
+	values map[string]string
+}
+
+// Has 是否有参数: {{ if .Query.Has "days" }}
+func (q QueryParams) Has(name string) bool {
+	return len(q.values[name]) > 0
+}
+
+// Int 整数, 没有参数时为def
+func (q QueryParams) Int(name string, def int64) (int64, error) {
+	s, ok := q.values[name]
+	if !ok || len(s) == 0 {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("query %s is not an integer", name)
+	}
+	return n, nil
+}
+
+// Float 数值, 没有参数时为def
+func (q QueryParams) Float(name string, def float64) (float64, error) {
+	s, ok := q.values[name]
+	if !ok || len(s) == 0 {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, fmt.Errorf("query %s is not a number", name)
+	}
+	return f, nil
+}
+
+// Date 日期 2006-01-02, 没有参数时为def
+func (q QueryParams) Date(name, def string) (string, error) {
+	return q.time(name, def, time.DateOnly)
+}
+
+// Datetime 时间 2006-01-02 15:04:05, 没有参数时为def
+func (q QueryParams) Datetime(name, def string) (string, error) {
+	return q.time(name, def, time.DateTime)
+}
+
+func (q QueryParams) time(name, def, layout string) (string, error) {
+	s, ok := q.values[name]
+	if !ok || len(s) == 0 {
+		s = def
+	}
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		return "", fmt.Errorf("query %s is not in format %s", name, layout)
+	}
+	return t.Format(layout), nil
+}
+
+// Enum 只能是列出的值之一, 没有参数时为第一个值
+func (q QueryParams) Enum(name string, allowed ...string) (string, error) {
+	if len(allowed) == 0 {
+		return "", fmt.Errorf("query %s: no allowed values", name)
+	}
+	s, ok := q.values[name]
+	if !ok || len(s) == 0 {
+		return allowed[0], nil
+	}
+	if !slices.Contains(allowed, s) {
+		return "", fmt.Errorf("query %s is not one of %s", name, strings.Join(allowed, ", "))
+	}
+	return s, nil
+}
+
+// Render 替换 {host} {site} {lang}, 再按 text/template 渲染
+func (v *TemplateVars) Render(name, content string) (string, error) {
+	content = strings.NewReplacer("{host}", v.Host, "{site}", v.Site, "{lang}", v.Lang).Replace(content)
+	if !strings.Contains(content, "{{") {
+		return content, nil
+	}
+	tpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(content)
+	if err != nil {
+		return "", fmt.Errorf("error at parse template %s:%v", name, err)
+	}
+	var buf bytes.Buffer
+	if err = tpl.Execute(&buf, v); err != nil {
+		return "", fmt.Errorf("error at render template %s:%v", name, err)
+	}
+	return buf.String(), nil
+}
+
+// RenderFile 读取并渲染文件
+func (v *TemplateVars) RenderFile(file string) (string, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return v.Render(file, string(content))
+}
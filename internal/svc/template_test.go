@@ -0,0 +1,62 @@
+package svc
+
+import (
+	"context"
+	"net/url"
+	"sqlsyncify/internal/config"
+	"testing"
+	"time"
+)
+
+func TestTemplateVars(t *testing.T) {
+	t.Setenv("SQLSYNCIFY_TEST_DB", "shop")
+	t.Setenv("TEST_DB_PASSWORD", "secret")
+	ctx := WithQuery(context.Background(), url.Values{"cate": {"blog"}, "days": {"7"}, "from": {"2024-02-01"}, "evil": {`\' OR 1=1 -- `}})
+	v := NewTemplateVars(ctx, config.Config{AppHost: "http://127.0.0.1:8080"},
+		&config.SiteConfig{Site: "demo", Lang: "en", Vars: map[string]string{"prefix": "wp_"}})
+	v.Now = time.Date(2024, 3, 31, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"{host}/synonym/{site}/{lang}", "http://127.0.0.1:8080/synonym/demo/en"},
+		{"SELECT * FROM {{ .Vars.prefix }}posts WHERE lang = '{lang}'", "SELECT * FROM wp_posts WHERE lang = 'en'"},
+		{"FROM {{ .Env.TEST_DB }}.posts", "FROM shop.posts"},
+		{"{{ .Env.TEST_DB_PASSWORD }}", ""},
+		{"cate = '{{ .Query.Enum \"cate\" \"news\" \"blog\" }}'", "cate = 'blog'"},
+		{"type = '{{ .Query.Enum \"type\" \"post\" \"page\" }}'", "type = 'post'"},
+		{"LIMIT {{ .Query.Int \"limit\" 10 }} -- {{ .Query.Int \"days\" 30 }}", "LIMIT 10 -- 7"},
+		{"{{ if .Query.Has \"days\" }}{{ .Query.Float \"days\" 0 }}{{ end }}", "7"},
+		{"date >= '{{ .Query.Date \"from\" \"2024-01-01\" }}' AND date < '{{ .Query.Date \"to\" \"2024-03-01\" }}'", "date >= '2024-02-01' AND date < '2024-03-01'"},
+		{"LIMIT {{ .Vars.limit | default \"10\" }}", "LIMIT 10"},
+		{"modified >= '{{ .Now.AddDate 0 0 -30 | date }}'", "modified >= '2024-03-01'"},
+		{"{{ .Now | datetime }}", "2024-03-31 08:00:00"},
+		{`{"analyzer": {"type": "custom"}}`, `{"analyzer": {"type": "custom"}}`},
+	}
+	for _, tt := range tests {
+		got, err := v.Render("test", tt.content)
+		if err != nil {
+			t.Errorf("%s: %v", tt.content, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Render(%s) = %s, want %s", tt.content, got, tt.want)
+		}
+	}
+	if _, err := v.Render("bad", "{{ .Now | nofunc }}"); err == nil {
+		t.Error("want parse error")
+	}
+	// 参数不能原样拼接到SQL中, 不合法的值渲染失败
+	for _, content := range []string{
+		"cate = '{{ .Query.evil }}'",
+		"cate = '{{ .Query.Enum \"evil\" \"news\" }}'",
+		"LIMIT {{ .Query.Int \"evil\" 10 }}",
+		"date >= '{{ .Query.Date \"evil\" \"2024-01-01\" }}'",
+		"cate = {{ .Query.cate | quote }}",
+	} {
+		if got, err := v.Render("evil", content); err == nil {
+			t.Errorf("Render(%s) = %s, want error", content, got)
+		}
+	}
+}
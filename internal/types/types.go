@@ -8,10 +8,60 @@ type Request struct {
 	Alias          bool   `form:"alias,optional,default=1"`
 	TestDataSource bool   `form:"testds,optional,default=0"`
 	Debug          bool   `form:"debug,optional,default=0"`
+	Resume         bool   `form:"resume,optional,default=0"`
+	Plan           bool   `form:"plan,optional,default=0"`
+	Rebuild        bool   `form:"rebuild,optional,default=0"`
 }
 
 type Response struct {
-	Message string `json:"message"`
+	Message   string               `json:"message"`
+	Import    *ImportReport        `json:"import,omitempty"`
+	Transform *TransformReport     `json:"transform,omitempty"`
+	Plan      *ImportPlan          `json:"plan,omitempty"`
+	Scripts   []ExportScriptReport `json:"scripts,omitempty"`
+}
+
+type ImportReport struct {
+	Success  bool                `json:"success"`
+	Duration string              `json:"duration"`
+	Files    []ImportFileReport  `json:"files"`
+	Tables   []ImportTableReport `json:"tables"`
+	Writer   ImportWriterStats   `json:"writer"`
+}
+
+type ImportWriterStats struct {
+	Rows          int64   `json:"rows"`
+	FailedRows    int64   `json:"failedRows"`
+	Statements    int64   `json:"statements"`
+	Transactions  int64   `json:"transactions"`
+	BusyRetries   int64   `json:"busyRetries"`
+	LockWait      string  `json:"lockWait"`
+	Elapsed       string  `json:"elapsed"`
+	RowsPerSecond float64 `json:"rowsPerSecond"`
+}
+
+type ImportFileReport struct {
+	File            string   `json:"file"`
+	Table           string   `json:"table"`
+	ChunksPlanned   int64    `json:"chunksPlanned"`
+	ChunksSucceeded int64    `json:"chunksSucceeded"`
+	ChunksFailed    int64    `json:"chunksFailed"`
+	RowsRead        int64    `json:"rowsRead"`
+	RowsWritten     int64    `json:"rowsWritten"`
+	Duration        string   `json:"duration"`
+	Errors          []string `json:"errors"`
+	ErrorCount      int      `json:"errorCount"`
+}
+
+type ImportTableReport struct {
+	Table        string `json:"table"`
+	Shard        string `json:"shard,omitempty"`
+	Chunks       int64  `json:"chunks"`
+	FailedChunks int64  `json:"failedChunks"`
+	SourceRows   int64  `json:"sourceRows"`
+	LocalRows    int64  `json:"localRows"`
+	Missing      int64  `json:"missing"`
+	Unknown      bool   `json:"unknown"`
 }
 
 type SynonymHeadRequest struct {
@@ -25,6 +75,57 @@ type SynonymHeadResponse struct {
 	LastModified string `head:"Last-Modified"`
 }
 
+type ImportFilePlan struct {
+	File          string   `json:"file"`
+	Table         string   `json:"table"`
+	Level         int      `json:"level"`
+	After         []string `json:"after,omitempty"`
+	Priority      int      `json:"priority"`
+	DataSource    string   `json:"dataSource"`
+	Driver        string   `json:"driver"`
+	Key           string   `json:"key"`
+	ChunkMode     string   `json:"chunkMode"`
+	Incremental   string   `json:"incremental,omitempty"`
+	Watermark     string   `json:"watermark,omitempty"`
+	MinKey        string   `json:"minKey,omitempty"`
+	MaxKey        string   `json:"maxKey,omitempty"`
+	Chunks        int      `json:"chunks"`
+	EstimatedRows int64    `json:"estimatedRows"`
+	Sql           string   `json:"sql"`
+	Sqls          []string `json:"sqls"`
+	Error         string   `json:"error,omitempty"`
+}
+
+type ImportPlan struct {
+	Duration string           `json:"duration"`
+	Files    []ImportFilePlan `json:"files"`
+}
+
+type TransformFileReport struct {
+	File     string `json:"file"`
+	Level    int    `json:"level"`
+	Duration string `json:"duration"`
+	Skipped  bool   `json:"skipped"`
+	Error    string `json:"error,omitempty"`
+}
+
+type TransformReport struct {
+	Success  bool                  `json:"success"`
+	Duration string                `json:"duration"`
+	Files    []TransformFileReport `json:"files"`
+}
+
+type ExportScriptReport struct {
+	Script   string `json:"script"`
+	Docs     int64  `json:"docs"`
+	Errors   int64  `json:"errors"`
+	Timeouts int64  `json:"timeouts"`
+	Dropped  int64  `json:"dropped"`
+	Emitted  int64  `json:"emitted"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
 type SynonymRequest struct {
 	Site string `path:"site"`
 	Lang string `path:"lang"`
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DependencyLevels 按依赖关系分层, 每层只依赖之前的层, 同一层按名称排序
+// deps中不在nodes里的依赖忽略, 有循环依赖时返回错误
+func DependencyLevels(nodes []string, deps map[string][]string) ([][]string, error) {
+	known := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		known[n] = true
+	}
+	indegree := make(map[string]int, len(nodes))
+	dependents := make(map[string][]string)
+	for _, n := range nodes {
+		seen := make(map[string]bool)
+		for _, d := range deps[n] {
+			if !known[d] || seen[d] || d == n {
+				continue
+			}
+			seen[d] = true
+			indegree[n]++
+			dependents[d] = append(dependents[d], n)
+		}
+	}
+	var level []string
+	for _, n := range nodes {
+		if indegree[n] == 0 {
+			level = append(level, n)
+		}
+	}
+	var levels [][]string
+	done := 0
+	for len(level) > 0 {
+		sort.Strings(level)
+		levels = append(levels, level)
+		done += len(level)
+		var next []string
+		for _, n := range level {
+			for _, m := range dependents[n] {
+				if indegree[m]--; indegree[m] == 0 {
+					next = append(next, m)
+				}
+			}
+		}
+		level = next
+	}
+	if done < len(nodes) {
+		var cycle []string
+		for _, n := range nodes {
+			if indegree[n] > 0 {
+				cycle = append(cycle, n)
+			}
+		}
+		sort.Strings(cycle)
+		return levels, fmt.Errorf("circular dependency: %s", strings.Join(cycle, ", "))
+	}
+	return levels, nil
+}
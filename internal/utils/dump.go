@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"vitess.io/vitess/go/vt/sqlparser"
+)
+
+// DumpTable mysqldump中CREATE TABLE的表结构
+type DumpTable struct {
+	Name string
+	// 列名和MySQL类型, 如: varchar
+	Columns []string
+	Types   []string
+	// 索引的列, 包括主键
+	Indexes [][]string
+}
+
+// DumpHandler 处理mysqldump中的建表和插入语句
+type DumpHandler interface {
+	CreateTable(table *DumpTable) error
+	// Insert columns为空时按建表的列顺序
+	Insert(table string, columns []string, rows [][]any) error
+}
+
+// ScanDump 逐条读取mysqldump的输出, 只处理CREATE TABLE和INSERT, 其余语句忽略
+// mysqldump每条语句以行末的分号结束, 字符串中的换行会转义
+func ScanDump(r io.Reader, h DumpHandler) error {
+	parser, err := sqlparser.New(sqlparser.Options{
+		TruncateUILen:  512,
+		TruncateErrLen: 0,
+	})
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReaderSize(r, 1<<20)
+	var stmt strings.Builder
+	lineNo, startLine := 0, 0
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+		lineNo++
+		trimmed := strings.TrimSpace(line)
+		if stmt.Len() == 0 && (len(trimmed) == 0 || strings.HasPrefix(trimmed, "--")) {
+			if readErr == io.EOF {
+				return nil
+			}
+			continue
+		}
+		if stmt.Len() == 0 {
+			startLine = lineNo
+		}
+		stmt.WriteString(line)
+		if strings.HasSuffix(trimmed, ";") || readErr == io.EOF {
+			if err = scanDumpStatement(parser, stmt.String(), h); err != nil {
+				return fmt.Errorf("line %d: %v", startLine, err)
+			}
+			stmt.Reset()
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+	}
+}
+
+func scanDumpStatement(parser *sqlparser.Parser, sqlStr string, h DumpHandler) error {
+	head := strings.ToUpper(strings.TrimSpace(sqlStr))
+	if !strings.HasPrefix(head, "CREATE TABLE") && !strings.HasPrefix(head, "INSERT") && !strings.HasPrefix(head, "REPLACE") {
+		return nil
+	}
+	stmt, err := parser.Parse(strings.TrimSuffix(strings.TrimSpace(sqlStr), ";"))
+	if err != nil {
+		return err
+	}
+	switch node := stmt.(type) {
+	case *sqlparser.CreateTable:
+		return h.CreateTable(dumpTable(node))
+	case *sqlparser.Insert:
+		values, ok := node.Rows.(sqlparser.Values)
+		if !ok {
+			return fmt.Errorf("unsupported insert: %s", sqlparser.String(node.Rows))
+		}
+		tableName, err := node.Table.TableName()
+		if err != nil {
+			return err
+		}
+		columns := make([]string, len(node.Columns))
+		for n, col := range node.Columns {
+			columns[n] = col.String()
+		}
+		rows := make([][]any, len(values))
+		for n, tuple := range values {
+			row := make([]any, len(tuple))
+			for p, expr := range tuple {
+				if row[p], err = dumpValue(expr); err != nil {
+					return err
+				}
+			}
+			rows[n] = row
+		}
+		return h.Insert(tableName.Name.String(), columns, rows)
+	}
+	return nil
+}
+
+func dumpTable(node *sqlparser.CreateTable) *DumpTable {
+	table := &DumpTable{Name: node.Table.Name.String()}
+	if node.TableSpec == nil {
+		return table
+	}
+	for _, col := range node.TableSpec.Columns {
+		table.Columns = append(table.Columns, col.Name.String())
+		table.Types = append(table.Types, strings.ToLower(col.Type.Type))
+	}
+	for _, idx := range node.TableSpec.Indexes {
+		var cols []string
+		for _, col := range idx.Columns {
+			if col.Expression != nil {
+				// 函数索引不处理
+				cols = nil
+				break
+			}
+			cols = append(cols, col.Column.String())
+		}
+		if len(cols) > 0 {
+			table.Indexes = append(table.Indexes, cols)
+		}
+	}
+	return table
+}
+
+// dumpValue INSERT语句中的值转为Go的值, 字符串已去掉转义
+func dumpValue(expr sqlparser.Expr) (any, error) {
+	switch node := expr.(type) {
+	case *sqlparser.NullVal:
+		return nil, nil
+	case sqlparser.BoolVal:
+		if node {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case *sqlparser.IntroducerExpr:
+		// _binary '...'
+		return dumpValue(node.Expr)
+	case *sqlparser.UnaryExpr:
+		v, err := dumpValue(node.Expr)
+		if err != nil || node.Operator != sqlparser.UMinusOp {
+			return v, err
+		}
+		switch n := v.(type) {
+		case int64:
+			return -n, nil
+		case float64:
+			return -n, nil
+		case string:
+			return "-" + n, nil
+		}
+		return v, nil
+	case *sqlparser.Literal:
+		switch node.Type {
+		case sqlparser.StrVal, sqlparser.DateVal, sqlparser.TimeVal, sqlparser.TimestampVal:
+			return node.Val, nil
+		case sqlparser.IntVal:
+			if n, err := strconv.ParseInt(node.Val, 10, 64); err == nil {
+				return n, nil
+			}
+			// 超出int64的unsigned bigint按字符串保存
+			return node.Val, nil
+		case sqlparser.FloatVal:
+			return strconv.ParseFloat(node.Val, 64)
+		case sqlparser.DecimalVal:
+			// 保持精度
+			return node.Val, nil
+		case sqlparser.HexVal:
+			return node.HexDecode()
+		case sqlparser.HexNum:
+			lit := &sqlparser.Literal{Val: node.Val[2:]}
+			if len(lit.Val)%2 == 1 {
+				lit.Val = "0" + lit.Val
+			}
+			return lit.HexDecode()
+		case sqlparser.BitNum:
+			return strconv.ParseInt(node.Val[2:], 2, 64)
+		}
+	}
+	return nil, fmt.Errorf("unsupported value: %s", sqlparser.String(expr))
+}
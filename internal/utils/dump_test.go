@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type dumpRecorder struct {
+	tables []*DumpTable
+	rows   map[string][][]any
+}
+
+func (d *dumpRecorder) CreateTable(table *DumpTable) error {
+	d.tables = append(d.tables, table)
+	return nil
+}
+
+func (d *dumpRecorder) Insert(table string, _ []string, rows [][]any) error {
+	d.rows[table] = append(d.rows[table], rows...)
+	return nil
+}
+
+const testDump = "-- MySQL dump 10.13\n" +
+	"/*!40101 SET NAMES utf8mb4 */;\n" +
+	"DROP TABLE IF EXISTS `wp_posts`;\n" +
+	"/*!40101 SET @saved_cs_client     = @@character_set_client */;\n" +
+	"CREATE TABLE `wp_posts` (\n" +
+	"  `ID` bigint unsigned NOT NULL AUTO_INCREMENT,\n" +
+	"  `post_title` text COLLATE utf8mb4_unicode_520_ci NOT NULL,\n" +
+	"  `price` decimal(10,2) DEFAULT NULL,\n" +
+	"  `flag` bit(1) DEFAULT NULL,\n" +
+	"  `raw` blob,\n" +
+	"  PRIMARY KEY (`ID`),\n" +
+	"  KEY `type_status` (`post_title`(20),`ID`)\n" +
+	") ENGINE=InnoDB AUTO_INCREMENT=3 DEFAULT CHARSET=utf8mb4;\n" +
+	"LOCK TABLES `wp_posts` WRITE;\n" +
+	"INSERT INTO `wp_posts` VALUES (1,'it\\'s \\\"ok\\\"\\nline;',-12.50,_binary '\\0',0x4142),(2,'b',NULL,b'1',_binary 'xy');\n" +
+	"UNLOCK TABLES;\n"
+
+func TestScanDump(t *testing.T) {
+	rec := &dumpRecorder{rows: make(map[string][][]any)}
+	if err := ScanDump(strings.NewReader(testDump), rec); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.tables) != 1 {
+		t.Fatalf("tables = %d, want 1", len(rec.tables))
+	}
+	table := rec.tables[0]
+	if !reflect.DeepEqual(table.Columns, []string{"ID", "post_title", "price", "flag", "raw"}) {
+		t.Errorf("columns = %v", table.Columns)
+	}
+	if !reflect.DeepEqual(table.Types, []string{"bigint", "text", "decimal", "bit", "blob"}) {
+		t.Errorf("types = %v", table.Types)
+	}
+	if !reflect.DeepEqual(table.Indexes, [][]string{{"ID"}, {"post_title", "ID"}}) {
+		t.Errorf("indexes = %v", table.Indexes)
+	}
+	want := [][]any{
+		{int64(1), "it's \"ok\"\nline;", "-12.50", "\x00", []byte("AB")},
+		{int64(2), "b", nil, int64(1), "xy"},
+	}
+	if got := rec.rows["wp_posts"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("rows = %#v, want %#v", got, want)
+	}
+}
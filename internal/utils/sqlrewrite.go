@@ -0,0 +1,288 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"vitess.io/vitess/go/vt/sqlparser"
+)
+
+// SqlAddWhere 在查询的WHERE中追加条件, UNION查询追加到每个分支
+// 通过语法树改写, 兼容GROUP BY/ORDER BY/HAVING和子查询
+func SqlAddWhere(sqlStr string, cond string) (string, error) {
+	stmt, err := parseSelect(sqlStr)
+	if err != nil {
+		return "", err
+	}
+	expr, err := parseExpr(cond)
+	if err != nil {
+		return "", err
+	}
+	if err = addWhere(stmt, expr); err != nil {
+		return "", err
+	}
+	return sqlparser.String(stmt), nil
+}
+
+// SqlSetLimit 查询没有LIMIT时加上LIMIT
+func SqlSetLimit(sqlStr string, limit int) (string, error) {
+	stmt, err := parseSelect(sqlStr)
+	if err != nil {
+		return "", err
+	}
+	if stmt.GetLimit() == nil {
+		stmt.SetLimit(sqlparser.NewLimitWithoutOffset(limit))
+	}
+	return sqlparser.String(stmt), nil
+}
+
+// SqlOrderLimit 替换查询的排序并设置LIMIT, 用于按主键游标分页
+func SqlOrderLimit(sqlStr string, orderBy []string, limit int) (string, error) {
+	stmt, err := parseSelect(sqlStr)
+	if err != nil {
+		return "", err
+	}
+	_, isUnion := stmt.(*sqlparser.Union)
+	stmt.SetOrderBy(nil)
+	for _, field := range orderBy {
+		expr, err := parseExpr(field)
+		if err != nil {
+			return "", err
+		}
+		if isUnion {
+			// UNION只能按结果列排序
+			stripQualifier(expr)
+		}
+		stmt.AddOrder(&sqlparser.Order{Expr: expr, Direction: sqlparser.AscOrder})
+	}
+	stmt.SetLimit(sqlparser.NewLimitWithoutOffset(limit))
+	return sqlparser.String(stmt), nil
+}
+
+// SqlAggregate 用原查询的FROM和WHERE生成聚合查询, 如: MIN(id) AS minId, MAX(id) AS maxId
+// 去掉GROUP BY/HAVING/ORDER BY/LIMIT, UNION查询作为子查询处理
+func SqlAggregate(sqlStr string, selectExprs string) (string, error) {
+	stmt, err := parseSelect(sqlStr)
+	if err != nil {
+		return "", err
+	}
+	exprs, err := parseSelectExprs(selectExprs)
+	if err != nil {
+		return "", err
+	}
+	switch node := stmt.(type) {
+	case *sqlparser.Select:
+		node.SelectExprs = exprs
+		node.Distinct = false
+		node.GroupBy = nil
+		node.Having = nil
+		node.OrderBy = nil
+		node.Limit = nil
+		return sqlparser.String(node), nil
+	case *sqlparser.Union:
+		node.OrderBy = nil
+		node.Limit = nil
+		stripQualifier(exprs)
+		return fmt.Sprintf("select %s from (%s) as _t", sqlparser.String(exprs), sqlparser.String(node)), nil
+	}
+	return "", fmt.Errorf("not a select statement")
+}
+
+// SqlValue 拼接到SQL中的字面量
+func SqlValue(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%d", val)
+	case float32, float64:
+		return fmt.Sprintf("%v", val)
+	case json.Number:
+		if _, err := strconv.ParseFloat(string(val), 64); err == nil {
+			return string(val)
+		}
+		return sqlparser.String(sqlparser.NewStrLiteral(string(val)))
+	case []byte:
+		return sqlparser.String(sqlparser.NewStrLiteral(string(val)))
+	case string:
+		return sqlparser.String(sqlparser.NewStrLiteral(val))
+	default:
+		return sqlparser.String(sqlparser.NewStrLiteral(fmt.Sprintf("%v", val)))
+	}
+}
+
+// SqlStdValue 标准SQL的字面量, 字符串中的单引号写两次, 用于SQLite
+func SqlStdValue(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%d", val)
+	case float32, float64:
+		return fmt.Sprintf("%v", val)
+	case json.Number:
+		if _, err := strconv.ParseFloat(string(val), 64); err == nil {
+			return string(val)
+		}
+		return stdQuote(string(val))
+	case []byte:
+		return stdQuote(string(val))
+	case string:
+		return stdQuote(val)
+	default:
+		return stdQuote(fmt.Sprintf("%v", val))
+	}
+}
+
+func stdQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func parseSelect(sqlStr string) (sqlparser.TableStatement, error) {
+	stmt, err := ParseSql(sqlStr)
+	if err != nil {
+		return nil, err
+	}
+	sel, ok := stmt.(sqlparser.TableStatement)
+	if !ok {
+		return nil, fmt.Errorf("not a select statement")
+	}
+	return sel, nil
+}
+
+func parseSelectExprs(exprs string) (*sqlparser.SelectExprs, error) {
+	stmt, err := ParseSql("select " + exprs)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.(*sqlparser.Select).SelectExprs, nil
+}
+
+func parseExpr(expr string) (sqlparser.Expr, error) {
+	exprs, err := parseSelectExprs(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(exprs.Exprs) != 1 {
+		return nil, fmt.Errorf("invalid expression: %s", expr)
+	}
+	aliased, ok := exprs.Exprs[0].(*sqlparser.AliasedExpr)
+	if !ok {
+		return nil, fmt.Errorf("invalid expression: %s", expr)
+	}
+	return aliased.Expr, nil
+}
+
+func addWhere(stmt sqlparser.TableStatement, expr sqlparser.Expr) error {
+	switch node := stmt.(type) {
+	case *sqlparser.Select:
+		node.AddWhere(sqlparser.CloneExpr(expr))
+		return nil
+	case *sqlparser.Union:
+		if err := addWhere(node.Left, expr); err != nil {
+			return err
+		}
+		return addWhere(node.Right, expr)
+	}
+	return fmt.Errorf("unsupported statement: %T", stmt)
+}
+
+// stripQualifier 去掉字段的表名: wp.ID => ID
+func stripQualifier(node sqlparser.SQLNode) {
+	sqlparser.Rewrite(node, func(cursor *sqlparser.Cursor) bool {
+		if col, ok := cursor.Node().(*sqlparser.ColName); ok {
+			col.Qualifier = sqlparser.TableName{}
+		}
+		return true
+	}, nil)
+}
+
+// SqlDirective 读取sql文件中的指令注释, 如: -- key=wp.ID
+// 未设置时返回空字符串
+func SqlDirective(sqlStr, name string) string {
+	prefix := fmt.Sprintf("-- %s=", name)
+	pos := strings.Index(sqlStr, prefix)
+	if pos == -1 {
+		return ""
+	}
+	val := sqlStr[pos+len(prefix):]
+	if end := strings.Index(val, "\n"); end != -1 {
+		val = val[:end]
+	}
+	return strings.Trim(val, " \t\r\n")
+}
+
+// SqlDirectives 读取可以出现多次的指令, 如: -- index=ID
+func SqlDirectives(sqlStr, name string) []string {
+	prefix := fmt.Sprintf("-- %s=", name)
+	var ret []string
+	for _, line := range strings.Split(sqlStr, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, prefix) {
+			if val := strings.TrimSpace(line[len(prefix):]); len(val) > 0 {
+				ret = append(ret, val)
+			}
+		}
+	}
+	return ret
+}
+
+// SqlTopLevelKeywords 查询最外层(不在括号、引号和注释中)出现的单词, 转为大写
+// 不能改写语法树时用于判断能否直接在末尾拼接条件
+func SqlTopLevelKeywords(sqlStr string) map[string]bool {
+	ret := make(map[string]bool)
+	depth := 0
+	word := strings.Builder{}
+	endWord := func() {
+		if word.Len() > 0 && depth == 0 {
+			ret[strings.ToUpper(word.String())] = true
+		}
+		word.Reset()
+	}
+	for i := 0; i < len(sqlStr); i++ {
+		c := sqlStr[i]
+		switch {
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9':
+			word.WriteByte(c)
+			continue
+		case c == '\'' || c == '"' || c == '`':
+			// 引号内的内容, 重复的引号为转义
+			for i++; i < len(sqlStr); i++ {
+				if sqlStr[i] == '\\' && c == '\'' {
+					i++
+				} else if sqlStr[i] == c {
+					if i+1 < len(sqlStr) && sqlStr[i+1] == c {
+						i++
+						continue
+					}
+					break
+				}
+			}
+		case c == '-' && strings.HasPrefix(sqlStr[i:], "--"):
+			if end := strings.IndexByte(sqlStr[i:], '\n'); end != -1 {
+				i += end
+			} else {
+				i = len(sqlStr)
+			}
+		case c == '/' && strings.HasPrefix(sqlStr[i:], "/*"):
+			if end := strings.Index(sqlStr[i+2:], "*/"); end != -1 {
+				i += end + 3
+			} else {
+				i = len(sqlStr)
+			}
+		case c == '(':
+			endWord()
+			depth++
+			continue
+		case c == ')':
+			endWord()
+			depth--
+			continue
+		}
+		endWord()
+	}
+	endWord()
+	return ret
+}
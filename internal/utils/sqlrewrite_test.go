@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSqlAddWhere(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		cond string
+		want string
+	}{
+		{name: "no where", sql: "select a from t", cond: "id between 1 and 10",
+			want: "select a from t where id between 1 and 10"},
+		{name: "group by", sql: "-- key=wp.ID\nselect wp.ID, count(*) as c from wp_posts as wp where wp.post_type = 'post' group by wp.ID", cond: "wp.ID between 1 and 10",
+			want: "select wp.ID, count(*) as c from wp_posts as wp where wp.post_type = 'post' and wp.ID between 1 and 10 group by wp.ID"},
+		{name: "order by having", sql: "select a, count(*) as c from t group by a having c > 1 order by a", cond: "a > 1",
+			want: "select a, count(*) as c from t where a > 1 group by a having c > 1 order by a asc"},
+		{name: "subquery", sql: "select a from t where a in (select b from t2 where b > 0)", cond: "a < 5",
+			want: "select a from t where a in (select b from t2 where b > 0) and a < 5"},
+		{name: "union", sql: "select a from t union select a from t2", cond: "a < 5",
+			want: "select a from t where a < 5 union select a from t2 where a < 5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SqlAddWhere(tt.sql, tt.cond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("SqlAddWhere() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSqlAggregate(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want string
+	}{
+		{name: "group by", sql: "select wp.ID, count(*) as c from wp_posts as wp where wp.ID > 0 group by wp.ID having c > 1 order by wp.ID limit 10",
+			want: "select min(wp.ID) as minId, max(wp.ID) as maxId from wp_posts as wp where wp.ID > 0"},
+		{name: "union", sql: "select wp.ID from wp_posts as wp union select wp.ID from wp_pages as wp",
+			want: "select min(ID) as minId, max(ID) as maxId from (select wp.ID from wp_posts as wp union select wp.ID from wp_pages as wp) as _t"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SqlAggregate(tt.sql, "MIN(wp.ID) AS minId, MAX(wp.ID) AS maxId")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("SqlAggregate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSqlLimit(t *testing.T) {
+	got, err := SqlSetLimit("select a from t group by a", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "select a from t group by a limit 10"; got != want {
+		t.Errorf("SqlSetLimit() = %v, want %v", got, want)
+	}
+	got, err = SqlOrderLimit("select a.x, a.y from t as a order by a.y desc", []string{"a.x", "a.y"}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "select a.x, a.y from t as a order by a.x asc, a.y asc limit 100"; got != want {
+		t.Errorf("SqlOrderLimit() = %v, want %v", got, want)
+	}
+}
+
+func TestSqlTopLevelKeywords(t *testing.T) {
+	kw := SqlTopLevelKeywords("select a, (select max(b) from u where u.id = t.id limit 1) as m from t -- order by a\n where c = 'x group by' /* limit */")
+	for _, w := range []string{"SELECT", "FROM", "WHERE"} {
+		if !kw[w] {
+			t.Errorf("%s not found", w)
+		}
+	}
+	for _, w := range []string{"LIMIT", "ORDER", "GROUP", "U"} {
+		if kw[w] {
+			t.Errorf("%s should be ignored", w)
+		}
+	}
+}
+
+func TestSqlValue(t *testing.T) {
+	tests := []struct {
+		v    any
+		want string
+	}{
+		{v: nil, want: "null"},
+		{v: int64(12), want: "12"},
+		{v: json.Number("18446744073709551615"), want: "18446744073709551615"},
+		{v: "it's", want: "'it\\'s'"},
+	}
+	for _, tt := range tests {
+		if got := SqlValue(tt.v); got != tt.want {
+			t.Errorf("SqlValue(%v) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// SQLiteType 本地列的声明类型和值转换
+type SQLiteType struct {
+	// 建表时的声明类型, 决定SQLite的类型亲和性
+	Decl string
+	// 写入前转换数据源返回的值, nil时[]byte转为string
+	Convert func(v any) any
+}
+
+// mysqlTypes MySQL类型(database/sql的DatabaseTypeName或建表语句中的类型)到SQLite的映射
+var mysqlTypes = map[string]SQLiteType{
+	"TINYINT":         {Decl: "INTEGER"},
+	"SMALLINT":        {Decl: "INTEGER"},
+	"MEDIUMINT":       {Decl: "INTEGER"},
+	"INT":             {Decl: "INTEGER"},
+	"INTEGER":         {Decl: "INTEGER"},
+	"BIGINT":          {Decl: "INTEGER"},
+	"UNSIGNED BIGINT": {Decl: "INTEGER", Convert: ConvertNumber},
+	"YEAR":            {Decl: "INTEGER"},
+	"BIT":             {Decl: "INTEGER", Convert: ConvertBit},
+	"BOOL":            {Decl: "INTEGER"},
+	"BOOLEAN":         {Decl: "INTEGER"},
+	"FLOAT":           {Decl: "REAL"},
+	"DOUBLE":          {Decl: "REAL"},
+	"REAL":            {Decl: "REAL"},
+	// NUMERIC亲和性可以按数值比较和排序, 超过15位有效数字的值按BLOB精确保存
+	"DECIMAL":    {Decl: "NUMERIC", Convert: ConvertNumber},
+	"NUMERIC":    {Decl: "NUMERIC", Convert: ConvertNumber},
+	"CHAR":       {Decl: "TEXT"},
+	"VARCHAR":    {Decl: "TEXT"},
+	"TINYTEXT":   {Decl: "TEXT"},
+	"TEXT":       {Decl: "TEXT"},
+	"MEDIUMTEXT": {Decl: "TEXT"},
+	"LONGTEXT":   {Decl: "TEXT"},
+	"JSON":       {Decl: "TEXT"},
+	"ENUM":       {Decl: "TEXT"},
+	// 逗号分隔的多个值
+	"SET":  {Decl: "TEXT"},
+	"NULL": {Decl: "TEXT"},
+	// SQLite 没有专门的 DATE 类型, TIME可以为负数或超过24小时
+	"DATE":       {Decl: "TEXT"},
+	"DATETIME":   {Decl: "TEXT"},
+	"TIMESTAMP":  {Decl: "TEXT"},
+	"TIME":       {Decl: "TEXT"},
+	"BINARY":     {Decl: "BLOB", Convert: ConvertBinary},
+	"VARBINARY":  {Decl: "BLOB", Convert: ConvertBinary},
+	"TINYBLOB":   {Decl: "BLOB", Convert: ConvertBinary},
+	"BLOB":       {Decl: "BLOB", Convert: ConvertBinary},
+	"MEDIUMBLOB": {Decl: "BLOB", Convert: ConvertBinary},
+	"LONGBLOB":   {Decl: "BLOB", Convert: ConvertBinary},
+	// 内部格式: 4字节SRID + WKB
+	"GEOMETRY":           {Decl: "BLOB", Convert: ConvertBytes},
+	"POINT":              {Decl: "BLOB", Convert: ConvertBytes},
+	"LINESTRING":         {Decl: "BLOB", Convert: ConvertBytes},
+	"POLYGON":            {Decl: "BLOB", Convert: ConvertBytes},
+	"MULTIPOINT":         {Decl: "BLOB", Convert: ConvertBytes},
+	"MULTILINESTRING":    {Decl: "BLOB", Convert: ConvertBytes},
+	"MULTIPOLYGON":       {Decl: "BLOB", Convert: ConvertBytes},
+	"GEOMETRYCOLLECTION": {Decl: "BLOB", Convert: ConvertBytes},
+	"VECTOR":             {Decl: "BLOB", Convert: ConvertBytes},
+}
+
+// MySQLType 查找MySQL类型的映射, 如: UNSIGNED BIGINT, bigint unsigned, varchar
+func MySQLType(mysqlType string) (SQLiteType, error) {
+	t := strings.ToUpper(strings.TrimSpace(mysqlType))
+	unsigned := strings.Contains(t, "UNSIGNED")
+	t = strings.TrimSpace(strings.ReplaceAll(t, "UNSIGNED", ""))
+	if unsigned && t == "BIGINT" {
+		t = "UNSIGNED BIGINT"
+	}
+	if st, ok := mysqlTypes[t]; ok {
+		return st, nil
+	}
+	return SQLiteType{}, fmt.Errorf("未知的 MySQL 类型: %s", mysqlType)
+}
+
+// MapMySQLTypeToSQLite 映射 MySQL 类型到 SQLite 类型
+func MapMySQLTypeToSQLite(mysqlType string) (string, error) {
+	st, err := MySQLType(mysqlType)
+	return st.Decl, err
+}
+
+// postgresTypes PostgreSQL类型(lib/pq的DatabaseTypeName)到SQLite的映射, 日期时间按time.Time返回
+var postgresTypes = map[string]SQLiteType{
+	"INT2":        {Decl: "INTEGER"},
+	"INT4":        {Decl: "INTEGER"},
+	"INT8":        {Decl: "INTEGER"},
+	"OID":         {Decl: "INTEGER"},
+	"BOOL":        {Decl: "INTEGER"},
+	"FLOAT4":      {Decl: "REAL"},
+	"FLOAT8":      {Decl: "REAL"},
+	"NUMERIC":     {Decl: "NUMERIC", Convert: ConvertNumber},
+	"MONEY":       {Decl: "TEXT", Convert: ConvertText},
+	"CHAR":        {Decl: "TEXT"},
+	"BPCHAR":      {Decl: "TEXT"},
+	"VARCHAR":     {Decl: "TEXT"},
+	"TEXT":        {Decl: "TEXT"},
+	"NAME":        {Decl: "TEXT"},
+	"UUID":        {Decl: "TEXT"},
+	"JSON":        {Decl: "TEXT"},
+	"JSONB":       {Decl: "TEXT"},
+	"XML":         {Decl: "TEXT"},
+	"INET":        {Decl: "TEXT"},
+	"CIDR":        {Decl: "TEXT"},
+	"MACADDR":     {Decl: "TEXT"},
+	"INTERVAL":    {Decl: "TEXT"},
+	"DATE":        {Decl: "TEXT", Convert: ConvertTime("2006-01-02")},
+	"TIME":        {Decl: "TEXT", Convert: ConvertTime("15:04:05.999999")},
+	"TIMETZ":      {Decl: "TEXT", Convert: ConvertTime("15:04:05.999999Z07:00")},
+	"TIMESTAMP":   {Decl: "TEXT", Convert: ConvertTime("2006-01-02 15:04:05.999999")},
+	"TIMESTAMPTZ": {Decl: "TEXT", Convert: ConvertTime("2006-01-02 15:04:05.999999Z07:00")},
+	"BYTEA":       {Decl: "BLOB", Convert: ConvertBytes},
+}
+
+// PostgresType 查找PostgreSQL类型的映射, 数组类型(如 _INT4)按文本保存
+func PostgresType(pgType string) (SQLiteType, error) {
+	t := strings.ToUpper(strings.TrimSpace(pgType))
+	if strings.HasPrefix(t, "_") {
+		return SQLiteType{Decl: "TEXT", Convert: ConvertText}, nil
+	}
+	if st, ok := postgresTypes[t]; ok {
+		return st, nil
+	}
+	return SQLiteType{}, fmt.Errorf("未知的 PostgreSQL 类型: %s", pgType)
+}
+
+// DeclType sql-import中 -- type= 指定的声明类型, 按类型亲和性转换值
+func DeclType(decl string) SQLiteType {
+	st := SQLiteType{Decl: decl}
+	affinity, _ := MapSQLiteType(decl)
+	switch affinity {
+	case "BLOB":
+		st.Convert = ConvertBytes
+	case "TEXT":
+		st.Convert = ConvertText
+	}
+	return st
+}
+
+// ConvertUint64 超出int64的无符号整数按BLOB保存, SQLite不能写入最高位为1的uint64
+func ConvertUint64(v any) any {
+	if n, ok := v.(uint64); ok {
+		if n > math.MaxInt64 {
+			return []byte(strconv.FormatUint(n, 10))
+		}
+		return int64(n)
+	}
+	return v
+}
+
+// ConvertNumber 驱动按字符串返回的数值, 如DECIMAL、BIGINT UNSIGNED
+// 列的亲和性能精确转换的(int64范围内的整数, 不超过15位有效数字的小数)保留字符串, 写入时转为INTEGER或REAL;
+// 其余转为[]byte按BLOB保存: 类型亲和性不转换BLOB, 不会变成丢精度的REAL, 导出时按字符串输出
+func ConvertNumber(v any) any {
+	var s string
+	switch n := v.(type) {
+	case uint64:
+		return ConvertUint64(n)
+	case []byte:
+		s = string(n)
+	case string:
+		s = n
+	default:
+		return v
+	}
+	if exactNumber(s) {
+		return s
+	}
+	return []byte(s)
+}
+
+// exactNumber 写入INTEGER、NUMERIC列时能精确转换的数值, 非数值的字符串按原样写入
+func exactNumber(s string) bool {
+	if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return true
+	}
+	if _, err := strconv.ParseFloat(s, 64); err != nil {
+		return true
+	}
+	digits := 0
+	for _, c := range strings.TrimLeft(strings.TrimLeft(s, "+-"), "0.") {
+		if c == 'e' || c == 'E' {
+			break
+		}
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+	}
+	return digits <= 15
+}
+
+// ConvertBit BIT(n)按大端字节序转为整数, 如 b'101' => 5
+func ConvertBit(v any) any {
+	b, ok := v.([]byte)
+	if !ok {
+		return v
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return ConvertUint64(n)
+}
+
+// ConvertBinary 二进制列中合法的UTF-8文本转为字符串, 其余保留[]byte
+func ConvertBinary(v any) any {
+	if b, ok := v.([]byte); ok && utf8.Valid(b) {
+		return string(b)
+	}
+	return v
+}
+
+// ConvertBytes 保留[]byte, 按BLOB写入
+func ConvertBytes(v any) any {
+	return v
+}
+
+// ConvertText 转为字符串, 按TEXT写入
+func ConvertText(v any) any {
+	switch s := v.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return string(s)
+	case string:
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+// ConvertTime time.Time按layout转为字符串, 与MySQL返回的格式一致
+func ConvertTime(layout string) func(v any) any {
+	return func(v any) any {
+		switch tm := v.(type) {
+		case time.Time:
+			return tm.Format(layout)
+		case []byte:
+			return string(tm)
+		}
+		return v
+	}
+}
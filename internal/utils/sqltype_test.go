@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestMySQLType(t *testing.T) {
+	tests := []struct {
+		mysqlType string
+		decl      string
+		in        any
+		want      any
+	}{
+		{mysqlType: "DECIMAL", decl: "NUMERIC", in: []byte("12.30"), want: "12.30"},
+		{mysqlType: "DECIMAL", decl: "NUMERIC", in: []byte("12345678901234567.25"), want: []byte("12345678901234567.25")},
+		{mysqlType: "UNSIGNED BIGINT", decl: "INTEGER", in: uint64(18446744073709551615), want: []byte("18446744073709551615")},
+		{mysqlType: "UNSIGNED BIGINT", decl: "INTEGER", in: []byte("18446744073709551615"), want: []byte("18446744073709551615")},
+		{mysqlType: "UNSIGNED BIGINT", decl: "INTEGER", in: []byte("9223372036854775807"), want: "9223372036854775807"},
+		{mysqlType: "bigint unsigned", decl: "INTEGER", in: uint64(7), want: int64(7)},
+		{mysqlType: "BIT", decl: "INTEGER", in: []byte{0x01, 0x01}, want: int64(257)},
+		{mysqlType: "JSON", decl: "TEXT", in: []byte(`{"a":1}`), want: `{"a":1}`},
+		{mysqlType: "ENUM", decl: "TEXT"},
+		{mysqlType: "YEAR", decl: "INTEGER"},
+		{mysqlType: "TIME", decl: "TEXT"},
+		{mysqlType: "VARBINARY", decl: "BLOB", in: []byte{0xff, 0x00}, want: []byte{0xff, 0x00}},
+		{mysqlType: "BINARY", decl: "BLOB", in: []byte("abc"), want: "abc"},
+		{mysqlType: "GEOMETRY", decl: "BLOB", in: []byte("abc"), want: []byte("abc")},
+	}
+	for _, tt := range tests {
+		st, err := MySQLType(tt.mysqlType)
+		if err != nil || st.Decl != tt.decl {
+			t.Errorf("MySQLType(%s) = %s, %v, want %s", tt.mysqlType, st.Decl, err, tt.decl)
+			continue
+		}
+		if tt.in == nil {
+			continue
+		}
+		got := tt.in
+		if st.Convert != nil {
+			got = st.Convert(tt.in)
+		} else if b, ok := got.([]byte); ok {
+			got = string(b)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("MySQLType(%s) convert %v = %#v, want %#v", tt.mysqlType, tt.in, got, tt.want)
+		}
+	}
+	if _, err := MySQLType("SERIAL_X"); err == nil {
+		t.Error("unknown type should return error")
+	}
+}
+
+// TestMySQLTypeStored 驱动返回的DECIMAL、BIGINT UNSIGNED写入SQLite后的类型, 比较和排序
+func TestMySQLTypeStored(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+	price, _ := MySQLType("DECIMAL")
+	hits, _ := MySQLType("bigint unsigned")
+	if _, err = db.Exec("CREATE TABLE t (id INTEGER, price " + price.Decl + ", hits " + hits.Decl + ")"); err != nil {
+		t.Fatal(err)
+	}
+	rows := [][]string{
+		{"1", "12.30", "7"},
+		{"2", "9.99", "18446744073709551615"},
+		{"3", "12345678901234567.25", "9223372036854775807"},
+		{"4", "10.00", "18446744073709551614"},
+	}
+	for _, r := range rows {
+		if _, err = db.Exec("INSERT INTO t VALUES (?, ?, ?)", r[0], price.Convert([]byte(r[1])), hits.Convert([]byte(r[2]))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT group_concat(typeof(price) || ':' || price, '|') FROM (SELECT price FROM t ORDER BY id)", "real:12.3|real:9.99|blob:12345678901234567.25|integer:10"},
+		{"SELECT group_concat(typeof(hits) || ':' || hits, '|') FROM (SELECT hits FROM t ORDER BY id)", "integer:7|blob:18446744073709551615|integer:9223372036854775807|blob:18446744073709551614"},
+		// 精确保存的值按数值比较, 超出精度的BLOB大于所有数值
+		{"SELECT group_concat(id) FROM (SELECT id FROM t WHERE price > 10 ORDER BY price)", "1,3"},
+		{"SELECT group_concat(id) FROM (SELECT id FROM t ORDER BY price)", "2,4,1,3"},
+		{"SELECT group_concat(id) FROM (SELECT id FROM t ORDER BY hits)", "1,3,4,2"},
+	}
+	for _, tt := range tests {
+		var got string
+		if err = db.QueryRow(tt.query).Scan(&got); err != nil || got != tt.want {
+			t.Errorf("%s = %s %v, want %s", tt.query, got, err, tt.want)
+		}
+	}
+}
+
+func TestPostgresType(t *testing.T) {
+	tm := time.Date(2024, 1, 2, 3, 4, 5, 600000000, time.FixedZone("", 8*3600))
+	tests := []struct {
+		pgType string
+		decl   string
+		in     any
+		want   any
+	}{
+		{pgType: "INT8", decl: "INTEGER", in: int64(7), want: int64(7)},
+		{pgType: "BOOL", decl: "INTEGER", in: true, want: true},
+		{pgType: "NUMERIC", decl: "NUMERIC", in: []byte("10.00"), want: "10.00"},
+		{pgType: "_INT4", decl: "TEXT", in: []byte("{1,2}"), want: "{1,2}"},
+		{pgType: "JSONB", decl: "TEXT", in: []byte(`{"a":1}`), want: `{"a":1}`},
+		{pgType: "DATE", decl: "TEXT", in: tm, want: "2024-01-02"},
+		{pgType: "TIMESTAMP", decl: "TEXT", in: tm, want: "2024-01-02 03:04:05.6"},
+		{pgType: "TIMESTAMPTZ", decl: "TEXT", in: tm, want: "2024-01-02 03:04:05.6+08:00"},
+		{pgType: "BYTEA", decl: "BLOB", in: []byte{0xff}, want: []byte{0xff}},
+	}
+	for _, tt := range tests {
+		st, err := PostgresType(tt.pgType)
+		if err != nil || st.Decl != tt.decl {
+			t.Errorf("PostgresType(%s) = %s, %v, want %s", tt.pgType, st.Decl, err, tt.decl)
+			continue
+		}
+		got := tt.in
+		if st.Convert != nil {
+			got = st.Convert(tt.in)
+		} else if b, ok := got.([]byte); ok {
+			got = string(b)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("PostgresType(%s) convert %v = %#v, want %#v", tt.pgType, tt.in, got, tt.want)
+		}
+	}
+	if _, err := PostgresType("TSVECTOR"); err == nil {
+		t.Error("unknown type should return error")
+	}
+}
@@ -20,7 +20,11 @@ func IsPrefix(str string, prefix string) bool {
 	return strings.EqualFold(tmp, prefix)
 }
 
-func ScanDir(dirPath string) ([]string, error) {
+// ScanDir 列出目录中指定扩展名的文件, 未指定时为.sql
+func ScanDir(dirPath string, exts ...string) ([]string, error) {
+	if len(exts) == 0 {
+		exts = []string{".sql"}
+	}
 	// 使用filepath.Walk遍历目录
 	log.Printf("scan dir: %s\n", dirPath)
 	var sqlFiles []string
@@ -32,7 +36,7 @@ func ScanDir(dirPath string) ([]string, error) {
 		}
 
 		// 检查是否为文件（排除目录）
-		if !info.IsDir() && filepath.Ext(path) == ".sql" {
+		if !info.IsDir() && InArray(exts, strings.ToLower(filepath.Ext(path))) {
 			log.Println("Found File:", path)
 			sqlFiles = append(sqlFiles, path)
 		}
@@ -172,23 +176,26 @@ func RemoveSqlComment(str string) string {
 	return str
 }
 
-// MapMySQLTypeToSQLite 映射 MySQL 类型到 SQLite 类型
-func MapMySQLTypeToSQLite(mysqlType string) (string, error) {
-	t := strings.ToUpper(mysqlType)
-	t = strings.ReplaceAll(t, "UNSIGNED ", "")
-	switch t {
-	case "INT", "INTEGER", "TINYINT", "SMALLINT", "MEDIUMINT", "BIGINT":
+// MapSQLiteType 按 SQLite 的类型亲和性规则映射声明类型
+func MapSQLiteType(declType string) (string, error) {
+	t := strings.ToUpper(declType)
+	switch {
+	case len(t) == 0:
+		// 表达式列没有声明类型
+		return "", fmt.Errorf("未知的 SQLite 类型: %s", declType)
+	case strings.Contains(t, "INT"):
 		return "INTEGER", nil
-	case "CHAR", "VARCHAR", "TEXT", "TINYTEXT", "MEDIUMTEXT", "LONGTEXT":
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
 		return "TEXT", nil
-	case "DATE", "DATETIME", "TIMESTAMP":
-		return "TEXT", nil // SQLite 没有专门的 DATE 类型
-	case "FLOAT", "DOUBLE", "DECIMAL", "REAL":
-		return "REAL", nil
-	case "BLOB", "TINYBLOB", "MEDIUMBLOB", "LONGBLOB":
+	case strings.Contains(t, "BLOB"):
 		return "BLOB", nil
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"):
+		return "REAL", nil
+	case strings.Contains(t, "BOOL"):
+		return "INTEGER", nil
 	default:
-		return "", fmt.Errorf("未知的 MySQL 类型: %s", mysqlType)
+		// DATE, DATETIME 等按 NUMERIC 亲和性原样保存
+		return "NUMERIC", nil
 	}
 }
 
@@ -171,3 +171,20 @@ func TestSimplePathCheck(t *testing.T) {
 		})
 	}
 }
+
+func TestDependencyLevels(t *testing.T) {
+	levels, err := DependencyLevels([]string{"post_cates", "cates", "posts", "tree"}, map[string][]string{
+		"tree":       {"cates", "post_cates"},
+		"post_cates": {"posts", "wp_terms"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(levels); got != "[[cates posts] [post_cates] [tree]]" {
+		t.Errorf("levels = %s", got)
+	}
+	_, err = DependencyLevels([]string{"a", "b", "c"}, map[string][]string{"a": {"b"}, "b": {"a"}})
+	if err == nil || !strings.Contains(err.Error(), "a, b") {
+		t.Errorf("want circular dependency error, got %v", err)
+	}
+}
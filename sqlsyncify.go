@@ -32,6 +32,7 @@ func main() {
 	defer server.Stop()
 
 	ctx := svc.NewServiceContext(c)
+	defer ctx.DataSources.Close()
 
 	handler.RegisterHandlers(server, ctx)
 